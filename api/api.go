@@ -2,121 +2,432 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/programming-in-th/grader/conf"
 )
 
 type GradingRequest struct {
-	SubmissionID      string
-	TaskID            string
-	TargLang          string
-	Code              []string
-	SyncUpdateChannel chan SyncUpdate
+	SubmissionID string
+	TaskID       string
+	TargLang     string
+	Source
+	SyncUpdateChannel  chan SyncUpdate
+	Accepted           time.Time `json:"-"` // When the API accepted the submission
+	RejudgedAfterCrash bool      `json:"-"` // Set on submissions the grader was judging when it stopped
+}
+
+// Source is the code of a submission, given in one of three ways. Archive takes precedence over Files,
+// and Files over Code
+type Source struct {
+	Code    []string     // Contents of the source files, which are named after the language
+	Files   []SourceFile // Source files with their names
+	Archive []byte       // Zip or tar archive of the source files, optionally gzipped. Base64 encoded in JSON
+}
+
+// SourceFile is one file of a submission. Name is relative to the root of the submission and may contain directories
+type SourceFile struct {
+	Name    string
+	Content string
+}
+
+// RejudgeRequest asks for the stored submissions that match every non-empty field to be judged again
+type RejudgeRequest struct {
+	ID                string          // Set by the grader
+	SubmissionIDs     []string        // Only these submissions
+	TaskIDs           []string        // Only submissions to these tasks
+	Langs             []string        // Only submissions in these languages
+	Verdict           string          // Only submissions whose latest verdict is this, such as "Correct"
+	Since             time.Time       // Only submissions submitted at or after this time
+	Until             time.Time       // Only submissions submitted before this time
+	SyncUpdateChannel chan SyncUpdate `json:"-"`
+}
+
+// SubmissionQuery selects the stored submissions that match every non-empty field
+type SubmissionQuery struct {
+	SubmissionIDs []string  // Only these submissions
+	TaskIDs       []string  // Only submissions to these tasks
+	Langs         []string  // Only submissions in these languages
+	Verdict       string    // Only submissions whose latest verdict is this, such as "Correct"
+	Since         time.Time // Only submissions submitted at or after this time
+	Until         time.Time // Only submissions submitted before this time
+	Limit         int       // At most this many submissions, the ones submitted last. No limit if 0
 }
 
 type syncUpdatePayloadType string
 
 const msgUpdateType syncUpdatePayloadType = "msg"
 const groupUpdateType syncUpdatePayloadType = "group"
+const rejudgeUpdateType syncUpdatePayloadType = "rejudge"
+const flushUpdateType syncUpdatePayloadType = "flush"
 
 type SyncUpdate struct {
 	payloadType  syncUpdatePayloadType
 	submissionID string
+	taskVersion  string
 	payload      interface{}
+
+	rejudgedAfterCrash bool
 }
 
+// SyncUpdateMessage and SyncUpdateGroup carry the version of the task's data the submission is judged on,
+// once the task is loaded. RejudgedAfterCrash is set on every update of a submission that is judged again
+// because the grader stopped while judging it, and earlier updates may have been sent for it
 type SyncUpdateMessage struct {
-	SubmissionID string
-	Message      string
+	SubmissionID       string
+	TaskVersion        string `json:",omitempty"`
+	Message            string
+	RejudgedAfterCrash bool `json:",omitempty"`
 }
 
 type SyncUpdateGroup struct {
-	SubmissionID string
-	Results      interface{}
+	SubmissionID       string
+	TaskVersion        string `json:",omitempty"`
+	Results            interface{}
+	RejudgedAfterCrash bool `json:",omitempty"`
+}
+
+// SyncUpdateRejudge carries the report of a finished rejudge
+type SyncUpdateRejudge struct {
+	RejudgeID string
+	Report    interface{}
 }
 
 // This is endpoint where messages finally get send to the sync client
-func listenAndUpdateSync(ch chan SyncUpdate, port int) {
+// syncUpdateRequest serializes an update into the endpoint of the sync client it is sent to and its body
+func syncUpdateRequest(message SyncUpdate) (string, []byte, error) {
+	var endpoint string
+	var payload interface{}
+	switch message.payloadType {
+	case msgUpdateType:
+		text, ok := message.payload.(string)
+		if !ok {
+			return "", nil, errors.Errorf("Message of submission %s is not a string", message.submissionID)
+		}
+		endpoint, payload = "/message", SyncUpdateMessage{message.submissionID, message.taskVersion, text, message.rejudgedAfterCrash}
+	case groupUpdateType:
+		endpoint, payload = "/group", SyncUpdateGroup{message.submissionID, message.taskVersion, message.payload, message.rejudgedAfterCrash}
+	case rejudgeUpdateType:
+		endpoint, payload = "/rejudge", SyncUpdateRejudge{message.submissionID, message.payload}
+	default:
+		return "", nil, errors.Errorf("Unsupported payload type %s", message.payloadType)
+	}
+	requestBody, err := json.Marshal(payload)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "Sync update of %s not serializable", message.submissionID)
+	}
+	return endpoint, requestBody, nil
+}
+
+// listenAndUpdateSync sends every update on ch to the sync client. An update that cannot be serialized is
+// reported to operators, and a submission whose results cannot be sent is told it got "Judge Error" instead
+func listenAndUpdateSync(ch chan SyncUpdate, port int, config conf.Config) {
 	for {
 		message := <-ch
-
-		var requestBody []byte
-		var err error
+		if message.payloadType == flushUpdateType {
+			close(message.payload.(chan bool))
+			continue
+		}
 
 		baseURL := "http://localhost:" + strconv.Itoa(port)
-		if message.payloadType == msgUpdateType {
-			baseURL += "/message"
-			requestBody, err = json.Marshal(SyncUpdateMessage{message.submissionID, message.payload.(string)})
-			if err != nil {
-				log.Fatal(errors.Wrap(err, "Sync update not serializable"))
+		endpoint, requestBody, err := syncUpdateRequest(message)
+		if err != nil {
+			SendAlert(Alert{SubmissionID: message.submissionID, Message: err.Error()}, config)
+			if message.payloadType != groupUpdateType {
+				continue
 			}
-		} else if message.payloadType == groupUpdateType {
-			baseURL += "/group"
-			requestBody, err = json.Marshal(SyncUpdateGroup{message.submissionID, message.payload})
+			endpoint, requestBody, err = syncUpdateRequest(SyncUpdate{msgUpdateType, message.submissionID, message.taskVersion, conf.IEVerdict, message.rejudgedAfterCrash})
 			if err != nil {
-				log.Fatal(errors.Wrap(err, "Sync update not serializable"))
+				continue
 			}
-		} else {
-			log.Fatal("Unsupported payload type")
 		}
 
 		log.Println(string(requestBody))
-		r, err := http.Post(baseURL, "application/json", bytes.NewBuffer(requestBody))
+		r, err := http.Post(baseURL+endpoint, "application/json", bytes.NewBuffer(requestBody))
 		if err != nil {
 			log.Println(errors.Wrap(err, "Unable to send sync update"))
+			continue
 		}
 		r.Body.Close()
 	}
 }
 
-func SendPrefixGroupResult(submissionID string, prefixGroupStatus interface{}, ch chan SyncUpdate) {
-	ch <- SyncUpdate{groupUpdateType, submissionID, prefixGroupStatus}
+// Alert tells operators about a failure of the grader or of a task, rather than of a submission
+type Alert struct {
+	Time         time.Time
+	SubmissionID string `json:",omitempty"`
+	TaskID       string `json:",omitempty"`
+	Test         int    `json:",omitempty"` // Index of the test, starting at 1
+	BoxID        *int   `json:",omitempty"`
+	Message      string
 }
 
-func SendJudgingCompleteMessage(submissionID string, ch chan SyncUpdate) {
-	ch <- SyncUpdate{msgUpdateType, submissionID, "Complete"}
+// alertTimeout is how long posting an alert may take
+const alertTimeout = 10 * time.Second
+
+// SendAlert logs an alert and posts it to the alert URL of the global configuration, if there is one.
+// It does not wait for the alert to be posted
+func SendAlert(alert Alert, config conf.Config) {
+	if alert.Time.IsZero() {
+		alert.Time = time.Now()
+	}
+	alertBytes, err := json.Marshal(alert)
+	if err != nil {
+		log.Println(errors.Wrap(err, "Alert not serializable"))
+		return
+	}
+	log.Println("Alert:", string(alertBytes))
+	if config.Glob.AlertURL == "" {
+		return
+	}
+	go func() {
+		client := http.Client{Timeout: alertTimeout}
+		r, err := client.Post(config.Glob.AlertURL, "application/json", bytes.NewBuffer(alertBytes))
+		if err != nil {
+			log.Println(errors.Wrap(err, "Unable to send alert"))
+			return
+		}
+		r.Body.Close()
+	}()
+}
+
+// MarkRejudgedAfterCrash returns a channel that passes every update sent on it on to ch, marked as the
+// update of a submission that is judged again after a crash. The returned function must be called once
+// the submission is judged, and returns when every update has been passed on
+func MarkRejudgedAfterCrash(ch chan SyncUpdate) (chan SyncUpdate, func()) {
+	marked := make(chan SyncUpdate)
+	finished := make(chan bool)
+	go func() {
+		for update := range marked {
+			update.rejudgedAfterCrash = true
+			ch <- update
+		}
+		close(finished)
+	}()
+	return marked, func() {
+		close(marked)
+		<-finished
+	}
 }
 
-func SendJudgedTestMessage(submissionID string, testIndex int, ch chan SyncUpdate) {
-	ch <- SyncUpdate{msgUpdateType, submissionID, "Judged test #" + strconv.Itoa(testIndex+1)}
+func SendPrefixGroupResult(submissionID string, taskVersion string, prefixGroupStatus interface{}, ch chan SyncUpdate) {
+	ch <- SyncUpdate{groupUpdateType, submissionID, taskVersion, prefixGroupStatus, false}
 }
 
-func SendCompilationErrorMessage(submissionID string, ch chan SyncUpdate) {
-	ch <- SyncUpdate{msgUpdateType, submissionID, "Compilation Error"}
+func SendJudgingCompleteMessage(submissionID string, taskVersion string, ch chan SyncUpdate) {
+	ch <- SyncUpdate{msgUpdateType, submissionID, taskVersion, "Complete", false}
 }
 
-func SendCompilingMessage(submissionID string, ch chan SyncUpdate) {
-	ch <- SyncUpdate{msgUpdateType, submissionID, "Compiling"}
+func SendJudgedTestMessage(submissionID string, taskVersion string, testIndex int, ch chan SyncUpdate) {
+	ch <- SyncUpdate{msgUpdateType, submissionID, taskVersion, "Judged test #" + strconv.Itoa(testIndex+1), false}
 }
 
-func handleHTTPSubmitRequest(w *http.ResponseWriter, r *http.Request, ch chan GradingRequest, syncUpdateChannel chan SyncUpdate) {
+func SendCompilationErrorMessage(submissionID string, taskVersion string, ch chan SyncUpdate) {
+	ch <- SyncUpdate{msgUpdateType, submissionID, taskVersion, conf.CEVerdict, false}
+}
+
+func SendCompilationTimeLimitExceededMessage(submissionID string, taskVersion string, ch chan SyncUpdate) {
+	ch <- SyncUpdate{msgUpdateType, submissionID, taskVersion, conf.CTLEVerdict, false}
+}
+
+// SendJudgeErrorMessage tells the sync client that the grader could not judge a submission
+func SendJudgeErrorMessage(submissionID string, taskVersion string, ch chan SyncUpdate) {
+	ch <- SyncUpdate{msgUpdateType, submissionID, taskVersion, conf.IEVerdict, false}
+}
+
+func SendCompilingMessage(submissionID string, taskVersion string, ch chan SyncUpdate) {
+	ch <- SyncUpdate{msgUpdateType, submissionID, taskVersion, "Compiling", false}
+}
+
+// SendRejudgeReport sends the report of a finished rejudge. Reports have no submission, so they are sent under the ID of the rejudge
+func SendRejudgeReport(rejudgeID string, report interface{}, ch chan SyncUpdate) {
+	ch <- SyncUpdate{rejudgeUpdateType, rejudgeID, "", report, false}
+}
+
+func handleHTTPSubmitRequest(w *http.ResponseWriter, r *http.Request, ch chan GradingRequest, syncUpdateChannel chan SyncUpdate, done chan bool, config conf.Config) {
 	defer r.Body.Close()
 
 	var request GradingRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
 		http.Error(*w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	request.SyncUpdateChannel = syncUpdateChannel
+	request.Accepted = time.Now()
 
 	log.Println("New request with submission ID", request.SubmissionID)
 
-	// Send request to submission worker
-	ch <- request
+	// The submission is only acknowledged once it is on disk, so it is judged even if the grader stops
+	err = enqueueRequest(request, config)
+	if err != nil {
+		log.Println(err)
+		http.Error(*w, "Cannot queue submission", http.StatusInternalServerError)
+		return
+	}
+
+	// Send request to submission worker. Once the grader is stopping, queued submissions are judged when it
+	// starts again, and others are turned away
+	select {
+	case ch <- request:
+	case <-done:
+		if !queueEnabled(config) {
+			http.Error(*w, "Grader is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+	}
 
 	(*w).Write([]byte("Successfull submission: " + request.SubmissionID))
 }
 
-func InitAPI(ch chan GradingRequest, config conf.Config) {
+// handleHTTPRejudgeRequest starts a rejudge and responds with its ID. Its report is sent to the sync client when it is done
+func handleHTTPRejudgeRequest(w *http.ResponseWriter, r *http.Request, ch chan RejudgeRequest, syncUpdateChannel chan SyncUpdate) {
+	defer r.Body.Close()
+
+	var request RejudgeRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(*w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request.ID = "rejudge_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	request.SyncUpdateChannel = syncUpdateChannel
+
+	log.Println("New rejudge with ID", request.ID)
+
+	ch <- request
+
+	(*w).Write([]byte(request.ID))
+}
+
+// SubmissionQueryHandler answers a query for stored submissions with a value that is sent back as JSON
+type SubmissionQueryHandler func(query SubmissionQuery) (interface{}, error)
+
+// parseSubmissionQuery reads a query for stored submissions from URL parameters. The parameters id, task and
+// lang may be repeated, and since and until are RFC 3339 times
+func parseSubmissionQuery(values url.Values) (SubmissionQuery, error) {
+	query := SubmissionQuery{
+		SubmissionIDs: values["id"],
+		TaskIDs:       values["task"],
+		Langs:         values["lang"],
+		Verdict:       values.Get("verdict"),
+	}
+	for _, bound := range []struct {
+		name string
+		time *time.Time
+	}{{"since", &query.Since}, {"until", &query.Until}} {
+		if values.Get(bound.name) == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, values.Get(bound.name))
+		if err != nil {
+			return query, errors.Wrapf(err, "Invalid %s", bound.name)
+		}
+		*bound.time = parsed
+	}
+	if values.Get("limit") != "" {
+		limit, err := strconv.Atoi(values.Get("limit"))
+		if err != nil || limit < 0 {
+			return query, errors.Errorf("Invalid limit %s", values.Get("limit"))
+		}
+		query.Limit = limit
+	}
+	return query, nil
+}
+
+func handleHTTPSubmissionsRequest(w *http.ResponseWriter, r *http.Request, handler SubmissionQueryHandler) {
+	if r.Method != http.MethodGet {
+		http.Error(*w, "Submissions are queried with GET", http.StatusMethodNotAllowed)
+		return
+	}
+	query, err := parseSubmissionQuery(r.URL.Query())
+	if err != nil {
+		http.Error(*w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	submissions, err := handler(query)
+	if err != nil {
+		log.Println(errors.Wrap(err, "Failed to query submissions"))
+		http.Error(*w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	(*w).Header().Set("Content-Type", "application/json")
+	json.NewEncoder(*w).Encode(submissions)
+}
+
+// NewSyncUpdateChannel returns the channel that updates are sent to the sync client on. Updates are sent
+// one at a time, in the order they arrive
+func NewSyncUpdateChannel(config conf.Config) chan SyncUpdate {
 	syncUpdateChannel := make(chan SyncUpdate)
-	go listenAndUpdateSync(syncUpdateChannel, config.Glob.SyncUpdatePort)
-	http.HandleFunc("/submit", func(w http.ResponseWriter, r *http.Request) {
-		handleHTTPSubmitRequest(&w, r, ch, syncUpdateChannel)
+	go listenAndUpdateSync(syncUpdateChannel, config.Glob.SyncUpdatePort, config)
+	return syncUpdateChannel
+}
+
+// FlushSyncUpdates waits until every update sent on ch before it has been sent to the sync client
+func FlushSyncUpdates(ch chan SyncUpdate) {
+	flushed := make(chan bool)
+	ch <- SyncUpdate{flushUpdateType, "", "", flushed, false}
+	<-flushed
+}
+
+// InitAPI serves the API until done is closed. It then stops accepting requests, and returns once the
+// requests being handled are finished or shutdown expires. It fails if the API cannot be served
+func InitAPI(ch chan GradingRequest,
+	rejudgeChannel chan RejudgeRequest,
+	syncUpdateChannel chan SyncUpdate,
+	submissionQueryHandler SubmissionQueryHandler,
+	done chan bool,
+	shutdown context.Context,
+	config conf.Config) error {
+
+	// Submissions left in the queue by a grader that stopped are judged again, before or alongside new ones
+	recovered, err := recoverQueue(config)
+	if err != nil {
+		log.Println(errors.Wrap(err, "Cannot recover queued submissions"))
+	}
+	go func() {
+		for _, request := range recovered {
+			log.Println("Recovered request with submission ID", request.SubmissionID)
+			request.SyncUpdateChannel = syncUpdateChannel
+			select {
+			case ch <- request:
+			case <-done:
+				return // Still queued, so it is recovered again when the grader starts
+			}
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/submit", func(w http.ResponseWriter, r *http.Request) {
+		handleHTTPSubmitRequest(&w, r, ch, syncUpdateChannel, done, config)
+	})
+	mux.HandleFunc("/rejudge", func(w http.ResponseWriter, r *http.Request) {
+		handleHTTPRejudgeRequest(&w, r, rejudgeChannel, syncUpdateChannel)
+	})
+	mux.HandleFunc("/submissions", func(w http.ResponseWriter, r *http.Request) {
+		handleHTTPSubmissionsRequest(&w, r, submissionQueryHandler)
 	})
-	http.ListenAndServe("localhost:"+strconv.Itoa(config.Glob.SyncListenPort), nil)
+	server := &http.Server{Addr: "localhost:" + strconv.Itoa(config.Glob.SyncListenPort), Handler: mux}
+	stopped := make(chan bool)
+	go func() {
+		<-done
+		err := server.Shutdown(shutdown)
+		if err != nil {
+			log.Println(errors.Wrap(err, "Failed to stop API server"))
+		}
+		close(stopped)
+	}()
+	err = server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return errors.Wrap(err, "API server failed")
+	}
+	<-stopped
+	return nil
 }
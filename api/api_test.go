@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/programming-in-th/grader/conf"
+)
+
+func TestFlushSyncUpdates(t *testing.T) {
+	var mutex sync.Mutex
+	messages := make([]SyncUpdateMessage, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message SyncUpdateMessage
+		json.NewDecoder(r.Body).Decode(&message)
+		mutex.Lock()
+		messages = append(messages, message)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+
+	ch := NewSyncUpdateChannel(conf.Config{Glob: conf.GlobalConfiguration{SyncUpdatePort: port}})
+	SendCompilingMessage("1", "", ch)
+	marked, finish := MarkRejudgedAfterCrash(ch)
+	SendCompilingMessage("2", "", marked)
+	SendJudgingCompleteMessage("2", "v1", marked)
+	finish()
+	FlushSyncUpdates(ch)
+
+	// Every update sent before the flush has reached the sync client, in order
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(messages) != 3 {
+		t.Fatalf("Got %d updates, expected 3", len(messages))
+	}
+	expected := []SyncUpdateMessage{{"1", "", "Compiling", false}, {"2", "", "Compiling", true}, {"2", "v1", "Complete", true}}
+	for i, message := range messages {
+		if message != expected[i] {
+			t.Errorf("Got update %+v, expected %+v", message, expected[i])
+		}
+	}
+}
+
+func TestSyncUpdateNotSerializable(t *testing.T) {
+	var mutex sync.Mutex
+	paths := make([]string, 0)
+	messages := make([]SyncUpdateMessage, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message SyncUpdateMessage
+		json.NewDecoder(r.Body).Decode(&message)
+		mutex.Lock()
+		paths = append(paths, r.URL.Path)
+		messages = append(messages, message)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+
+	// A result that cannot be sent tells the sync client that the submission got Judge Error instead
+	ch := NewSyncUpdateChannel(conf.Config{Glob: conf.GlobalConfiguration{SyncUpdatePort: port}})
+	SendPrefixGroupResult("1", "v1", math.NaN(), ch)
+	FlushSyncUpdates(ch)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(paths) != 1 || paths[0] != "/message" || messages[0] != (SyncUpdateMessage{"1", "v1", conf.IEVerdict, false}) {
+		t.Errorf("Got updates %v %+v, expected a Judge Error message", paths, messages)
+	}
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/conf"
+)
+
+// queueMutex serializes updates to the on-disk queue
+var queueMutex sync.Mutex
+
+// queuedRequest is a submission that was accepted and has not finished judging
+type queuedRequest struct {
+	SubmissionID string
+	TaskID       string
+	TargLang     string
+	Source       Source
+	Accepted     time.Time
+	Started      bool // Judging started, so the grader stopped while judging it if it is still queued
+}
+
+// queueEnabled reports whether the global configuration has an on-disk queue
+func queueEnabled(config conf.Config) bool {
+	return config.Glob.QueuePath != ""
+}
+
+// queuedRequestPath returns the file a submission is queued in. IDs are escaped, so that they cannot leave the queue
+func queuedRequestPath(submissionID string, config conf.Config) string {
+	return path.Join(config.Glob.QueuePath, url.PathEscape(submissionID)+".json")
+}
+
+// writeQueuedRequest replaces the queued copy of a submission whole, so it is never read half written
+func writeQueuedRequest(queued queuedRequest, config conf.Config) error {
+	queuedBytes, err := json.Marshal(queued)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to marshal queued submission %s", queued.SubmissionID)
+	}
+	err = os.MkdirAll(config.Glob.QueuePath, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create queue directory")
+	}
+	queuedPath := queuedRequestPath(queued.SubmissionID, config)
+	err = ioutil.WriteFile(queuedPath+".tmp", queuedBytes, 0644)
+	if err == nil {
+		err = os.Rename(queuedPath+".tmp", queuedPath)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write queued submission %s", queued.SubmissionID)
+	}
+	return nil
+}
+
+// readQueuedRequest reads a submission from the queue
+func readQueuedRequest(submissionID string, config conf.Config) (queuedRequest, error) {
+	queuedBytes, err := ioutil.ReadFile(queuedRequestPath(submissionID, config))
+	if err != nil {
+		return queuedRequest{}, errors.Wrapf(err, "Failed to read queued submission %s", submissionID)
+	}
+	var queued queuedRequest
+	err = json.Unmarshal(queuedBytes, &queued)
+	if err != nil {
+		return queuedRequest{}, errors.Wrapf(err, "Failed to unmarshal queued submission %s", submissionID)
+	}
+	return queued, nil
+}
+
+// enqueueRequest keeps an accepted submission on disk until it is judged
+func enqueueRequest(request GradingRequest, config conf.Config) error {
+	if !queueEnabled(config) {
+		return nil
+	}
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	return writeQueuedRequest(queuedRequest{
+		SubmissionID: request.SubmissionID,
+		TaskID:       request.TaskID,
+		TargLang:     request.TargLang,
+		Source:       request.Source,
+		Accepted:     request.Accepted,
+	}, config)
+}
+
+// StartQueuedRequest records that a queued submission started judging
+func StartQueuedRequest(submissionID string, config conf.Config) error {
+	if !queueEnabled(config) {
+		return nil
+	}
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	queued, err := readQueuedRequest(submissionID, config)
+	if err != nil {
+		return err
+	}
+	queued.Started = true
+	return writeQueuedRequest(queued, config)
+}
+
+// FinishQueuedRequest removes a submission that finished judging from the queue
+func FinishQueuedRequest(submissionID string, config conf.Config) error {
+	if !queueEnabled(config) {
+		return nil
+	}
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	err := os.Remove(queuedRequestPath(submissionID, config))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed to remove queued submission %s", submissionID)
+	}
+	return nil
+}
+
+// recoverQueue reads the submissions left in the queue by a grader that stopped, in the order they were
+// accepted. Submissions that started judging are marked to be rejudged after the crash
+func recoverQueue(config conf.Config) ([]GradingRequest, error) {
+	if !queueEnabled(config) {
+		return nil, nil
+	}
+	entries, err := ioutil.ReadDir(config.Glob.QueuePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list queued submissions")
+	}
+	queued := make([]queuedRequest, 0)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		submissionID, err := url.PathUnescape(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		request, err := readQueuedRequest(submissionID, config)
+		if err != nil {
+			return nil, err
+		}
+		queued = append(queued, request)
+	}
+	sort.SliceStable(queued, func(i, j int) bool {
+		return queued[i].Accepted.Before(queued[j].Accepted)
+	})
+	requests := make([]GradingRequest, 0, len(queued))
+	for _, request := range queued {
+		requests = append(requests, GradingRequest{
+			SubmissionID:       request.SubmissionID,
+			TaskID:             request.TaskID,
+			TargLang:           request.TargLang,
+			Source:             request.Source,
+			Accepted:           request.Accepted,
+			RejudgedAfterCrash: request.Started,
+		})
+	}
+	return requests, nil
+}
+
+// QueuedSubmissionIDs returns the IDs of the submissions left in the queue by a grader that stopped, in the
+// order they were accepted
+func QueuedSubmissionIDs(config conf.Config) ([]string, error) {
+	requests, err := recoverQueue(config)
+	if err != nil {
+		return nil, err
+	}
+	submissionIDs := make([]string, 0, len(requests))
+	for _, request := range requests {
+		submissionIDs = append(submissionIDs, request.SubmissionID)
+	}
+	return submissionIDs, nil
+}
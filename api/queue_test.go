@@ -0,0 +1,63 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/programming-in-th/grader/conf"
+)
+
+func TestQueue(t *testing.T) {
+	queuePath, err := ioutil.TempDir("", "queue_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(queuePath)
+	config := conf.Config{Glob: conf.GlobalConfiguration{QueuePath: queuePath}}
+
+	accepted := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, submissionID := range []string{"waiting", "judging/1", "finished"} {
+		err := enqueueRequest(GradingRequest{SubmissionID: submissionID, TaskID: "a_time_b", TargLang: "cpp14", Source: Source{Code: []string{submissionID}},
+			Accepted: accepted.Add(time.Duration(i) * time.Minute)}, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, submissionID := range []string{"judging/1", "finished"} {
+		err := StartQueuedRequest(submissionID, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = FinishQueuedRequest("finished", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the submission that started judging was judged when the grader stopped
+	recovered, err := recoverQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered) != 2 || recovered[0].SubmissionID != "waiting" || recovered[0].RejudgedAfterCrash ||
+		recovered[1].SubmissionID != "judging/1" || !recovered[1].RejudgedAfterCrash || recovered[1].Source.Code[0] != "judging/1" ||
+		!recovered[1].Accepted.Equal(accepted.Add(time.Minute)) {
+		t.Errorf("Got recovered requests %+v", recovered)
+	}
+
+	submissionIDs, err := QueuedSubmissionIDs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(submissionIDs) != 2 || submissionIDs[0] != "waiting" || submissionIDs[1] != "judging/1" {
+		t.Errorf("Got queued submission IDs %v, expected waiting and judging/1", submissionIDs)
+	}
+
+	// Nothing is queued without a queue path
+	recovered, err = recoverQueue(conf.Config{})
+	if err != nil || len(recovered) != 0 {
+		t.Errorf("Got %+v and error %v without a queue", recovered, err)
+	}
+}
@@ -29,27 +29,106 @@ const (
 	IEVerdict string = "Judge Error"
 	// SKVerdict means the test was skipped because a dependent group was not passed
 	SKVerdict string = "Skipped"
+	// OLEVerdict means the program wrote more output than allowed
+	OLEVerdict string = "Output Limit Exceeded"
+	// ILEVerdict means the program ran out of wall clock time without using up its CPU time, e.g. while sleeping or waiting for input
+	ILEVerdict string = "Idleness Limit Exceeded"
+	// SVVerdict means the program was killed for a forbidden operation, such as a blocked system call
+	SVVerdict string = "Security Violation"
+	// PEVerdict means the output is only wrong in its formatting. Only checkers give this verdict
+	PEVerdict string = "Presentation Error"
+	// CEVerdict means the submission did not compile
+	CEVerdict string = "Compilation Error"
+	// CTLEVerdict means the compiler ran out of time on the submission
+	CTLEVerdict string = "Compilation Time Limit Exceeded"
 )
 
+// LangConfiguration defines how programs of a language are compiled and run. Languages without
+// CompileCommands use the script in compileScripts, and languages without RunCommands the script in runnerScripts
 type LangConfiguration struct {
 	ID        string
 	Extension string
+
+	EntryPoint      string            // Source file compiled or run first, such as Main.java. Defaults to the first file with Extension
+	CompileCommands []string          // Compile command. $SRC expands to all source files, $MAIN is the entry point and $BIN the binary to write
+	RunCommands     []string          // Run command. $BIN is the binary
+	Interpreted     bool              // The source files are run, starting from the entry point. CompileCommands, if any, only check them
+	Env             map[string]string // Extra environment variables for compiling and running. $MEMORY is the memory limit in MB
+	Directories     []string          // Extra host directories the compiler and program can read
+	MaxProcesses    int               // Processes and threads the program may run at once. Defaults to 1
+	StackLimit      int               // Stack size of the program in MB. Only limited by the memory limit if 0
+	WallTimeFactor  float64           // Multiplies the wall clock limit of the compiler and program, for slow starting runtimes
+	VersionCommand  []string          // Prints the version of the toolchain, so that cached binaries are not used after an upgrade
 }
 
 type GlobalConfiguration struct {
-	LangConfig      []LangConfiguration
-	DefaultMessages map[string]string
-	IsolateBinPath  string
-	SyncListenPort  int
-	SyncUpdatePort  int
+	LangConfig       []LangConfiguration
+	DefaultMessages  map[string]string
+	IsolateBinPath   string
+	Sandbox          string // Sandbox backend to run programs in. Defaults to isolate
+	AllowFakeSandbox bool   // The fake backend does not confine programs, so it is only used for development if this is set
+	CgroupPath       string // cgroup v2 directory the native sandbox creates its cgroups in
+	FirstBoxID       int    // Boxes are numbered from FirstBoxID
+	NumBoxes         int    // Maximum number of boxes. Defaults to one per worker
+	OutputLimit      int    // Largest file a program may write in MB, unless its task sets a limit. Defaults to DefaultOutputLimit
+	DiskQuota        int    // Disk space a program may use in its box in MB. Unlimited if 0
+	FileQuota        int    // Number of files a program may create in its box if there is a disk quota. Defaults to DefaultFileQuota
+	SyncListenPort   int
+	SyncUpdatePort   int
+
+	CompileTimeLimit   float64 // CPU time the compiler may use in seconds. Defaults to DefaultCompileTimeLimit
+	CompileMemoryLimit int     // Memory the compiler may use in MB. Defaults to DefaultCompileMemoryLimit
+	BinarySizeLimit    int     // Largest file the compiler may write in MB. Defaults to DefaultBinarySizeLimit
+	SourceSizeLimit    int     // Total size of the source files of a submission in KB, after unpacking. Defaults to DefaultSourceSizeLimit
+
+	CachePath string // Directory compiled binaries and results are cached in, by the hash of their sources. Nothing is cached if empty
+	CacheSize int    // Space the cache may take up in MB. Defaults to DefaultCacheSize
+
+	StorePath      string // Directory submissions and their results are kept in, for rejudging. Nothing is kept if empty
+	StoreRetention int    // Days a submission is kept after it was last judged. Submissions are kept forever if 0
+	StoreJudgings  int    // Most judgings kept for each submission, the latest ones. Every judging is kept if 0
+
+	QueuePath string // Directory accepted submissions are kept in until they are judged, so that they survive a restart. Nothing is kept if empty
+
+	ShutdownTimeout float64 // Seconds the grader waits for submissions being judged to finish when it is stopped. Defaults to DefaultShutdownTimeout
+
+	AlertURL string // URL that failures of the grader and of tasks are posted to as JSON, for operators. They are only logged if empty
 }
 
+// DefaultOutputLimit is the output limit in MB if the global configuration does not set one
+const DefaultOutputLimit = 64
+
+// DefaultFileQuota is the file quota if the global configuration sets a disk quota without one
+const DefaultFileQuota = 100
+
+// Limits of compilation if the global configuration does not set them
+const (
+	DefaultCompileTimeLimit   = 10
+	DefaultCompileMemoryLimit = 512
+	DefaultBinarySizeLimit    = 32
+)
+
+// DefaultSourceSizeLimit is the source size limit in KB if the global configuration does not set one
+const DefaultSourceSizeLimit = 1024
+
+// DefaultCacheSize is the cache size in MB if the global configuration does not set one
+const DefaultCacheSize = 1024
+
+// DefaultShutdownTimeout is the shutdown timeout in seconds if the global configuration does not set one
+const DefaultShutdownTimeout = 60
+
 type Config struct {
 	BasePath string
 	Glob     GlobalConfiguration
 }
 
-var PossibleCheckerVerdicts = []string{ACVerdict, PartialVerdict, WAVerdict, IEVerdict}
+var PossibleCheckerVerdicts = []string{ACVerdict, PartialVerdict, WAVerdict, PEVerdict, IEVerdict}
+
+// requiredMessageVerdicts must have default messages in the global configuration
+var requiredMessageVerdicts = []string{ACVerdict, PartialVerdict, WAVerdict, IEVerdict}
+
+// optionalMessageVerdicts have blank default messages unless the global configuration gives them
+var optionalMessageVerdicts = []string{TLEVerdict, MLEVerdict, REVerdict, OLEVerdict, ILEVerdict, SVVerdict, PEVerdict}
 
 func GetLangCompileConfig(config Config, targLang string) *LangConfiguration {
 	// Find target language's compile configuration
@@ -77,21 +156,43 @@ func readGlobalConfig(globalConfigPath string) (GlobalConfiguration, error) {
 	json.Unmarshal(configFileBytes, &globalConfigInstance)
 
 	// Check that each verdict is present
-	for _, checkerVerdict := range PossibleCheckerVerdicts {
+	for _, checkerVerdict := range requiredMessageVerdicts {
 		if _, exists := globalConfigInstance.DefaultMessages[checkerVerdict]; !exists {
 			return GlobalConfiguration{}, errors.Wrap(err, "Global configuration format incorrect: incomplete parameters")
 		}
 	}
 
 	// Fill blanks for verdicts not specified
-	if _, exists := globalConfigInstance.DefaultMessages[TLEVerdict]; !exists {
-		globalConfigInstance.DefaultMessages[TLEVerdict] = ""
+	for _, verdict := range optionalMessageVerdicts {
+		if _, exists := globalConfigInstance.DefaultMessages[verdict]; !exists {
+			globalConfigInstance.DefaultMessages[verdict] = ""
+		}
+	}
+
+	// Programs must never be able to fill the disk, so there is always an output limit
+	if globalConfigInstance.OutputLimit <= 0 {
+		globalConfigInstance.OutputLimit = DefaultOutputLimit
+	}
+	if globalConfigInstance.DiskQuota > 0 && globalConfigInstance.FileQuota <= 0 {
+		globalConfigInstance.FileQuota = DefaultFileQuota
+	}
+	if globalConfigInstance.CompileTimeLimit <= 0 {
+		globalConfigInstance.CompileTimeLimit = DefaultCompileTimeLimit
+	}
+	if globalConfigInstance.CompileMemoryLimit <= 0 {
+		globalConfigInstance.CompileMemoryLimit = DefaultCompileMemoryLimit
+	}
+	if globalConfigInstance.BinarySizeLimit <= 0 {
+		globalConfigInstance.BinarySizeLimit = DefaultBinarySizeLimit
+	}
+	if globalConfigInstance.SourceSizeLimit <= 0 {
+		globalConfigInstance.SourceSizeLimit = DefaultSourceSizeLimit
 	}
-	if _, exists := globalConfigInstance.DefaultMessages[MLEVerdict]; !exists {
-		globalConfigInstance.DefaultMessages[MLEVerdict] = ""
+	if globalConfigInstance.CacheSize <= 0 {
+		globalConfigInstance.CacheSize = DefaultCacheSize
 	}
-	if _, exists := globalConfigInstance.DefaultMessages[REVerdict]; !exists {
-		globalConfigInstance.DefaultMessages[REVerdict] = ""
+	if globalConfigInstance.ShutdownTimeout <= 0 {
+		globalConfigInstance.ShutdownTimeout = DefaultShutdownTimeout
 	}
 
 	return globalConfigInstance, nil
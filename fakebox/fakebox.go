@@ -0,0 +1,224 @@
+package fakebox
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/isolate"
+	"github.com/programming-in-th/grader/util"
+)
+
+// Script decides the outcome of a run in place of actually running command. It may write the
+// files the run is expected to produce (such as options.Stdout) into the box directory dir
+type Script func(dir string, options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics)
+
+// Box is a sandbox that needs neither root nor an isolate install, for tests and development.
+// Programs are run directly as the current user in a temporary directory, with only the CPU time,
+// address space and file size limited through rlimits. Disk quotas, process limits and extra directories
+// are not enforced, as everything on the host is visible anyway. It must never be used to run untrusted code
+type Box struct {
+	boxID  int
+	dir    string // Box directory. Must only be set through Init()
+	script Script
+}
+
+// New creates a Box that runs commands under rlimits
+func New(boxID int) *Box {
+	return &Box{boxID: boxID}
+}
+
+// NewScripted creates a Box whose runs are decided by script instead of running anything
+func NewScripted(boxID int, script Script) *Box {
+	return &Box{boxID: boxID, script: script}
+}
+
+// Init creates the box directory
+func (box *Box) Init() error {
+	if box.dir != "" {
+		return errors.New("Box is already initialized. It must be cleaned up first")
+	}
+	dir, err := ioutil.TempDir("", "fakebox_"+strconv.Itoa(box.boxID)+"_")
+	if err != nil {
+		return errors.Wrap(err, "Unable to create box directory")
+	}
+	box.dir = dir
+	return nil
+}
+
+func copyFile(srcPath string, dstPath string) error {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	contents, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dstPath, contents, info.Mode().Perm())
+}
+
+// CopyIn copies the file at srcPath into the box directory as name, keeping its permissions
+func (box *Box) CopyIn(srcPath string, name string) error {
+	err := os.MkdirAll(path.Dir(path.Join(box.dir, name)), 0755)
+	if err == nil {
+		err = copyFile(srcPath, path.Join(box.dir, name))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Unable to copy %s into box directory", srcPath)
+	}
+	return nil
+}
+
+// CopyOut copies the file name out of the box directory to dstPath
+func (box *Box) CopyOut(name string, dstPath string) error {
+	err := copyFile(path.Join(box.dir, name), dstPath)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to copy %s out of box directory", name)
+	}
+	return nil
+}
+
+// Reset empties the box directory
+func (box *Box) Reset() error {
+	err := util.RemoveDirContents(box.dir)
+	if err != nil {
+		return errors.Wrap(err, "Unable to empty box directory")
+	}
+	return nil
+}
+
+// Cleanup removes the box directory
+func (box *Box) Cleanup() error {
+	err := os.RemoveAll(box.dir)
+	box.dir = ""
+	return err
+}
+
+// Run runs command in the box directory, or lets the script of the box decide the outcome if it has one
+func (box *Box) Run(options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics) {
+	if box.script != nil {
+		return box.script(box.dir, options, command)
+	}
+	return Exec(box.dir, options, command)
+}
+
+// Exec runs command in the directory dir, so scripts can also run some commands for real. Like isolate, the
+// program is given TimeLimit + ExtraTime seconds of CPU time and its wall clock limit before it is killed,
+// but is judged to exceed the time limit as soon as it uses more than TimeLimit.
+// The memory limit is enforced on the address space, so programs that run out of memory usually show up as
+// runtime errors
+func Exec(dir string, options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics) {
+	if len(command) == 0 {
+		return isolate.IsolateRunXX, isolate.RunMetrics{}
+	}
+
+	program := command[0]
+	if !strings.Contains(program, "/") {
+		program = "./" + program // Relative to the box directory, as in isolate
+	}
+	cpuLimit := int(math.Ceil(options.TimeLimit + options.ExtraTime))
+	if cpuLimit < 1 {
+		cpuLimit = 1
+	}
+	limitScript := "ulimit -t " + strconv.Itoa(cpuLimit)
+	if options.MemoryLimit > 0 {
+		limitScript += " && ulimit -v " + strconv.Itoa(options.MemoryLimit)
+	}
+	if options.OutputLimit > 0 {
+		limitScript += " && ulimit -f " + strconv.Itoa(options.OutputLimit*2) // In 512-byte blocks
+	}
+	if options.StackLimit > 0 {
+		limitScript += " && ulimit -s " + strconv.Itoa(options.StackLimit)
+	}
+	limitScript += ` && exec "$0" "$@"`
+	cmd := exec.Command("/bin/sh", append([]string{"-c", limitScript, program}, command[1:]...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), options.Env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if options.Stdin != "" {
+		stdin, err := os.Open(path.Join(dir, options.Stdin))
+		if err != nil {
+			return isolate.IsolateRunXX, isolate.RunMetrics{}
+		}
+		defer stdin.Close()
+		cmd.Stdin = stdin
+	}
+	if options.Stdout != "" {
+		stdout, err := os.Create(path.Join(dir, options.Stdout))
+		if err != nil {
+			return isolate.IsolateRunXX, isolate.RunMetrics{}
+		}
+		defer stdout.Close()
+		cmd.Stdout = stdout
+	}
+	if options.StderrToStdout {
+		cmd.Stderr = cmd.Stdout
+	} else if options.Stderr != "" {
+		stderr, err := os.Create(path.Join(dir, options.Stderr))
+		if err != nil {
+			return isolate.IsolateRunXX, isolate.RunMetrics{}
+		}
+		defer stderr.Close()
+		cmd.Stderr = stderr
+	}
+
+	err := cmd.Start()
+	if err != nil {
+		return isolate.IsolateRunXX, isolate.RunMetrics{}
+	}
+	timer := time.AfterFunc(time.Duration(options.WallClockLimit()*float64(time.Second)), func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err = cmd.Wait()
+	wallClockExceeded := !timer.Stop() // The timer has already fired
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return isolate.IsolateRunXX, isolate.RunMetrics{}
+		}
+	}
+
+	state := cmd.ProcessState
+	usage := state.SysUsage().(*syscall.Rusage)
+	timeElapsed := (usage.Utime.Sec+usage.Stime.Sec)*1000 + (usage.Utime.Usec+usage.Stime.Usec)/1000
+	status := state.Sys().(syscall.WaitStatus)
+	metrics := isolate.RunMetrics{
+		TimeElapsed: int(timeElapsed),
+		MemoryUsage: int(usage.Maxrss),
+	}
+	if status.Exited() {
+		metrics.ExitCode = status.ExitStatus()
+	}
+	if status.Signaled() {
+		metrics.ExitSignal = int(status.Signal())
+	}
+	withinTimeLimit := float64(metrics.TimeElapsed) <= options.TimeLimit*1000
+	// The CPU time limit is enforced with SIGXCPU, or with SIGKILL once the hard limit is reached
+	cpuTimeKilled := status.Signaled() && (status.Signal() == syscall.SIGXCPU || (status.Signal() == syscall.SIGKILL && !withinTimeLimit))
+	metrics.Killed = wallClockExceeded || cpuTimeKilled
+
+	if wallClockExceeded && withinTimeLimit {
+		return isolate.IsolateRunILE, metrics
+	}
+	if wallClockExceeded || !withinTimeLimit || (status.Signaled() && status.Signal() == syscall.SIGXCPU) {
+		return isolate.IsolateRunTLE, metrics
+	}
+	if state.Success() {
+		return isolate.IsolateRunOK, metrics
+	}
+	if options.MemoryLimit > 0 && metrics.MemoryUsage > options.MemoryLimit {
+		return isolate.IsolateRunMLE, metrics
+	}
+	if status.Signaled() {
+		return isolate.SignalVerdict(status.Signal()), metrics
+	}
+	return isolate.IsolateRunRE, metrics
+}
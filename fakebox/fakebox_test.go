@@ -0,0 +1,118 @@
+package fakebox
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/programming-in-th/grader/isolate"
+)
+
+func runScript(t *testing.T, script string, input string, options isolate.RunOptions) (isolate.RunVerdict, isolate.RunMetrics, string) {
+	dir, err := ioutil.TempDir("", "fakebox_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(path.Join(dir, "run"), []byte("#!/bin/sh\n"+script+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(dir, "input"), []byte(input), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	box := New(0)
+	err = box.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer box.Cleanup()
+	for _, name := range []string{"run", "input"} {
+		err = box.CopyIn(path.Join(dir, name), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	options.Stdin = "input"
+	options.Stdout = "output"
+	options.Stderr = "stderr"
+	verdict, metrics := box.Run(options, []string{"run"})
+	err = box.CopyOut("stderr", path.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, _ := ioutil.ReadFile(path.Join(dir, "stderr"))
+	if verdict != isolate.IsolateRunOK {
+		return verdict, metrics, string(stderr)
+	}
+	err = box.CopyOut("output", path.Join(dir, "output"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, _ := ioutil.ReadFile(path.Join(dir, "output"))
+	return verdict, metrics, string(output) + string(stderr)
+}
+
+func TestRun(t *testing.T) {
+	options := isolate.RunOptions{TimeLimit: 0.5, ExtraTime: 0.5, MemoryLimit: 256000, OutputLimit: 16}
+	tests := []struct {
+		name       string
+		script     string
+		verdict    isolate.RunVerdict
+		output     string // Standard output followed by standard error
+		exitCode   int
+		exitSignal int
+		killed     bool
+	}{
+		{"OK", "read a b; echo $((a * b))", isolate.IsolateRunOK, "10\n", 0, 0, false},
+		{"RE", "echo failed >&2; exit 3", isolate.IsolateRunRE, "failed\n", 3, 0, false},
+		{"TLE", "while :; do :; done", isolate.IsolateRunTLE, "", 0, 9, true},
+		{"SV", "kill -SYS $$", isolate.IsolateRunSV, "", 0, 31, false},
+		{"OLE", "exec head -c 100000 /dev/zero", isolate.IsolateRunOLE, "", 0, 25, false},
+	}
+	for _, test := range tests {
+		verdict, metrics, output := runScript(t, test.script, "5 2\n", options)
+		if verdict != test.verdict {
+			t.Errorf("%s: got verdict %s, expected %s", test.name, verdict, test.verdict)
+		}
+		if output != test.output {
+			t.Errorf("%s: got output %q, expected %q", test.name, output, test.output)
+		}
+		if metrics.ExitCode != test.exitCode || metrics.ExitSignal != test.exitSignal || metrics.Killed != test.killed {
+			t.Errorf("%s: got exit code %d, signal %d and killed %t", test.name, metrics.ExitCode, metrics.ExitSignal, metrics.Killed)
+		}
+	}
+}
+
+func TestProfile(t *testing.T) {
+	options := isolate.RunOptions{TimeLimit: 0.5, ExtraTime: 0.5, StackLimit: 8192, Env: []string{"GREETING=hi"}}
+	verdict, _, output := runScript(t, "ulimit -s; echo $GREETING", "", options)
+	if verdict != isolate.IsolateRunOK || output != "8192\nhi\n" {
+		t.Errorf("Got verdict %s and output %q", verdict, output)
+	}
+
+	// An idle program is killed by the wall clock limit long before TimeLimit + 5 seconds
+	options.WallTime = 0.3
+	verdict, metrics, _ := runScript(t, "sleep 3", "", options)
+	if verdict != isolate.IsolateRunILE || !metrics.Killed {
+		t.Errorf("Got verdict %s and killed %t, expected %s", verdict, metrics.Killed, isolate.IsolateRunILE)
+	}
+}
+
+func TestScripted(t *testing.T) {
+	box := NewScripted(0, func(dir string, options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics) {
+		return isolate.IsolateRunMLE, isolate.RunMetrics{TimeElapsed: 10, MemoryUsage: options.MemoryLimit + 1}
+	})
+	err := box.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer box.Cleanup()
+	verdict, metrics := box.Run(isolate.RunOptions{MemoryLimit: 1024}, []string{"run"})
+	if verdict != isolate.IsolateRunMLE || metrics.MemoryUsage != 1025 {
+		t.Errorf("Got %s %v, expected the scripted result", verdict, metrics)
+	}
+}
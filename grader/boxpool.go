@@ -0,0 +1,299 @@
+package grader
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/api"
+	"github.com/programming-in-th/grader/conf"
+)
+
+// pooledBox is a box in a boxPool. A box that is not ready must be rebuilt before its next run
+type pooledBox struct {
+	boxID    int
+	box      Sandbox
+	locked   bool // This process holds the lock of the box ID
+	ready    bool
+	failures int       // Rebuilds that failed in a row
+	retryAt  time.Time // The box is quarantined, and not rebuilt again, until then
+}
+
+// Boxes that cannot be rebuilt are quarantined for boxQuarantine, doubling with every failure in a row up to
+// boxQuarantineMax, so that a box stuck in the sandbox does not fail every test it is given
+const (
+	boxQuarantine    = 30 * time.Second
+	boxQuarantineMax = 10 * time.Minute
+)
+
+// boxPool is a fixed set of boxes that are initialized once and only emptied between runs.
+// Boxes are numbered from the FirstBoxID field of the global configuration, so that several
+// graders on one machine can use disjoint ranges of box IDs
+type boxPool struct {
+	boxes       chan *pooledBox // Boxes that are free and not quarantined
+	mutex       sync.Mutex      // Guards quarantined, aborted, and the box of every entry, which abort reads while boxes are in use
+	quarantined []*pooledBox    // Free boxes that are kept out of boxes until their quarantine ends
+	aborted     bool            // Every box was cleaned up by abort
+	all         []*pooledBox    // Every box, including those in use
+	config      conf.Config
+}
+
+// newBoxPool creates and initializes size boxes, or NumBoxes boxes from the global configuration
+// if that is smaller. Boxes that fail to initialize are retried when they are first needed
+func newBoxPool(size int, config conf.Config) *boxPool {
+	if config.Glob.NumBoxes > 0 && config.Glob.NumBoxes < size {
+		size = config.Glob.NumBoxes
+	}
+	if size < 1 {
+		size = 1
+	}
+	pool := &boxPool{boxes: make(chan *pooledBox, size), config: config}
+	for i := 0; i < size; i++ {
+		entry := &pooledBox{boxID: config.Glob.FirstBoxID + i}
+		err := pool.rebuild(entry)
+		if err != nil {
+			log.Println(errors.Wrapf(err, "Cannot initialize box %d", entry.boxID))
+		}
+		pool.all = append(pool.all, entry)
+		pool.boxes <- entry
+	}
+	return pool
+}
+
+// boxLockDir holds a lock file for every box ID. Every grader process, including the commands, holds
+// the lock of each box it uses, so that boxes in use by another process are refused instead of destroyed
+const boxLockDir = "/tmp/grader_box_locks"
+
+// heldBoxLock is the lock of a box ID held by this process, and the number of pools using it
+type heldBoxLock struct {
+	file    *os.File
+	holders int
+}
+
+var (
+	boxLocksMutex sync.Mutex
+	boxLocks      = make(map[int]*heldBoxLock)
+)
+
+// lockBox takes the lock of a box ID for this process. It fails if another process holds it
+func lockBox(boxID int) error {
+	boxLocksMutex.Lock()
+	defer boxLocksMutex.Unlock()
+	if held, exists := boxLocks[boxID]; exists {
+		held.holders++
+		return nil
+	}
+	err := os.MkdirAll(boxLockDir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Cannot create box lock directory")
+	}
+	file, err := os.OpenFile(path.Join(boxLockDir, strconv.Itoa(boxID)+".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot open lock of box %d", boxID)
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return errors.Errorf("Box %d is in use by another grader", boxID)
+		}
+		return errors.Wrapf(err, "Cannot lock box %d", boxID)
+	}
+	boxLocks[boxID] = &heldBoxLock{file: file, holders: 1}
+	return nil
+}
+
+// unlockBox releases a lock taken with lockBox
+func unlockBox(boxID int) {
+	boxLocksMutex.Lock()
+	defer boxLocksMutex.Unlock()
+	held, exists := boxLocks[boxID]
+	if !exists {
+		return
+	}
+	held.holders--
+	if held.holders == 0 {
+		held.file.Close()
+		delete(boxLocks, boxID)
+	}
+}
+
+// rebuild destroys whatever is left of a box, including boxes left behind by a grader that crashed,
+// and initializes it again. Boxes locked by another process are left alone
+func (pool *boxPool) rebuild(entry *pooledBox) error {
+	entry.ready = false
+	if !entry.locked {
+		err := lockBox(entry.boxID)
+		if err != nil {
+			return err
+		}
+		entry.locked = true
+	}
+	if entry.box == nil {
+		box, err := newSandbox(entry.boxID, pool.config)
+		if err != nil {
+			return err
+		}
+		pool.mutex.Lock()
+		entry.box = box
+		pool.mutex.Unlock()
+	}
+	entry.box.Cleanup() // Fails if the box does not exist, which is fine
+	err := entry.box.Init()
+	if err != nil {
+		return err
+	}
+	entry.ready = true
+	return nil
+}
+
+// get takes a box out of the pool, waiting until one is free. Boxes that are not ready are rebuilt, and
+// quarantined if that fails. Quarantined boxes are not used until their quarantine ends, and it only fails
+// if every box is quarantined
+func (pool *boxPool) get() (*pooledBox, error) {
+	var lastErr error
+	for {
+		// Boxes whose quarantine ended are tried again, and the others are waited for until the first one ends
+		pool.mutex.Lock()
+		now := time.Now()
+		quarantined := make([]*pooledBox, 0, len(pool.quarantined))
+		var next *pooledBox
+		for _, entry := range pool.quarantined {
+			if !now.Before(entry.retryAt) {
+				pool.boxes <- entry
+				continue
+			}
+			quarantined = append(quarantined, entry)
+			if next == nil || entry.retryAt.Before(next.retryAt) {
+				next = entry
+			}
+		}
+		pool.quarantined = quarantined
+		allQuarantined := len(quarantined) == len(pool.all)
+		pool.mutex.Unlock()
+		if allQuarantined {
+			if lastErr == nil {
+				lastErr = errors.Errorf("Box %d is quarantined until %s", next.boxID, next.retryAt.Format(time.RFC3339))
+			}
+			return nil, errors.Wrap(lastErr, "Every box is quarantined")
+		}
+
+		var quarantineEnded <-chan time.Time
+		var timer *time.Timer
+		if next != nil {
+			timer = time.NewTimer(next.retryAt.Sub(now))
+			quarantineEnded = timer.C
+		}
+		var entry *pooledBox
+		select {
+		case entry = <-pool.boxes:
+		case <-quarantineEnded:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if entry == nil {
+			continue
+		}
+		if entry.ready {
+			return entry, nil
+		}
+		err := pool.rebuild(entry)
+		if err == nil {
+			if entry.failures > 0 {
+				log.Printf("Box %d recovered after %d failed rebuilds", entry.boxID, entry.failures)
+			}
+			entry.failures = 0
+			return entry, nil
+		}
+		lastErr = errors.Wrapf(err, "Cannot rebuild box %d", entry.boxID)
+		pool.quarantine(entry, lastErr)
+	}
+}
+
+// quarantine keeps a box that could not be rebuilt out of use for a while, and alerts operators
+func (pool *boxPool) quarantine(entry *pooledBox, err error) {
+	entry.failures++
+	duration := boxQuarantine
+	for i := 1; i < entry.failures && duration < boxQuarantineMax; i++ {
+		duration *= 2
+	}
+	if duration > boxQuarantineMax {
+		duration = boxQuarantineMax
+	}
+	entry.retryAt = time.Now().Add(duration)
+	pool.mutex.Lock()
+	pool.quarantined = append(pool.quarantined, entry)
+	pool.mutex.Unlock()
+	boxID := entry.boxID
+	api.SendAlert(api.Alert{BoxID: &boxID, Message: fmt.Sprintf("%v. Quarantined for %s", err, duration)}, pool.config)
+}
+
+// put empties a box and returns it to the pool. Boxes that failed are rebuilt on their next use instead
+func (pool *boxPool) put(entry *pooledBox, failed bool) {
+	if !failed {
+		err := entry.box.Reset()
+		if err != nil {
+			log.Println(errors.Wrapf(err, "Cannot reset box %d", entry.boxID))
+			failed = true
+		}
+	}
+	if failed {
+		entry.ready = false
+	}
+	pool.boxes <- entry
+}
+
+// close cleans up every box in the pool, waiting for boxes in use to be returned first, and releases their locks
+func (pool *boxPool) close() {
+	pool.mutex.Lock()
+	entries := pool.quarantined
+	pool.quarantined = nil
+	pool.mutex.Unlock()
+	for len(entries) < len(pool.all) {
+		entries = append(entries, <-pool.boxes)
+	}
+	for _, entry := range entries {
+		if !entry.locked {
+			continue
+		}
+		if entry.box != nil {
+			err := entry.box.Cleanup()
+			if err != nil {
+				log.Println(errors.Wrapf(err, "Cannot clean up box %d", entry.boxID))
+			}
+		}
+		unlockBox(entry.boxID)
+		entry.locked = false
+	}
+}
+
+// abort cleans up every box in the pool at once, including boxes in use, for when the jobs using them cannot
+// be waited for
+func (pool *boxPool) abort() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.aborted = true
+	for _, entry := range pool.all {
+		if entry.box == nil {
+			continue
+		}
+		err := entry.box.Cleanup()
+		if err != nil {
+			log.Println(errors.Wrapf(err, "Cannot clean up box %d", entry.boxID))
+		}
+	}
+}
+
+// isAborted reports whether the pool was aborted
+func (pool *boxPool) isAborted() bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return pool.aborted
+}
@@ -0,0 +1,241 @@
+package grader
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/isolate"
+)
+
+// countingBox is a Sandbox that counts how often each step of its lifecycle happens
+type countingBox struct {
+	boxID    int
+	inits    int
+	resets   int
+	cleanups int
+	failInit bool
+}
+
+func (box *countingBox) Init() error {
+	box.inits++
+	if box.failInit {
+		return errors.New("Init failed")
+	}
+	return nil
+}
+func (box *countingBox) CopyIn(srcPath string, name string) error  { return nil }
+func (box *countingBox) CopyOut(name string, dstPath string) error { return nil }
+func (box *countingBox) Reset() error {
+	box.resets++
+	return nil
+}
+func (box *countingBox) Cleanup() error {
+	box.cleanups++
+	return nil
+}
+func (box *countingBox) Run(options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics) {
+	return isolate.IsolateRunOK, isolate.RunMetrics{}
+}
+
+func TestBoxPool(t *testing.T) {
+	boxes := make(map[int]*countingBox)
+	sandboxBackends["counting"] = func(boxID int, config conf.Config) Sandbox {
+		boxes[boxID] = &countingBox{boxID: boxID}
+		return boxes[boxID]
+	}
+	defer delete(sandboxBackends, "counting")
+	config := conf.Config{Glob: conf.GlobalConfiguration{Sandbox: "counting", FirstBoxID: 10, NumBoxes: 2}}
+
+	pool := newBoxPool(4, config)
+	if len(boxes) != 2 || boxes[10] == nil || boxes[11] == nil {
+		t.Fatalf("Got boxes %v, expected boxes 10 and 11", boxes)
+	}
+
+	// Successful runs only empty the box
+	for i := 0; i < 3; i++ {
+		entry, err := pool.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.put(entry, false)
+	}
+	total := 0
+	for _, box := range boxes {
+		if box.inits != 1 {
+			t.Errorf("Box %d was initialized %d times, expected once", box.boxID, box.inits)
+		}
+		total += box.resets
+	}
+	if total != 3 {
+		t.Errorf("Boxes were reset %d times, expected 3", total)
+	}
+
+	// A failed box is rebuilt when it is next used
+	entry, _ := pool.get()
+	failedBox := entry.box.(*countingBox)
+	pool.put(entry, true)
+	entry, _ = pool.get()
+	pool.put(entry, false)
+	entry, _ = pool.get()
+	pool.put(entry, false)
+	if failedBox.inits != 2 {
+		t.Errorf("Failed box was initialized %d times, expected twice", failedBox.inits)
+	}
+
+	// A box that cannot be rebuilt is reported and kept for another try
+	entry, _ = pool.get()
+	failedBox = entry.box.(*countingBox)
+	failedBox.failInit = true
+	pool.put(entry, true)
+	for i := 0; i < 2; i++ {
+		entry, err := pool.get()
+		if err != nil {
+			continue
+		}
+		if entry.box == failedBox {
+			t.Error("Got a box that could not be rebuilt")
+		}
+		pool.put(entry, false)
+	}
+
+	pool.close()
+	for _, box := range boxes {
+		if box.cleanups < 1 {
+			t.Errorf("Box %d was not cleaned up", box.boxID)
+		}
+	}
+}
+
+func TestBoxPoolQuarantine(t *testing.T) {
+	var box *countingBox
+	sandboxBackends["counting"] = func(boxID int, config conf.Config) Sandbox {
+		box = &countingBox{boxID: boxID, failInit: true}
+		return box
+	}
+	defer delete(sandboxBackends, "counting")
+	pool := newBoxPool(1, conf.Config{Glob: conf.GlobalConfiguration{Sandbox: "counting"}})
+	defer pool.close()
+
+	// A box that cannot be rebuilt is quarantined instead of being rebuilt for every run
+	for i := 0; i < 3; i++ {
+		if _, err := pool.get(); err == nil {
+			t.Fatal("Got a box that could not be rebuilt")
+		}
+	}
+	if box.inits != 2 {
+		t.Errorf("Box was initialized %d times, expected twice", box.inits)
+	}
+
+	// It is used again once it is rebuilt after its quarantine
+	entry := pool.quarantined[0]
+	if entry.failures != 1 || entry.retryAt.Sub(time.Now()) > boxQuarantine {
+		t.Errorf("Box failed %d times and is quarantined until %s", entry.failures, entry.retryAt)
+	}
+	entry.retryAt = time.Now()
+	box.failInit = false
+	entry, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.failures != 0 {
+		t.Errorf("Recovered box has %d failures", entry.failures)
+	}
+	pool.put(entry, false)
+}
+
+func TestBoxPoolWaitsForHealthyBox(t *testing.T) {
+	boxes := make(map[int]*countingBox)
+	sandboxBackends["counting"] = func(boxID int, config conf.Config) Sandbox {
+		boxes[boxID] = &countingBox{boxID: boxID}
+		return boxes[boxID]
+	}
+	defer delete(sandboxBackends, "counting")
+	pool := newBoxPool(2, conf.Config{Glob: conf.GlobalConfiguration{Sandbox: "counting", FirstBoxID: 20}})
+	defer pool.close()
+
+	// One box is quarantined and the other is in use
+	healthy, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed.box.(*countingBox).failInit = true
+	pool.put(failed, true)
+
+	// The healthy box is waited for instead of failing
+	got := make(chan *pooledBox)
+	go func() {
+		entry, err := pool.get()
+		if err != nil {
+			t.Error(err)
+		}
+		got <- entry
+	}()
+	select {
+	case <-got:
+		t.Fatal("Got a box while the only healthy box was in use")
+	case <-time.After(200 * time.Millisecond):
+	}
+	pool.put(healthy, false)
+	if entry := <-got; entry != healthy {
+		t.Errorf("Got box %d, expected the healthy box %d", entry.boxID, healthy.boxID)
+	}
+	pool.put(healthy, false)
+}
+
+func TestBoxPoolInUse(t *testing.T) {
+	boxes := make(map[int]*countingBox)
+	sandboxBackends["counting"] = func(boxID int, config conf.Config) Sandbox {
+		boxes[boxID] = &countingBox{boxID: boxID}
+		return boxes[boxID]
+	}
+	defer delete(sandboxBackends, "counting")
+
+	// Another process holds the lock of the box
+	boxID := 900
+	err := os.MkdirAll(boxLockDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := os.OpenFile(path.Join(boxLockDir, strconv.Itoa(boxID)+".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	err = syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The box is refused without being cleaned up
+	pool := newBoxPool(1, conf.Config{Glob: conf.GlobalConfiguration{Sandbox: "counting", FirstBoxID: boxID}})
+	if _, err := pool.get(); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("Got error %v, expected the box to be in use", err)
+	}
+	if len(boxes) != 0 {
+		t.Errorf("Got boxes %v, expected the box in use to be left alone", boxes)
+	}
+
+	// It is used once the other process releases it
+	other.Close()
+	pool.quarantined[0].retryAt = time.Now()
+	entry, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.put(entry, false)
+	pool.close()
+	if boxes[boxID] == nil || boxes[boxID].cleanups < 2 {
+		t.Errorf("Got boxes %v, expected the box to be rebuilt and cleaned up", boxes)
+	}
+}
@@ -0,0 +1,416 @@
+package grader
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/isolate"
+	"github.com/programming-in-th/grader/util"
+)
+
+/* BUILD SCRIPT TYPES */
+
+// buildStep produces the input of one test, either by running a generator or by copying a file
+type buildStep struct {
+	lineNumber int
+	command    string // "gen" or "copy"
+	args       []string
+}
+
+type buildGroup struct {
+	fullScore    float64
+	dependencies []int
+	steps        []buildStep
+}
+
+// buildScript is a parsed build.txt. The format of build.txt is, one directive per line:
+//
+//	# comment
+//	reference <language> <path to reference solution, relative to the task directory>
+//	group <full score> [depends <group index> ...]
+//	gen <generator> [arguments ...]
+//	copy <path to input file, relative to the task directory>
+//
+// Every gen or copy line produces the next test of the last group. Generators live in the generators
+// directory and must write the input to stdout. Seeds are passed to generators as ordinary arguments,
+// so the same line always produces the same input
+type buildScript struct {
+	referenceLang string
+	referencePath string
+	groups        []buildGroup
+}
+
+// buildCache records what each generated file was built from. Files whose recorded hash matches are not rebuilt
+type buildCache struct {
+	Generators map[string]string // Generator name -> hash of its source
+	Inputs     map[string]string // Test index -> hash of the step that produced the input
+	Solutions  map[string]string // Test index -> hash of the input and the reference solution
+}
+
+// BuildReport summarizes what a task build did
+type BuildReport struct {
+	NumTests           int
+	InputsGenerated    int
+	SolutionsGenerated int
+}
+
+const buildScriptName = "build.txt"
+const buildDirName = ".build"
+
+func parseBuildScript(scriptPath string) (buildScript, error) {
+	scriptFile, err := os.Open(scriptPath)
+	if err != nil {
+		return buildScript{}, errors.Wrapf(err, "Failed to read build script at %s", scriptPath)
+	}
+	defer scriptFile.Close()
+
+	script := buildScript{}
+	scanner := bufio.NewScanner(scriptFile)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if commentStart := strings.Index(line, "#"); commentStart != -1 {
+			line = line[:commentStart]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "reference":
+			if len(fields) != 3 {
+				return buildScript{}, errors.Errorf("%s:%d: expected \"reference <language> <path>\"", scriptPath, lineNumber)
+			}
+			script.referenceLang = fields[1]
+			script.referencePath = fields[2]
+		case "group":
+			if len(fields) < 2 || (len(fields) > 2 && fields[2] != "depends") {
+				return buildScript{}, errors.Errorf("%s:%d: expected \"group <full score> [depends <group index> ...]\"", scriptPath, lineNumber)
+			}
+			fullScore, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return buildScript{}, errors.Wrapf(err, "%s:%d: invalid full score", scriptPath, lineNumber)
+			}
+			group := buildGroup{fullScore: fullScore, dependencies: make([]int, 0)}
+			for i := 3; i < len(fields); i++ {
+				dependency, err := strconv.Atoi(fields[i])
+				if err != nil || dependency < 1 || dependency > len(script.groups) {
+					return buildScript{}, errors.Errorf("%s:%d: groups can only depend on earlier groups", scriptPath, lineNumber)
+				}
+				group.dependencies = append(group.dependencies, dependency)
+			}
+			script.groups = append(script.groups, group)
+		case "gen", "copy":
+			if len(script.groups) == 0 {
+				return buildScript{}, errors.Errorf("%s:%d: test before the first group", scriptPath, lineNumber)
+			}
+			if len(fields) < 2 || (fields[0] == "copy" && len(fields) != 2) {
+				return buildScript{}, errors.Errorf("%s:%d: expected \"%s\" with a file", scriptPath, lineNumber, fields[0])
+			}
+			currGroup := &script.groups[len(script.groups)-1]
+			currGroup.steps = append(currGroup.steps, buildStep{lineNumber, fields[0], fields[1:]})
+		default:
+			return buildScript{}, errors.Errorf("%s:%d: unknown directive %s", scriptPath, lineNumber, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return buildScript{}, errors.Wrapf(err, "Failed to read build script at %s", scriptPath)
+	}
+	if script.referencePath == "" {
+		return buildScript{}, errors.Errorf("%s: no reference solution", scriptPath)
+	}
+	for i, group := range script.groups {
+		if len(group.steps) == 0 {
+			return buildScript{}, errors.Errorf("%s: group %d has no tests", scriptPath, i+1)
+		}
+	}
+	return script, nil
+}
+
+func readBuildCache(cachePath string) buildCache {
+	cache := buildCache{}
+	cacheFileBytes, err := ioutil.ReadFile(cachePath)
+	if err == nil {
+		err = json.Unmarshal(cacheFileBytes, &cache)
+		if err != nil {
+			log.Println(errors.Wrap(err, "Build cache is corrupted, rebuilding everything"))
+			cache = buildCache{}
+		}
+	}
+	if cache.Generators == nil {
+		cache.Generators = make(map[string]string)
+	}
+	if cache.Inputs == nil {
+		cache.Inputs = make(map[string]string)
+	}
+	if cache.Solutions == nil {
+		cache.Solutions = make(map[string]string)
+	}
+	return cache
+}
+
+func writeBuildCache(cachePath string, cache buildCache) error {
+	cacheFileBytes, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal build cache")
+	}
+	return ioutil.WriteFile(cachePath, cacheFileBytes, 0644)
+}
+
+func fileExists(filePath string) bool {
+	_, err := os.Stat(filePath)
+	return err == nil
+}
+
+// prepareGenerator returns the command that runs a generator and the hash of its source.
+// C++ generators are compiled (with testlib.h available) whenever their source changes
+func prepareGenerator(taskPath string, name string, cache *buildCache, config conf.Config) ([]string, string, error) {
+	generatorsPath := path.Join(taskPath, "generators")
+	binPath := path.Join(taskPath, buildDirName, "generators", name)
+
+	for _, candidate := range []string{name + ".cpp", name + ".py", name} {
+		srcPath := path.Join(generatorsPath, candidate)
+		if !fileExists(srcPath) {
+			continue
+		}
+		hash, err := util.HashFile(srcPath)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "Cannot read generator %s", srcPath)
+		}
+
+		switch path.Ext(candidate) {
+		case ".cpp":
+			if cache.Generators[name] != hash || !fileExists(binPath) {
+				out, err := exec.Command("/usr/bin/c++", "--std=c++17", "-O2",
+					"-I", path.Join(config.BasePath, "config", "defaultCheckers"),
+					srcPath, "-o", binPath).CombinedOutput()
+				if err != nil {
+					return nil, "", errors.Wrapf(err, "Cannot compile generator %s: %s", srcPath, strings.TrimSpace(string(out)))
+				}
+				cache.Generators[name] = hash
+			}
+			return []string{binPath}, hash, nil
+		case ".py":
+			return []string{"/usr/bin/python3", srcPath}, hash, nil
+		default:
+			return []string{srcPath}, hash, nil
+		}
+	}
+	return nil, "", errors.Errorf("Generator %s not found in %s", name, generatorsPath)
+}
+
+// runBuildStep produces inputPath from step and returns the hash identifying what it was produced from.
+// Nothing is done if the cache shows that inputPath was already produced from the same step
+func runBuildStep(taskPath string, step buildStep, inputPath string, cachedHash string, cache *buildCache, config conf.Config) (string, bool, error) {
+	if step.command == "copy" {
+		hash, err := util.HashFile(path.Join(taskPath, step.args[0]))
+		if err != nil {
+			return "", false, errors.Wrapf(err, "Line %d: cannot read %s", step.lineNumber, step.args[0])
+		}
+		stepHash := util.HashStrings("copy", hash)
+		if stepHash == cachedHash && fileExists(inputPath) {
+			return stepHash, false, nil
+		}
+		data, err := ioutil.ReadFile(path.Join(taskPath, step.args[0]))
+		if err == nil {
+			err = ioutil.WriteFile(inputPath, data, 0644)
+		}
+		if err != nil {
+			return "", false, errors.Wrapf(err, "Line %d: cannot copy %s", step.lineNumber, step.args[0])
+		}
+		return stepHash, true, nil
+	}
+
+	command, generatorHash, err := prepareGenerator(taskPath, step.args[0], cache, config)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "Line %d", step.lineNumber)
+	}
+	stepHash := util.HashStrings(append([]string{"gen", generatorHash}, step.args[1:]...)...)
+	if stepHash == cachedHash && fileExists(inputPath) {
+		return stepHash, false, nil
+	}
+
+	inputFile, err := os.Create(inputPath)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "Cannot create %s", inputPath)
+	}
+	defer inputFile.Close()
+	cmd := exec.Command(command[0], append(command[1:], step.args[1:]...)...)
+	cmd.Dir = path.Join(taskPath, buildDirName)
+	cmd.Stdout = inputFile
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", false, errors.Wrap(err, "Cannot run generator")
+	}
+	err = cmd.Start()
+	if err != nil {
+		return "", false, errors.Wrapf(err, "Line %d: cannot run generator %s", step.lineNumber, step.args[0])
+	}
+	stderrBytes, _ := ioutil.ReadAll(stderr)
+	err = cmd.Wait()
+	if err != nil {
+		os.Remove(inputPath)
+		return "", false, errors.Wrapf(err, "Line %d: generator %s failed: %s", step.lineNumber, step.args[0], strings.TrimSpace(string(stderrBytes)))
+	}
+	return stepHash, true, nil
+}
+
+// BuildTask generates the inputs of a task with the generators listed in its build.txt, generates the
+// solutions by running the reference solution in the sandbox, and writes the groups into manifest.json.
+// Only inputs and solutions whose sources changed since the last build are regenerated
+func BuildTask(taskID string, config conf.Config) (BuildReport, error) {
+	report := BuildReport{}
+	taskPath := path.Join(config.BasePath, "tasks", taskID)
+	manifestPath := path.Join(taskPath, "manifest.json")
+
+	script, err := parseBuildScript(path.Join(taskPath, buildScriptName))
+	if err != nil {
+		return report, err
+	}
+	manifest, err := ReadManifest(manifestPath)
+	if err != nil {
+		return report, err
+	}
+	if manifest.DefaultLimits == nil {
+		if _, exists := manifest.Limits[script.referenceLang]; !exists {
+			return report, errors.Errorf("Task has no limits for the reference solution's language %s", script.referenceLang)
+		}
+	}
+
+	for _, dir := range []string{"inputs", "solutions", path.Join(buildDirName, "generators")} {
+		err = util.CreateDirIfNotExist(path.Join(taskPath, dir))
+		if err != nil {
+			return report, errors.Wrapf(err, "Cannot create %s", dir)
+		}
+	}
+	cachePath := path.Join(taskPath, buildDirName, "cache.json")
+	cache := readBuildCache(cachePath)
+	// Save whatever was built, even if a later step fails
+	defer func() {
+		err := writeBuildCache(cachePath, cache)
+		if err != nil {
+			log.Println(errors.Wrap(err, "Cannot save build cache"))
+		}
+	}()
+
+	// Generate inputs and lay out groups
+	groups := make([]TestGroup, 0, len(script.groups))
+	for _, group := range script.groups {
+		start := report.NumTests + 1
+		for _, step := range group.steps {
+			report.NumTests++
+			testIndex := strconv.Itoa(report.NumTests)
+			inputPath := path.Join(taskPath, "inputs", testIndex+".in")
+			stepHash, generated, err := runBuildStep(taskPath, step, inputPath, cache.Inputs[testIndex], &cache, config)
+			if err != nil {
+				delete(cache.Inputs, testIndex)
+				return report, err
+			}
+			cache.Inputs[testIndex] = stepHash
+			if generated {
+				report.InputsGenerated++
+			}
+		}
+		groups = append(groups, TestGroup{
+			FullScore:    group.fullScore,
+			Dependencies: group.dependencies,
+			TestIndices:  IndexRange{Start: start, End: report.NumTests},
+		})
+	}
+
+	// Remove tests left over from a previous build with more tests
+	for testIndex := range cache.Inputs {
+		if index, err := strconv.Atoi(testIndex); err != nil || index > report.NumTests {
+			os.Remove(path.Join(taskPath, "inputs", testIndex+".in"))
+			os.Remove(path.Join(taskPath, "solutions", testIndex+".sol"))
+			delete(cache.Inputs, testIndex)
+			delete(cache.Solutions, testIndex)
+		}
+	}
+
+	// Generate solutions with the reference solution
+	referenceHash, err := util.HashFile(path.Join(taskPath, script.referencePath))
+	if err != nil {
+		return report, errors.Wrap(err, "Cannot read reference solution")
+	}
+	referenceHash = util.HashStrings(referenceHash, script.referenceLang)
+	buildID := "build_" + taskID
+	userBinPath := ""
+	defer os.RemoveAll(path.Join(BASE_TMP_PATH, buildID))
+	pool := newBoxPool(1, config)
+	defer pool.close()
+	timeLimit, memoryLimit := manifest.runLimits(script.referenceLang)
+
+	for i := 1; i <= report.NumTests; i++ {
+		testIndex := strconv.Itoa(i)
+		inputPath := path.Join(taskPath, "inputs", testIndex+".in")
+		solutionPath := path.Join(taskPath, "solutions", testIndex+".sol")
+		inputHash, err := util.HashFile(inputPath)
+		if err != nil {
+			return report, errors.Wrapf(err, "Cannot read input %s", inputPath)
+		}
+		solutionHash := util.HashStrings(inputHash, referenceHash)
+		if cache.Solutions[testIndex] == solutionHash && fileExists(solutionPath) {
+			continue
+		}
+
+		if userBinPath == "" {
+			err = util.CreateDirIfNotExist(path.Join(BASE_TMP_PATH, buildID))
+			if err != nil {
+				return report, errors.Wrap(err, "Error creating working tmp folder")
+			}
+			srcDir, srcNames, err := prepareAuthorSolution(manifest, taskID, buildID, script.referenceLang, script.referencePath, config)
+			if err != nil {
+				return report, err
+			}
+			defer os.RemoveAll(srcDir)
+			compiled := compileSubmission(buildID,
+				taskID,
+				script.referenceLang,
+				srcDir,
+				srcNames,
+				taskCompileFilePaths(manifest, taskID, script.referenceLang, config),
+				pool,
+				config)
+			if compiled.verdict != "" {
+				return report, errors.Errorf("Reference solution does not compile: %s %v", compiled.verdict, compiled.err)
+			}
+			userBinPath = compiled.binPath
+		}
+
+		result := runInSandbox(userBinPath,
+			timeLimit,
+			memoryLimit,
+			manifest.outputLimit(config),
+			inputPath,
+			solutionPath,
+			path.Join(BASE_TMP_PATH, buildID, testIndex+".err"),
+			script.referenceLang,
+			pool,
+		)
+		if result.verdict != isolate.IsolateRunOK {
+			delete(cache.Solutions, testIndex)
+			return report, errors.Errorf("Reference solution failed on test %d with verdict %s: %v", i, result.verdict, result.err)
+		}
+		cache.Solutions[testIndex] = solutionHash
+		report.SolutionsGenerated++
+	}
+
+	manifest.Groups = groups
+	err = WriteManifest(manifestPath, manifest)
+	if err != nil {
+		return report, err
+	}
+	return report, nil
+}
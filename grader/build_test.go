@@ -0,0 +1,51 @@
+package grader
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseBuildScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grader_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	scriptPath := path.Join(dir, buildScriptName)
+	ioutil.WriteFile(scriptPath, []byte(`# a_time_b
+reference cpp14 reference/main.cpp
+
+group 30
+copy manual/sample.in
+gen random 1 100 17 # small numbers, seed 17
+
+group 70 depends 1
+gen random 1 1000000000 1
+gen random 1 1000000000 2
+`), 0644)
+
+	script, err := parseBuildScript(scriptPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if script.referenceLang != "cpp14" || script.referencePath != "reference/main.cpp" {
+		t.Errorf("Unexpected reference solution %s %s", script.referenceLang, script.referencePath)
+	}
+	if len(script.groups) != 2 || len(script.groups[0].steps) != 2 || len(script.groups[1].steps) != 2 {
+		t.Fatalf("Unexpected groups %#v", script.groups)
+	}
+	if step := script.groups[0].steps[1]; step.command != "gen" || len(step.args) != 4 || step.args[3] != "17" {
+		t.Errorf("Unexpected step %#v", step)
+	}
+	if deps := script.groups[1].dependencies; len(deps) != 1 || deps[0] != 1 {
+		t.Errorf("Unexpected dependencies %v", deps)
+	}
+
+	ioutil.WriteFile(scriptPath, []byte("reference cpp14 main.cpp\ngroup 100 depends 1\ngen random\n"), 0644)
+	if _, err := parseBuildScript(scriptPath); err == nil {
+		t.Error("Group depending on itself was accepted")
+	}
+}
@@ -0,0 +1,327 @@
+package grader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/util"
+)
+
+// Directories in the cache path of the global configuration
+const (
+	binaryCacheDir = "binaries"
+	resultCacheDir = "results"
+)
+
+// cacheMutex serializes writes to and eviction from the cache. Reads need no lock, since files are only ever
+// renamed into the cache whole
+var cacheMutex sync.Mutex
+
+// toolchainVersions remembers the output of the version command of each language, which is run once per process
+var toolchainVersions = struct {
+	sync.Mutex
+	versions map[string]string
+}{versions: make(map[string]string)}
+
+// toolchainVersion returns what the version command of the language prints, or nothing if it has none
+func toolchainVersion(langConfig conf.LangConfiguration) (string, error) {
+	if len(langConfig.VersionCommand) == 0 {
+		return "", nil
+	}
+	toolchainVersions.Lock()
+	defer toolchainVersions.Unlock()
+	key := strings.Join(langConfig.VersionCommand, "\x00")
+	if version, exists := toolchainVersions.versions[key]; exists {
+		return version, nil
+	}
+	out, err := exec.Command(langConfig.VersionCommand[0], langConfig.VersionCommand[1:]...).CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "Version command of language %s failed", langConfig.ID)
+	}
+	toolchainVersions.versions[key] = string(out)
+	return string(out), nil
+}
+
+// sourceHash hashes everything compiling a submission depends on: the configuration and toolchain of its
+// language, its source files with their names, and the compile files of the task
+func sourceHash(langConfig conf.LangConfiguration, srcDir string, srcNames []string, compPaths []string, config conf.Config) (string, error) {
+	langBytes, err := json.Marshal(langConfig)
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot marshal language configuration")
+	}
+	version, err := toolchainVersion(langConfig)
+	if err != nil {
+		return "", err
+	}
+	parts := []string{"source", string(langBytes), version}
+	if len(langConfig.CompileCommands) == 0 {
+		scriptHash, err := util.HashFile(path.Join(config.BasePath, "config", "compileScripts", langConfig.ID))
+		if err == nil { // Interpreted languages may have no compile script
+			parts = append(parts, scriptHash)
+		}
+	}
+	for _, name := range srcNames {
+		hash, err := util.HashFile(path.Join(srcDir, name))
+		if err != nil {
+			return "", errors.Wrapf(err, "Cannot hash source file %s", name)
+		}
+		parts = append(parts, name, hash)
+	}
+	for _, filePath := range compPaths {
+		if strings.HasPrefix(filePath, "-I") {
+			includeHash, err := hashDirectory(strings.TrimPrefix(filePath, "-I"))
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, "-I", includeHash)
+			continue
+		}
+		hash, err := util.HashFile(filePath)
+		if err != nil {
+			return "", errors.Wrapf(err, "Cannot hash compile file %s", filePath)
+		}
+		parts = append(parts, path.Base(filePath), hash)
+	}
+	return util.HashStrings(parts...), nil
+}
+
+// hashDirectory hashes the names and contents of the regular files in dir and its subdirectories.
+// A directory that does not exist hashes like an empty one
+func hashDirectory(dir string) (string, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return util.HashStrings(), nil
+	}
+	names, err := listFiles(dir)
+	if err != nil {
+		return "", errors.Wrapf(err, "Cannot list %s", dir)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		hash, err := hashFileCached(path.Join(dir, name))
+		if err != nil {
+			return "", errors.Wrapf(err, "Cannot hash %s", path.Join(dir, name))
+		}
+		parts = append(parts, name, hash)
+	}
+	return util.HashStrings(parts...), nil
+}
+
+// fileHash is the hash of a file while it has the given size, inode, modification time and change time
+type fileHash struct {
+	size       int64
+	inode      uint64
+	modTime    time.Time
+	changeTime time.Time
+	hash       string
+}
+
+// newFileHash returns the hash with the size, inode and times of info
+func newFileHash(info os.FileInfo, hash string) fileHash {
+	entry := fileHash{size: info.Size(), modTime: info.ModTime(), hash: hash}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.inode = stat.Ino
+		entry.changeTime = time.Unix(stat.Ctim.Sec, stat.Ctim.Nsec)
+	}
+	return entry
+}
+
+// matches reports whether the file still has the size, inode and times it had when it was hashed
+func (h fileHash) matches(info os.FileInfo) bool {
+	current := newFileHash(info, "")
+	return h.size == current.size && h.inode == current.inode && h.modTime.Equal(current.modTime) &&
+		h.changeTime.Equal(current.changeTime)
+}
+
+// fileHashes remembers the hashes of task files, so tests are only read again after they change
+var fileHashes = struct {
+	sync.Mutex
+	hashes map[string]fileHash
+}{hashes: make(map[string]fileHash)}
+
+// hashFileCached hashes the file at filePath, unless its size, inode, modification time and change time are
+// the same as when it was last hashed. The change time is updated by every write, even when the modification
+// time is set back afterwards
+func hashFileCached(filePath string) (string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	fileHashes.Lock()
+	cached, exists := fileHashes.hashes[filePath]
+	fileHashes.Unlock()
+	if exists && cached.matches(info) {
+		return cached.hash, nil
+	}
+	hash, err := util.HashFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	fileHashes.Lock()
+	fileHashes.hashes[filePath] = newFileHash(info, hash)
+	fileHashes.Unlock()
+	return hash, nil
+}
+
+// cacheEnabled reports whether the global configuration has a cache
+func cacheEnabled(config conf.Config) bool {
+	return config.Glob.CachePath != ""
+}
+
+// getCachedBinary copies the binary cached under key into workPath with the name it was compiled with,
+// and returns its path. It returns an empty path if nothing is cached under key
+func getCachedBinary(key string, workPath string, config conf.Config) string {
+	// Binaries are cached as <key>.<name>, since run commands and scripts may depend on the name
+	matches, err := filepath.Glob(path.Join(config.Glob.CachePath, binaryCacheDir, key+".*"))
+	if err != nil || len(matches) == 0 {
+		return ""
+	}
+	binPath := path.Join(workPath, strings.TrimPrefix(path.Base(matches[0]), key+"."))
+	err = copyFile(matches[0], binPath)
+	if err == nil {
+		err = os.Chmod(binPath, 0755)
+	}
+	if err != nil {
+		return ""
+	}
+	touchCacheFile(matches[0])
+	return binPath
+}
+
+// putCachedBinary caches the binary at binPath under key
+func putCachedBinary(key string, binPath string, config conf.Config) error {
+	return cachePut(config, binaryCacheDir, key+"."+path.Base(binPath), binPath)
+}
+
+// touchCacheFile marks a file of the cache as used, since the least recently used files are evicted first
+func touchCacheFile(cachedPath string) {
+	now := time.Now()
+	os.Chtimes(cachedPath, now, now)
+}
+
+// cachePut copies the file at srcPath into the cache directory kind as name, then evicts the least
+// recently used files until the cache fits in its size
+func cachePut(config conf.Config, kind string, name string, srcPath string) error {
+	dir := path.Join(config.Glob.CachePath, kind)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Cannot create cache directory")
+	}
+	tmpFile, err := ioutil.TempFile(dir, ".tmp_")
+	if err != nil {
+		return errors.Wrap(err, "Cannot create cache file")
+	}
+	tmpFile.Close()
+	err = copyFile(srcPath, tmpFile.Name())
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrap(err, "Cannot write cache file")
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	return evictCache(config)
+}
+
+// evictCache removes the least recently used files of the cache until it fits in the cache size
+func evictCache(config conf.Config) error {
+	files := make([]os.FileInfo, 0)
+	paths := make(map[os.FileInfo]string)
+	total := int64(0)
+	for _, kind := range []string{binaryCacheDir, resultCacheDir} {
+		dir := path.Join(config.Glob.CachePath, kind)
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "Cannot list cache directory")
+		}
+		for _, entry := range entries {
+			if !entry.Mode().IsRegular() || strings.HasPrefix(entry.Name(), ".tmp_") {
+				continue
+			}
+			files = append(files, entry)
+			paths[entry] = path.Join(dir, entry.Name())
+			total += entry.Size()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	sizeLimit := int64(config.Glob.CacheSize) * 1024 * 1024
+	for _, file := range files {
+		if total <= sizeLimit {
+			break
+		}
+		err := os.Remove(paths[file])
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "Cannot evict cache file")
+		}
+		total -= file.Size()
+	}
+	return nil
+}
+
+// resultKey is the key a result is cached under: the source hash of the submission, the version of the task,
+// and the global configuration, which has the messages of verdicts and the default limits
+func resultKey(srcHash string, manifestInstance taskManifest, config conf.Config) (string, error) {
+	globBytes, err := json.Marshal(config.Glob)
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot marshal global configuration")
+	}
+	return util.HashStrings("result", srcHash, manifestInstance.version, string(globBytes)), nil
+}
+
+// getCachedResult returns the result cached under key, or nil if there is none
+func getCachedResult(key string, config conf.Config) *PrefixGroupResult {
+	resultBytes, err := ioutil.ReadFile(path.Join(config.Glob.CachePath, resultCacheDir, key))
+	if err != nil {
+		return nil
+	}
+	var result PrefixGroupResult
+	err = json.Unmarshal(resultBytes, &result)
+	if err != nil {
+		return nil
+	}
+	touchCacheFile(path.Join(config.Glob.CachePath, resultCacheDir, key))
+	return &result
+}
+
+// putCachedResult caches result under key. Results with judge errors are not cached, since they may not
+// happen again
+func putCachedResult(key string, result PrefixGroupResult, config conf.Config) error {
+	for _, group := range result.GroupResults {
+		for _, test := range group.Status {
+			if test.Verdict == conf.IEVerdict {
+				return nil
+			}
+		}
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return errors.Wrap(err, "Cannot marshal result")
+	}
+	tmpFile, err := ioutil.TempFile("", "grader_result_")
+	if err != nil {
+		return errors.Wrap(err, "Cannot write result")
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(resultBytes)
+	tmpFile.Close()
+	if err != nil {
+		return errors.Wrap(err, "Cannot write result")
+	}
+	return cachePut(config, resultCacheDir, key, tmpFile.Name())
+}
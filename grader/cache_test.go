@@ -0,0 +1,155 @@
+package grader
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/fakebox"
+	"github.com/programming-in-th/grader/isolate"
+)
+
+func TestCache(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	gc.Glob.CachePath = path.Join(gc.BasePath, "cache")
+
+	compiles, runs := 0, 0
+	sandboxBackends["scripted"] = func(boxID int, config conf.Config) Sandbox {
+		return fakebox.NewScripted(boxID, func(dir string, options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics) {
+			if options.Stdin == "" { // The compiler reads no input
+				compiles++
+			} else {
+				runs++
+			}
+			return fakebox.Exec(dir, options, command)
+		})
+	}
+	defer delete(sandboxBackends, "scripted")
+	gc.Glob.Sandbox = "scripted"
+
+	steps := []struct {
+		name     string
+		code     string
+		compiles int
+		runs     int
+	}{
+		{"First submission", correctSolution, 1, 10},
+		{"Same code", correctSolution, 1, 10},
+		{"Nondeterministic scoring", correctSolution, 1, 20},
+		{"Different code", correctSolution + "// Changed\n", 2, 30},
+	}
+	for i, step := range steps {
+		if step.name == "Nondeterministic scoring" {
+			manifestPath := path.Join(gc.BasePath, "tasks", exampleTaskID, "manifest.json")
+			manifest, err := ReadManifest(manifestPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			manifest.NondeterministicScoring = true
+			err = WriteManifest(manifestPath, manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		result := gradeExample(t, gc, "test_cache_"+strconv.Itoa(i), step.code)
+		checkResult(t, step.name, result, 100, []float64{30, 70}, repeatVerdicts(conf.ACVerdict, 10))
+		if compiles != step.compiles || runs != step.runs {
+			t.Errorf("%s: got %d compiles and %d runs, expected %d and %d", step.name, compiles, runs, step.compiles, step.runs)
+		}
+	}
+
+	binaries, _ := ioutil.ReadDir(path.Join(gc.Glob.CachePath, binaryCacheDir))
+	results, _ := ioutil.ReadDir(path.Join(gc.Glob.CachePath, resultCacheDir))
+	// Results on the task stopped being cached once its scoring became nondeterministic
+	if len(binaries) != 2 || len(results) != 1 {
+		t.Errorf("Got %d binaries and %d results in the cache, expected 2 and 1", len(binaries), len(results))
+	}
+	for _, binary := range binaries {
+		if !strings.HasSuffix(binary.Name(), "."+binName) {
+			t.Errorf("Binary %s is not cached with its name", binary.Name())
+		}
+	}
+}
+
+func TestEvictCache(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "cache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+	config := conf.Config{Glob: conf.GlobalConfiguration{CachePath: cachePath, CacheSize: 1}}
+
+	// Three files of 400 KB, the second used most recently, do not fit in 1 MB
+	files := []string{path.Join(binaryCacheDir, "a.bin"), path.Join(resultCacheDir, "b"), path.Join(binaryCacheDir, "c.bin")}
+	used := []time.Duration{3 * time.Hour, time.Hour, 2 * time.Hour}
+	for i, file := range files {
+		os.MkdirAll(path.Dir(path.Join(cachePath, file)), 0755)
+		err := ioutil.WriteFile(path.Join(cachePath, file), make([]byte, 400*1024), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		usedTime := time.Now().Add(-used[i])
+		os.Chtimes(path.Join(cachePath, file), usedTime, usedTime)
+	}
+	err = evictCache(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, file := range files {
+		_, err := os.Stat(path.Join(cachePath, file))
+		if kept := err == nil; kept != (i != 0) {
+			t.Errorf("%s: got kept %v, expected %v", file, kept, i != 0)
+		}
+	}
+}
+
+func TestHashFileCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hash_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "1.in")
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	hashes := []string{}
+	write := func(content string) {
+		err := ioutil.WriteFile(filePath, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(filePath, modTime, modTime)
+		hash, err := hashFileCached(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	// The same size and modification time, first written in place and then replaced by another file
+	write("1 2\n")
+	write("3 4\n")
+	replacement := path.Join(dir, "replacement")
+	err = ioutil.WriteFile(replacement, []byte("5 6\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(replacement, modTime, modTime)
+	err = os.Rename(replacement, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashFileCached(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes = append(hashes, hash)
+	if hashes[0] == hashes[1] || hashes[1] == hashes[2] {
+		t.Errorf("Got hashes %v, expected each to differ", hashes)
+	}
+}
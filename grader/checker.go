@@ -2,7 +2,6 @@ package grader
 
 import (
 	"io/ioutil"
-	"log"
 	"os/exec"
 	"path"
 	"strconv"
@@ -18,14 +17,18 @@ type checkerResult struct {
 	message string
 }
 
-func writeCheckFile(submissionID string, testCaseIndex int, verdict string, score string, message string) {
+// writeCheckFile writes the result of a test for the grouper
+func writeCheckFile(submissionID string, testCaseIndex int, verdict string, score string, message string) error {
 	checkFilePath := path.Join(BASE_TMP_PATH, submissionID, strconv.Itoa(testCaseIndex+1)+".check")
 	err := ioutil.WriteFile(checkFilePath, []byte(verdict+"\n"+score+"\n"+message), 0644)
 	if err != nil {
-		log.Fatal("Error during checking. Cannot create .check file")
+		return errors.Wrap(err, "Cannot create .check file")
 	}
+	return nil
 }
 
+// runChecker checks the output of a test and writes its result for the grouper. A checker that fails or
+// prints something invalid gives "Judge Error" and an error
 func runChecker(submissionID string,
 	testCaseIndex int,
 	checkerPath string,
@@ -33,13 +36,13 @@ func runChecker(submissionID string,
 	outputPath string,
 	solutionPath string,
 	config conf.Config,
-) checkerResult {
+) (checkerResult, error) {
+	judgeErrorResult := checkerResult{conf.IEVerdict, "0", config.Glob.DefaultMessages[conf.IEVerdict]}
+
 	// Arguments: [path to checker binary, path to input file, path to user's produced output file, path to solution output (for checkers that diff)]
 	output, err := exec.Command(checkerPath, inputPath, outputPath, solutionPath).Output()
 	if err != nil {
-		log.Fatal(errors.Wrapf(err, "Error during checking. Did you chmod +x the checker executable?"))
-		writeCheckFile(submissionID, testCaseIndex, conf.IEVerdict, "0", config.Glob.DefaultMessages[conf.IEVerdict])
-		return checkerResult{conf.IEVerdict, "0", config.Glob.DefaultMessages[conf.IEVerdict]}
+		return judgeErrorResult, errors.Wrap(err, "Checker failed. Did you chmod +x the checker executable?")
 	}
 	outputLines := strings.Split(strings.TrimSpace(string(output)), "\n")
 	if len(outputLines) < 2 || len(outputLines) > 3 || !(func(arr []string, targ string) bool {
@@ -52,14 +55,11 @@ func runChecker(submissionID string,
 		}
 		return found
 	}(conf.PossibleCheckerVerdicts, outputLines[0])) {
-		writeCheckFile(submissionID, testCaseIndex, conf.IEVerdict, "0", config.Glob.DefaultMessages[conf.IEVerdict])
-		return checkerResult{conf.IEVerdict, "0", ""}
+		return judgeErrorResult, errors.Errorf("Checker output is invalid: %q", output)
 	}
-	if len(outputLines) == 2 {
-		writeCheckFile(submissionID, testCaseIndex, outputLines[0], outputLines[1], config.Glob.DefaultMessages[outputLines[0]])
-		return checkerResult{outputLines[0], outputLines[1], config.Glob.DefaultMessages[outputLines[0]]}
-	} else {
-		writeCheckFile(submissionID, testCaseIndex, outputLines[0], outputLines[1], outputLines[2])
-		return checkerResult{outputLines[0], outputLines[1], outputLines[2]}
+	result := checkerResult{outputLines[0], outputLines[1], config.Glob.DefaultMessages[outputLines[0]]}
+	if len(outputLines) == 3 {
+		result.message = outputLines[2]
 	}
+	return result, writeCheckFile(submissionID, testCaseIndex, result.verdict, result.score, result.message)
 }
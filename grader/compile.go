@@ -1,42 +1,229 @@
 package grader
 
 import (
+	"io"
+	"io/ioutil"
 	"log"
-	"os/exec"
+	"os"
 	"path"
 	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/isolate"
 )
 
-// Compiles user source into one file according to arguments in manifest.json
-func compileSubmission(submissionID string, taskID string, targLang string, srcPaths []string, compPaths []string, config conf.Config) (bool, string) {
-	args := []string{path.Join(BASE_TMP_PATH, submissionID)}
-	args = append(args, srcPaths...)
-	args = append(args, compPaths...)
-	out, err := exec.Command(
-		path.Join(config.BasePath, "config", "compileScripts", targLang),
-		args...,
-	).Output()
-	if err != nil {
-		log.Println(errors.Wrap(err, "Compile error: error executing compile script"))
-		log.Println("Args:", args)
-		log.Println("Output:", string(out))
-		return false, ""
+// compileScriptName is the name the compile script of the language is copied into the box as
+const compileScriptName = "compile"
+
+// compileOutputName is the file in the box the compile script writes its standard output to
+const compileOutputName = "compileOut"
+
+// compileMaxProcesses is the least number of processes compilers get, since they run their assembler and linker
+const compileMaxProcesses = 32
+
+// compileMessageName is the file the compiler's messages are written to, both in the box and in the working directory
+const compileMessageName = "compileMsg"
+
+// compileResult is the outcome of compiling a submission
+type compileResult struct {
+	verdict string // Empty if the submission compiled. Otherwise conf.CEVerdict, conf.CTLEVerdict or conf.IEVerdict
+	binPath string
+	message string // What the compiler printed, cut to compileMessageLimit
+	err     error  // Cause of conf.IEVerdict
+	aborted bool   // The compilation was cut off by aborting the grading job queue
+}
+
+// compileMessageLimit is the most of the compiler's messages that is kept
+const compileMessageLimit = 64 * 1024
+
+// compileJob asks a grading worker to compile a submission in one of its boxes
+type compileJob struct {
+	taskID           string
+	srcDir           string
+	srcNames         []string
+	compileFilePaths []string
+	resultChannel    chan compileResult
+}
+
+// programDirName is the directory in the working directory of a submission that the source files of an
+// interpreted language are copied to. They are run from there
+const programDirName = "program"
+
+// Compiles user source into one file according to arguments in manifest.json.
+// The source files are srcNames in srcDir, starting with the entry point. The compiler runs in a box with
+// the compile limits of the global configuration, and only the compiler's messages and the binary are
+// copied out into the working directory of the submission. The binary of an interpreted language is
+// its entry point, in a copy of the source files
+func compileSubmission(submissionID string, taskID string, targLang string, srcDir string, srcNames []string, compPaths []string, pool *boxPool, config conf.Config) compileResult {
+	langConfig := conf.GetLangCompileConfig(config, targLang)
+	if langConfig == nil {
+		return compileResult{verdict: conf.IEVerdict, err: errors.Errorf("Language %s is not configured", targLang)}
+	}
+
+	// Compiled binaries are cached by everything they depend on, so identical code is compiled once
+	cacheKey := ""
+	if cacheEnabled(config) && !langConfig.Interpreted {
+		hash, err := sourceHash(*langConfig, srcDir, srcNames, compPaths, config)
+		if err != nil {
+			log.Println(errors.Wrapf(err, "Cannot look up binary of submission %s in the cache", submissionID))
+		} else {
+			cacheKey = hash
+			if binPath := getCachedBinary(cacheKey, path.Join(BASE_TMP_PATH, submissionID), config); binPath != "" {
+				return compileResult{binPath: binPath}
+			}
+		}
+	}
+
+	result := compileResult{}
+	if !langConfig.Interpreted || len(langConfig.CompileCommands) > 0 {
+		entry, err := pool.get()
+		if err != nil {
+			return compileResult{verdict: conf.IEVerdict, err: err}
+		}
+		result = compileInBox(entry.box, submissionID, *langConfig, srcDir, srcNames, compPaths, config)
+		pool.put(entry, result.verdict == conf.IEVerdict)
+	}
+	if result.verdict == "" && cacheKey != "" {
+		err := putCachedBinary(cacheKey, result.binPath, config)
+		if err != nil {
+			log.Println(errors.Wrapf(err, "Cannot cache binary of submission %s", submissionID))
+		}
+	}
+	if result.verdict == "" && langConfig.Interpreted {
+		programPath := path.Join(BASE_TMP_PATH, submissionID, programDirName)
+		for _, name := range srcNames {
+			err := os.MkdirAll(path.Dir(path.Join(programPath, name)), 0755)
+			if err == nil {
+				err = copyFile(path.Join(srcDir, name), path.Join(programPath, name))
+			}
+			if err != nil {
+				return compileResult{verdict: conf.IEVerdict, err: errors.Wrap(err, "Cannot copy source files")}
+			}
+		}
+		result.binPath = path.Join(programPath, srcNames[0])
 	}
-	out_lines := strings.Split(string(out), "\n")
-	for i := 0; i < 2; i++ {
-		out_lines[i] = strings.TrimSpace(out_lines[i])
+	return result
+}
+
+func compileInBox(box Sandbox, submissionID string, langConfig conf.LangConfiguration, srcDir string, srcNames []string, compPaths []string, config conf.Config) compileResult {
+	workPath := path.Join(BASE_TMP_PATH, submissionID)
+	declarative := len(langConfig.CompileCommands) > 0
+
+	// The source files keep their directories, while the task's files are copied into the top of the box.
+	// Include directories are copied in whole and, for compile scripts, replaced by the box.
+	// Compile commands put "-I." in their template if they need it
+	files := make([][2]string, 0)
+	for _, name := range srcNames {
+		files = append(files, [2]string{path.Join(srcDir, name), name})
 	}
-	if len(out_lines) != 2 {
-		log.Println(errors.Wrap(err, "Compile error: compile script output is invalid"))
+	compileNames := make([]string, 0)
+	includeArgs := make([]string, 0)
+	for _, filePath := range compPaths {
+		if strings.HasPrefix(filePath, "-I") {
+			includePath := strings.TrimPrefix(filePath, "-I")
+			entries, _ := ioutil.ReadDir(includePath) // Tasks without compile files have no directory
+			for _, entry := range entries {
+				if entry.Mode().IsRegular() {
+					files = append(files, [2]string{path.Join(includePath, entry.Name()), entry.Name()})
+				}
+			}
+			includeArgs = append(includeArgs, "-I.")
+			continue
+		}
+		files = append(files, [2]string{filePath, path.Base(filePath)})
+		compileNames = append(compileNames, path.Base(filePath))
+	}
+
+	options := langRunOptions(isolate.RunOptions{
+		TimeLimit:   config.Glob.CompileTimeLimit,
+		ExtraTime:   1,
+		MemoryLimit: config.Glob.CompileMemoryLimit * 1024,
+		OutputLimit: config.Glob.BinarySizeLimit * 1024,
+	}, langConfig)
+	if options.MaxProcesses < compileMaxProcesses {
+		options.MaxProcesses = compileMaxProcesses
+	}
+	var command []string
+	if declarative {
+		command = expandCommand(langConfig.CompileCommands, append(append([]string{}, srcNames...), compileNames...), binName)
+		options.Stdout = compileMessageName
+		options.StderrToStdout = true
+	} else {
+		files = append(files, [2]string{path.Join(config.BasePath, "config", "compileScripts", langConfig.ID), compileScriptName})
+		command = append(append([]string{compileScriptName, "."}, srcNames...), includeArgs...)
+		command = append(command, compileNames...)
+		options.Stdout = compileOutputName
+	}
+	for _, file := range files {
+		err := box.CopyIn(file[0], file[1])
+		if err != nil {
+			return compileResult{verdict: conf.IEVerdict, err: err}
+		}
+	}
+
+	verdict, _ := box.Run(options, command)
+	box.CopyOut(compileMessageName, path.Join(workPath, compileMessageName)) // Only written if the compiler got that far
+	message := readCompileMessage(path.Join(workPath, compileMessageName))
+	switch verdict {
+	case isolate.IsolateRunOK:
+	case isolate.IsolateRunTLE, isolate.IsolateRunILE:
+		return compileResult{verdict: conf.CTLEVerdict, message: message}
+	case isolate.IsolateRunXX, isolate.IsolateRunOther:
+		return compileResult{verdict: conf.IEVerdict, err: errors.Errorf("Sandbox failed while compiling submission %s", submissionID)}
+	default:
+		log.Printf("Compile error: compiler of submission %s got verdict %s", submissionID, verdict)
+		return compileResult{verdict: conf.CEVerdict, message: message}
 	}
-	// Get return code from stdout
-	returnCode, err := strconv.Atoi(string(out_lines[0]))
+	if langConfig.Interpreted {
+		return compileResult{message: message} // The check passed, and the source file is the binary
+	}
+
+	outputBinName := binName
+	if !declarative {
+		// The compile script prints its return code and the path of the binary
+		outputPath := path.Join(workPath, compileOutputName)
+		err := box.CopyOut(compileOutputName, outputPath)
+		if err != nil {
+			return compileResult{verdict: conf.IEVerdict, err: err}
+		}
+		out, err := ioutil.ReadFile(outputPath)
+		if err != nil {
+			return compileResult{verdict: conf.IEVerdict, err: errors.Wrap(err, "Unable to read output of compile script")}
+		}
+		outLines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		if len(outLines) != 2 {
+			log.Println("Compile error: compile script output is invalid:", string(out))
+			return compileResult{verdict: conf.CEVerdict, message: message}
+		}
+		returnCode, err := strconv.Atoi(strings.TrimSpace(outLines[0]))
+		if err != nil {
+			log.Println(errors.Wrap(err, "Compile error: compile script output is invalid"))
+			return compileResult{verdict: conf.CEVerdict, message: message}
+		}
+		if returnCode != 0 {
+			return compileResult{verdict: conf.CEVerdict, message: message}
+		}
+		outputBinName = path.Base(strings.TrimSpace(outLines[1]))
+	}
+
+	binPath := path.Join(workPath, outputBinName)
+	err := box.CopyOut(outputBinName, binPath)
+	if err != nil {
+		log.Println(errors.Wrap(err, "Compile error: binary is missing"))
+		return compileResult{verdict: conf.CEVerdict, message: message}
+	}
+	return compileResult{binPath: binPath, message: message}
+}
+
+// readCompileMessage reads the compiler's messages, which are empty if the compiler wrote none
+func readCompileMessage(messagePath string) string {
+	messageFile, err := os.Open(messagePath)
 	if err != nil {
-		log.Println(errors.Wrap(err, "Compile error: compile script output is invalid"))
+		return ""
 	}
-	return returnCode == 0, out_lines[1]
+	defer messageFile.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(messageFile, compileMessageLimit))
+	return string(message)
 }
@@ -1,78 +1,639 @@
 package grader
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
+	"os/exec"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/programming-in-th/grader/api"
 	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/fakebox"
+	"github.com/programming-in-th/grader/isolate"
 )
 
-func TestReadManifest(t *testing.T) {
-	gc := conf.InitConfig("/home/proggrader/testcases")
-	pathTo := path.Join(gc.BasePath, "tasks", "o61_may08_estate", "manifest.json")
-	t.Log("Path to manifest.json: ", pathTo)
-	manifestInstance, err := readManifestFromFile(pathTo, gc)
+const exampleTaskID = "a_time_b"
+
+const correctSolution = `#include <iostream>
+int main() { long long a, b; std::cin >> a >> b; std::cout << a * b << std::endl; }
+`
+
+var (
+	checkerOnce sync.Once
+	checkerPath string
+	checkerOut  []byte
+	checkerErr  error
+)
+
+// newExampleConfig copies the example configuration and tasks into a new base path, compiles the checker
+// used by the example task and selects the fake sandbox. The returned function removes the base path
+func newExampleConfig(t *testing.T) (conf.Config, func()) {
+	if _, err := exec.LookPath("c++"); err != nil {
+		t.Skip("A C++ compiler is needed to grade the example task")
+	}
+	basePath, err := ioutil.TempDir("", "grader_test")
 	if err != nil {
-		t.Error("Can't read manifest.json\n", err)
+		t.Fatal(err)
 	}
-	t.Log(manifestInstance)
-	t.Log(manifestInstance.DefaultLimits)
+	cleanup := func() {
+		os.RemoveAll(basePath)
+	}
+	for _, dir := range []string{"config", "tasks"} {
+		out, err := exec.Command("cp", "-r", path.Join("..", "example", dir), basePath).CombinedOutput()
+		if err != nil {
+			cleanup()
+			t.Fatalf("Cannot copy example %s: %v\n%s", dir, err, out)
+		}
+	}
+	// Compiling testlib is slow, so the checker is compiled once and copied into every base path
+	checkerOnce.Do(func() {
+		checkerPath = path.Join(os.TempDir(), "grader_test_lcmp_"+strconv.Itoa(os.Getpid()))
+		checkerOut, checkerErr = exec.Command("c++", "--std=c++14", "-O2", "-o", checkerPath,
+			path.Join("..", "example", "config", "defaultCheckers", "lcmp.cpp")).CombinedOutput()
+	})
+	if checkerErr != nil {
+		cleanup()
+		t.Fatalf("Cannot compile checker: %v\n%s", checkerErr, checkerOut)
+	}
+	out, err := exec.Command("cp", checkerPath, path.Join(basePath, "config", "defaultCheckers", "lcmp")).CombinedOutput()
+	if err != nil {
+		cleanup()
+		t.Fatalf("Cannot copy checker: %v\n%s", err, out)
+	}
+	for _, dir := range []string{BASE_TMP_PATH, BASE_SRC_PATH} {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+
+	config := conf.InitConfig(basePath)
+	config.Glob.Sandbox = "fake"
+	config.Glob.AllowFakeSandbox = true
+	return config, cleanup
 }
 
-// Tests whole grading pipeline
-func TestGradeSubmission(t *testing.T) {
-	src := make([]string, 1)
-	data, _ := ioutil.ReadFile("/home/proggrader/test.cpp")
-	src[0] = string(data)
-	gc := conf.InitConfig("/home/proggrader/testcases")
+// gradeExample grades code on the example task and returns the final result
+func gradeExample(t *testing.T, config conf.Config, submissionID string, code string) *PrefixGroupResult {
 	done := make(chan bool)
-	jobQueue := NewGradingJobQueue(1, done, gc)
+	jobQueue := NewGradingJobQueue(1, done, config)
+	defer func() {
+		done <- true
+	}()
 	ch := make(chan api.SyncUpdate)
+	defer close(ch)
 	go func() {
-		for {
-			message := <-ch
-			t.Log(message)
+		for range ch {
 		}
 	}()
-	err := GradeSubmission("submissionID", "o61_may08_estate", "cpp14", src, jobQueue, ch, gc)
+	result, err := gradeSubmission(submissionID, exampleTaskID, "cpp14", api.Source{Code: []string{code}}, jobQueue, ch, config)
+	if err != nil {
+		t.Fatal("Error grading submission: ", err)
+	}
+	return result
+}
+
+// verdicts lists the verdict of every test in result in order
+func verdicts(result *PrefixGroupResult) []string {
+	list := make([]string, 0)
+	for _, group := range result.GroupResults {
+		for _, test := range group.Status {
+			list = append(list, test.Verdict)
+		}
+	}
+	return list
+}
+
+// repeatVerdicts concatenates count copies of each verdict in turn, e.g. repeatVerdicts("A", 2, "B", 1) = [A A B]
+func repeatVerdicts(verdictCounts ...interface{}) []string {
+	list := make([]string, 0)
+	for i := 0; i < len(verdictCounts); i += 2 {
+		for j := 0; j < verdictCounts[i+1].(int); j++ {
+			list = append(list, verdictCounts[i].(string))
+		}
+	}
+	return list
+}
+
+func checkResult(t *testing.T, name string, result *PrefixGroupResult, score float64, groupScores []float64, expectedVerdicts []string) {
+	if result == nil {
+		t.Errorf("%s: submission did not compile", name)
+		return
+	}
+	if result.Score != score {
+		t.Errorf("%s: got score %v, expected %v", name, result.Score, score)
+	}
+	for i, groupScore := range groupScores {
+		if result.GroupResults[i].Score != groupScore {
+			t.Errorf("%s: got score %v for group %d, expected %v", name, result.GroupResults[i].Score, i+1, groupScore)
+		}
+	}
+	got := verdicts(result)
+	if len(got) != len(expectedVerdicts) {
+		t.Errorf("%s: got verdicts %v, expected %v", name, got, expectedVerdicts)
+		return
+	}
+	for i := range got {
+		if got[i] != expectedVerdicts[i] {
+			t.Errorf("%s: got verdicts %v, expected %v", name, got, expectedVerdicts)
+			return
+		}
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	manifestInstance, err := readManifestFromFile(path.Join(gc.BasePath, "tasks", exampleTaskID, "manifest.json"), gc)
+	if err != nil {
+		t.Fatal("Can't read manifest.json\n", err)
+	}
+	if manifestInstance.numTests != 10 || len(manifestInstance.Groups) != 2 {
+		t.Errorf("Got %d tests in %d groups, expected 10 tests in 2 groups", manifestInstance.numTests, len(manifestInstance.Groups))
+	}
+	timeLimit, memoryLimit := manifestInstance.runLimits("cpp14")
+	if timeLimit != 1 || memoryLimit != 64*1024 {
+		t.Errorf("Got limits %v s and %d KiB, expected 1 s and 65536 KiB", timeLimit, memoryLimit)
+	}
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	os.Remove(checkerPath)
+	os.Exit(code)
+}
+
+// Tests whole grading pipeline
+func TestGradeSubmission(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+
+	tests := []struct {
+		name        string
+		code        string
+		score       float64
+		groupScores []float64
+		verdicts    []string
+	}{
+		{"Correct", correctSolution, 100, []float64{30, 70},
+			repeatVerdicts(conf.ACVerdict, 10)},
+		{"Overflow", "#include <iostream>\nint main() { int a, b; std::cin >> a >> b; std::cout << a * b << std::endl; }\n", 30, []float64{30, 0},
+			repeatVerdicts(conf.ACVerdict, 5, conf.WAVerdict, 1, conf.SKVerdict, 4)},
+		{"Incorrect", "#include <iostream>\nint main() { long long a, b; std::cin >> a >> b; std::cout << a + b << std::endl; }\n", 0, []float64{0, 0},
+			repeatVerdicts(conf.WAVerdict, 1, conf.SKVerdict, 9)},
+		{"Runtime Error", "int main() { return 1; }\n", 0, []float64{0, 0},
+			repeatVerdicts(conf.REVerdict, 1, conf.SKVerdict, 9)},
+	}
+	for i, test := range tests {
+		result := gradeExample(t, gc, "test_grade_"+strconv.Itoa(i), test.code)
+		checkResult(t, test.name, result, test.score, test.groupScores, test.verdicts)
+	}
+
+	result := gradeExample(t, gc, "test_grade_ce", "int main() { syntax error }\n")
+	if result != nil {
+		t.Error("Compilation Error: expected no result")
+	}
+
+	// A group skipped because its dependency failed has exactly one skipped result per test
+	manifestInstance, err := readManifestFromFile(path.Join(gc.BasePath, "tasks", exampleTaskID, "manifest.json"), gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := manifestInstance.Groups[1]
+	result = gradeExample(t, gc, "test_grade_skipped", tests[2].code)
+	if result == nil || len(result.GroupResults) != 2 {
+		t.Fatalf("Got result %+v, expected two groups", result)
+	}
+	status := result.GroupResults[1].Status
+	if len(status) != group.TestIndices.End-group.TestIndices.Start {
+		t.Errorf("Skipped group has %d results, expected %d", len(status), group.TestIndices.End-group.TestIndices.Start)
+	}
+	for _, testResult := range status {
+		if testResult.Verdict != conf.SKVerdict {
+			t.Errorf("Got results %+v for the skipped group", status)
+			break
+		}
+	}
+}
+
+func TestGradeSubmissionTimeLimit(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+
+	// Time out on the last test of the first group only
+	runs := 0
+	sandboxBackends["scripted"] = func(boxID int, config conf.Config) Sandbox {
+		return fakebox.NewScripted(boxID, func(dir string, options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics) {
+			if options.Stdin == "" { // The compiler reads no input
+				return fakebox.Exec(dir, options, command)
+			}
+			runs++
+			if runs == 5 {
+				return isolate.IsolateRunTLE, isolate.RunMetrics{TimeElapsed: 1500, MemoryUsage: 1024}
+			}
+			input, _ := ioutil.ReadFile(path.Join(dir, options.Stdin))
+			var a, b int64
+			fmt.Sscan(string(input), &a, &b)
+			ioutil.WriteFile(path.Join(dir, options.Stdout), []byte(strconv.FormatInt(a*b, 10)+"\n"), 0644)
+			return isolate.IsolateRunOK, isolate.RunMetrics{TimeElapsed: 10, MemoryUsage: 1024}
+		})
+	}
+	defer delete(sandboxBackends, "scripted")
+	gc.Glob.Sandbox = "scripted"
+
+	result := gradeExample(t, gc, "test_grade_tle", correctSolution)
+	checkResult(t, "Time Limit Exceeded", result, 0, []float64{0, 0},
+		repeatVerdicts(conf.ACVerdict, 4, conf.TLEVerdict, 1, conf.SKVerdict, 5))
+	if result != nil && result.Time != 1500 {
+		t.Errorf("Got time %d, expected 1500", result.Time)
+	}
+}
+
+func TestGradeSubmissionGrouperFailure(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+
+	taskPath := path.Join(gc.BasePath, "tasks", exampleTaskID)
+	manifest, err := ReadManifest(path.Join(taskPath, "manifest.json"))
 	if err != nil {
-		t.Error("Error grading submission")
+		t.Fatal(err)
+	}
+	manifest.Grouper = "custom"
+	err = WriteManifest(path.Join(taskPath, "manifest.json"), manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(taskPath, "grouper"), []byte("#!/bin/sh\nexit 1\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
 	}
 
+	// The first group is judged but scores nothing, and the second is skipped
+	result := gradeExample(t, gc, "test_grade_grouper", correctSolution)
+	checkResult(t, "Grouper failure", result, 0, []float64{0, 0},
+		repeatVerdicts(conf.ACVerdict, 5, conf.SKVerdict, 5))
 }
 
 func TestWaitForTestResult(t *testing.T) {
-	gc := conf.InitConfig("/home/proggrader/testcases")
-	pathToManifest := path.Join(gc.BasePath, "tasks", "o61_may08_estate", "manifest.json")
-	manifestInstance, _ := readManifestFromFile(pathToManifest, gc)
-	boxIDPool := safeBoxIDPool{BoxIDs: make(map[int]bool)}
-	result := waitForTestResult(manifestInstance, "submissionID", "cpp14", "/home/proggrader/a.out", 18, gc, &boxIDPool)
-	t.Log(result)
-}
-
-func TestRunIsolate(t *testing.T) {
-	boxIDPool := safeBoxIDPool{BoxIDs: make(map[int]bool)}
-	result := runIsolate("/home/proggrader/a.out",
-		3,
-		512000,
-		"/home/proggrader/testcases/tasks/o61_may08_estate/inputs/19.in",
-		"/home/proggrader/output",
-		"/usr/local/bin/isolate",
-		"/home/proggrader/testcases/config/runnerScripts/cpp14",
-		&boxIDPool,
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	manifestInstance, err := readManifestFromFile(path.Join(gc.BasePath, "tasks", exampleTaskID, "manifest.json"), gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userBinPath := compileExample(t, gc, "test_wait", correctSolution)
+	defer os.RemoveAll(path.Join(BASE_TMP_PATH, "test_wait"))
+
+	pool := newBoxPool(1, gc)
+	defer pool.close()
+	result := waitForTestResult(manifestInstance, "test_wait", "cpp14", userBinPath, 5, gc, pool)
+	if result.Verdict != conf.ACVerdict || result.Score != "100" {
+		t.Errorf("Got %v, expected a correct result", result)
+	}
+}
+
+func TestWaitForTestResultDetails(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	manifestInstance, err := readManifestFromFile(path.Join(gc.BasePath, "tasks", exampleTaskID, "manifest.json"), gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash := "#include <cstdlib>\n#include <iostream>\nint main() { std::cerr << \"bad input\" << std::endl; std::abort(); }\n"
+	userBinPath := compileExample(t, gc, "test_details", crash)
+	defer os.RemoveAll(path.Join(BASE_TMP_PATH, "test_details"))
+
+	pool := newBoxPool(1, gc)
+	defer pool.close()
+	result := waitForTestResult(manifestInstance, "test_details", "cpp14", userBinPath, 0, gc, pool)
+	if result.Verdict != conf.REVerdict || result.Signal != "SIGABRT" || result.Killed {
+		t.Errorf("Got %+v, expected a runtime error from SIGABRT", result)
+	}
+	if result.Stderr != "" {
+		t.Errorf("Got standard error %q, expected it to be hidden", result.Stderr)
+	}
+
+	manifestInstance.ShowStderr = true
+	result = waitForTestResult(manifestInstance, "test_details", "cpp14", userBinPath, 0, gc, pool)
+	if result.Stderr != "bad input\n" {
+		t.Errorf("Got standard error %q, expected \"bad input\\n\"", result.Stderr)
+	}
+}
+
+func TestWaitForTestResultOutputLimit(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	manifestInstance, err := readManifestFromFile(path.Join(gc.BasePath, "tasks", exampleTaskID, "manifest.json"), gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flood := "#include <cstdio>\nint main() { for (int i = 0; i < 1 << 21; i++) std::putchar('a'); }\n"
+	userBinPath := compileExample(t, gc, "test_output_limit", flood)
+	defer os.RemoveAll(path.Join(BASE_TMP_PATH, "test_output_limit"))
+
+	pool := newBoxPool(1, gc)
+	defer pool.close()
+	manifestInstance.OutputLimit = 1
+	result := waitForTestResult(manifestInstance, "test_output_limit", "cpp14", userBinPath, 0, gc, pool)
+	if result.Verdict != conf.OLEVerdict || result.Signal != "SIGXFSZ" {
+		t.Errorf("Got %+v, expected %s", result, conf.OLEVerdict)
+	}
+	info, err := os.Stat(path.Join(BASE_TMP_PATH, "test_output_limit", "1.out"))
+	if err == nil && info.Size() > 1024*1024 {
+		t.Errorf("Got %d bytes of output, expected at most 1 MiB", info.Size())
+	}
+}
+
+func TestReadStderrTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grader_test_stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stderrPath := path.Join(dir, "short.err")
+	ioutil.WriteFile(stderrPath, []byte("short\n"), 0644)
+	tail, err := readStderrTail(stderrPath)
+	if err != nil || tail != "short\n" {
+		t.Errorf("Got %q, %v, expected the whole file", tail, err)
+	}
+
+	stderrPath = path.Join(dir, "long.err")
+	ioutil.WriteFile(stderrPath, []byte(strings.Repeat("a", 3*stderrTailSize)+"end"), 0644)
+	tail, err = readStderrTail(stderrPath)
+	if err != nil || len(tail) != len("...")+stderrTailSize || !strings.HasPrefix(tail, "...") || !strings.HasSuffix(tail, "end") {
+		t.Errorf("Got %d bytes, %v, expected the marked end of the file", len(tail), err)
+	}
+}
+
+func TestRunInSandbox(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	userBinPath := compileExample(t, gc, "test_run", correctSolution)
+	defer os.RemoveAll(path.Join(BASE_TMP_PATH, "test_run"))
+
+	pool := newBoxPool(1, gc)
+	defer pool.close()
+	outputPath := path.Join(BASE_TMP_PATH, "test_run", "1.out")
+	result := runInSandbox(userBinPath,
+		1,
+		64*1024,
+		1024,
+		path.Join(gc.BasePath, "tasks", exampleTaskID, "inputs", "1.in"),
+		outputPath,
+		path.Join(BASE_TMP_PATH, "test_run", "1.err"),
+		"cpp14",
+		pool,
 	)
-	t.Log(result)
+	if result.verdict != isolate.IsolateRunOK {
+		t.Fatalf("Got verdict %s, expected %s: %v", result.verdict, isolate.IsolateRunOK, result.err)
+	}
+	output, _ := ioutil.ReadFile(outputPath)
+	if string(output) != "10\n" {
+		t.Errorf("Got output %q, expected \"10\\n\"", output)
+	}
+	if len(pool.boxes) != 1 {
+		t.Error("Box was not returned to the pool")
+	}
 }
 
 func TestCompile(t *testing.T) {
-	gc := conf.InitConfig("/home/szawinis/testing")
-	src := make([]string, 1)
-	src[0] = "/home/szawinis/testing/rectsum_test.cpp"
-	successful, binPath := compileSubmission("submissionID", "rectsum", "cpp14", src, gc)
-	t.Log("Compile success?", successful)
-	t.Log("User binary path:", binPath)
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	binPath := compileExample(t, gc, "test_compile", correctSolution)
+	defer os.RemoveAll(path.Join(BASE_TMP_PATH, "test_compile"))
+	if binPath != path.Join(BASE_TMP_PATH, "test_compile", "bin") {
+		t.Errorf("Got user binary path %s", binPath)
+	}
+}
+
+// compileExample compiles code for the example task in the working directory of submissionID
+func compileExample(t *testing.T, config conf.Config, submissionID string, code string) string {
+	err := os.MkdirAll(path.Join(BASE_TMP_PATH, submissionID), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcPath := path.Join(BASE_SRC_PATH, submissionID+".cpp")
+	err = ioutil.WriteFile(srcPath, []byte(code), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(srcPath)
+	pool := newBoxPool(1, config)
+	defer pool.close()
+	compiled := compileSubmission(submissionID, exampleTaskID, "cpp14", BASE_SRC_PATH, []string{submissionID + ".cpp"}, nil, pool, config)
+	if compiled.verdict != "" {
+		t.Fatalf("Compilation failed with verdict %s: %v", compiled.verdict, compiled.err)
+	}
+	return compiled.binPath
+}
+
+func TestCompileLimits(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	err := os.MkdirAll(path.Join(BASE_TMP_PATH, "test_compile_limits"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path.Join(BASE_TMP_PATH, "test_compile_limits"))
+	compile := func(code string) compileResult {
+		srcPath := path.Join(BASE_SRC_PATH, "test_compile_limits.cpp")
+		ioutil.WriteFile(srcPath, []byte(code), 0644)
+		defer os.Remove(srcPath)
+		pool := newBoxPool(1, gc)
+		defer pool.close()
+		return compileSubmission("test_compile_limits", exampleTaskID, "cpp14", BASE_SRC_PATH, []string{"test_compile_limits.cpp"}, nil, pool, gc)
+	}
+
+	// A binary larger than the limit cannot be written
+	gc.Glob.BinarySizeLimit = 1
+	result := compile("char big[4 << 20] = {1};\nint main() { return big[0]; }\n")
+	if result.verdict != conf.CEVerdict {
+		t.Errorf("Oversized binary: got verdict %q, expected %s", result.verdict, conf.CEVerdict)
+	}
+
+	var compileVerdict isolate.RunVerdict
+	sandboxBackends["scripted"] = func(boxID int, config conf.Config) Sandbox {
+		return fakebox.NewScripted(boxID, func(dir string, options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics) {
+			return compileVerdict, isolate.RunMetrics{}
+		})
+	}
+	defer delete(sandboxBackends, "scripted")
+	gc.Glob.Sandbox = "scripted"
+	for sandboxVerdict, verdict := range map[isolate.RunVerdict]string{
+		isolate.IsolateRunTLE: conf.CTLEVerdict,
+		isolate.IsolateRunILE: conf.CTLEVerdict,
+		isolate.IsolateRunMLE: conf.CEVerdict,
+		isolate.IsolateRunOLE: conf.CEVerdict,
+		isolate.IsolateRunXX:  conf.IEVerdict,
+	} {
+		compileVerdict = sandboxVerdict
+		result := compile(correctSolution)
+		if result.verdict != verdict {
+			t.Errorf("%s: got verdict %q, expected %s", sandboxVerdict, result.verdict, verdict)
+		}
+	}
+}
+
+func TestSandboxVerdicts(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	manifestInstance, err := readManifestFromFile(path.Join(gc.BasePath, "tasks", exampleTaskID, "manifest.json"), gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(path.Join(BASE_TMP_PATH, "test_verdicts"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path.Join(BASE_TMP_PATH, "test_verdicts"))
+
+	var runVerdict isolate.RunVerdict
+	sandboxBackends["scripted"] = func(boxID int, config conf.Config) Sandbox {
+		return fakebox.NewScripted(boxID, func(dir string, options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics) {
+			return runVerdict, isolate.RunMetrics{TimeElapsed: 10, MemoryUsage: 1024}
+		})
+	}
+	defer delete(sandboxBackends, "scripted")
+	gc.Glob.Sandbox = "scripted"
+	pool := newBoxPool(1, gc)
+	defer pool.close()
+
+	// The program is never run, so any file will do
+	userBinPath := path.Join(gc.BasePath, "tasks", exampleTaskID, "manifest.json")
+	for sandboxVerdict, verdict := range map[isolate.RunVerdict]string{
+		isolate.IsolateRunTLE:   conf.TLEVerdict,
+		isolate.IsolateRunILE:   conf.ILEVerdict,
+		isolate.IsolateRunMLE:   conf.MLEVerdict,
+		isolate.IsolateRunOLE:   conf.OLEVerdict,
+		isolate.IsolateRunRE:    conf.REVerdict,
+		isolate.IsolateRunSV:    conf.SVVerdict,
+		isolate.IsolateRunXX:    conf.IEVerdict,
+		isolate.IsolateRunOther: conf.IEVerdict,
+	} {
+		runVerdict = sandboxVerdict
+		result := waitForTestResult(manifestInstance, "test_verdicts", "cpp14", userBinPath, 0, gc, pool)
+		if result.Verdict != verdict || result.Score != "0" {
+			t.Errorf("%s: got %v, expected %s", sandboxVerdict, result, verdict)
+		}
+	}
+}
+
+func TestContinuesGroup(t *testing.T) {
+	tests := []struct {
+		result   SingleTestResult
+		expected bool
+	}{
+		{SingleTestResult{Verdict: conf.ACVerdict, Score: "100"}, true},
+		{SingleTestResult{Verdict: conf.PartialVerdict, Score: "0"}, true},
+		{SingleTestResult{Verdict: conf.PEVerdict, Score: "50"}, true},
+		{SingleTestResult{Verdict: conf.PEVerdict, Score: "0"}, false},
+		{SingleTestResult{Verdict: conf.WAVerdict, Score: "0"}, false},
+		{SingleTestResult{Verdict: conf.ILEVerdict, Score: "0"}, false},
+	}
+	for _, test := range tests {
+		if continuesGroup(test.result) != test.expected {
+			t.Errorf("%s with score %s: expected %v", test.result.Verdict, test.result.Score, test.expected)
+		}
+	}
+}
+
+func TestExpandCommand(t *testing.T) {
+	command := expandCommand([]string{"cc", "-I.", "$SRC", "-o", "$BIN", "-Wl,-Map=$BIN.map"}, []string{"a.c", "b.c"}, "bin")
+	expected := []string{"cc", "-I.", "a.c", "b.c", "-o", "bin", "-Wl,-Map=bin.map"}
+	if strings.Join(command, " ") != strings.Join(expected, " ") {
+		t.Errorf("Got %v, expected %v", command, expected)
+	}
+
+	options := langRunOptions(isolate.RunOptions{TimeLimit: 1, MemoryLimit: 256 * 1024}, conf.LangConfiguration{
+		Env:            map[string]string{"LANG": "C.UTF-8", "JAVA_OPTS": "-Xmx$MEMORYm"},
+		Directories:    []string{"/usr/lib/jvm"},
+		MaxProcesses:   64,
+		StackLimit:     64,
+		WallTimeFactor: 2,
+	})
+	if strings.Join(options.Env, " ") != "JAVA_OPTS=-Xmx256m LANG=C.UTF-8" || len(options.Directories) != 1 ||
+		options.MaxProcesses != 64 || options.StackLimit != 64*1024 || options.WallTime != 12 || options.TimeLimit != 1 {
+		t.Errorf("Got options %+v", options)
+	}
+
+	// Languages without a profile keep the defaults of the sandbox
+	options = langRunOptions(isolate.RunOptions{TimeLimit: 1}, conf.LangConfiguration{})
+	if len(options.Env) != 0 || options.MaxProcesses != 0 || options.StackLimit != 0 || options.WallClockLimit() != 6 {
+		t.Errorf("Got options %+v", options)
+	}
 }
 
-// TODO: Try to go for a more modular testing framework
+// TestLanguages compiles and runs an interpreted language defined by commands and a language
+// that only has scripts
+func TestLanguages(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is needed to run the languages")
+	}
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	workPath := path.Join(BASE_TMP_PATH, "test_languages")
+	err := os.MkdirAll(workPath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workPath)
+
+	gc.Glob.LangConfig = append(gc.Glob.LangConfig, conf.LangConfiguration{ID: "sh", Extension: "sh"})
+	for dir, script := range map[string]string{
+		"compileScripts": "#!/bin/sh\ncp \"$1/$2\" \"$1/prog\"\necho 0\necho \"$1/prog\"\n",
+		"runnerScripts":  "#!/bin/sh\nexec /bin/sh ./prog\n",
+	} {
+		err := ioutil.WriteFile(path.Join(gc.BasePath, "config", dir, "sh"), []byte(script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	inputPath := path.Join(workPath, "input")
+	err = ioutil.WriteFile(inputPath, []byte("5 2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := newBoxPool(1, gc)
+	defer pool.close()
+	for _, test := range []struct {
+		lang    string
+		code    string
+		verdict string
+	}{
+		{"python3", "a, b = map(int, input().split())\nprint(a * b)\n", ""},
+		{"python3", "print(\n", conf.CEVerdict},
+		{"sh", "read a b\necho $((a * b))\n", ""},
+	} {
+		srcPath := path.Join(workPath, "main."+test.lang)
+		err := ioutil.WriteFile(srcPath, []byte(test.code), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compiled := compileSubmission("test_languages", exampleTaskID, test.lang, workPath, []string{path.Base(srcPath)}, nil, pool, gc)
+		if compiled.verdict != test.verdict {
+			t.Errorf("%s: got verdict %q, expected %q: %v", test.lang, compiled.verdict, test.verdict, compiled.err)
+		}
+		if compiled.verdict != "" {
+			continue
+		}
+
+		outputPath := path.Join(workPath, "output")
+		result := runInSandbox(compiled.binPath, 1, 64*1024, 1024, inputPath, outputPath, path.Join(workPath, "stderr"), test.lang, pool)
+		if result.verdict != isolate.IsolateRunOK {
+			t.Errorf("%s: got verdict %s: %v", test.lang, result.verdict, result.err)
+			continue
+		}
+		output, _ := ioutil.ReadFile(outputPath)
+		if string(output) != "10\n" {
+			t.Errorf("%s: got output %q, expected \"10\\n\"", test.lang, output)
+		}
+	}
+}
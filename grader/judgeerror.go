@@ -0,0 +1,45 @@
+package grader
+
+import (
+	"fmt"
+
+	"github.com/programming-in-th/grader/api"
+	"github.com/programming-in-th/grader/conf"
+)
+
+// JudgeError is a failure of the grader or of a task, such as a checker that crashes, rather than of the
+// submission. The test or submission it happened in gets "Judge Error", and operators are alerted
+type JudgeError struct {
+	SubmissionID string
+	TaskID       string
+	Test         int // Index of the test, starting at 1. 0 if the error is not of one test
+	Err          error
+}
+
+func (judgeError *JudgeError) Error() string {
+	where := "submission " + judgeError.SubmissionID
+	if judgeError.Test > 0 {
+		where = fmt.Sprintf("test %d of %s", judgeError.Test, where)
+	}
+	return fmt.Sprintf("Judge error in %s of task %s: %v", where, judgeError.TaskID, judgeError.Err)
+}
+
+// Cause returns the underlying error, for errors.Cause
+func (judgeError *JudgeError) Cause() error {
+	return judgeError.Err
+}
+
+// Unwrap returns the underlying error, for errors.Is and errors.As
+func (judgeError *JudgeError) Unwrap() error {
+	return judgeError.Err
+}
+
+// reportJudgeError alerts operators to a judge error
+func reportJudgeError(judgeError *JudgeError, config conf.Config) {
+	api.SendAlert(api.Alert{
+		SubmissionID: judgeError.SubmissionID,
+		TaskID:       judgeError.TaskID,
+		Test:         judgeError.Test,
+		Message:      judgeError.Error(),
+	}, config)
+}
@@ -0,0 +1,86 @@
+package grader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/api"
+	"github.com/programming-in-th/grader/conf"
+)
+
+func TestJudgeErrorCause(t *testing.T) {
+	cause := errors.New("Checker failed")
+	var err error = &JudgeError{SubmissionID: "42", TaskID: "a_time_b", Test: 3, Err: cause}
+	if errors.Cause(err) != cause {
+		t.Errorf("Got cause %v", errors.Cause(err))
+	}
+	if err.Error() != "Judge error in test 3 of submission 42 of task a_time_b: Checker failed" {
+		t.Errorf("Got message %q", err.Error())
+	}
+}
+
+func TestGradeBrokenChecker(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+
+	var mutex sync.Mutex
+	alerts := make([]api.Alert, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert api.Alert
+		json.NewDecoder(r.Body).Decode(&alert)
+		mutex.Lock()
+		alerts = append(alerts, alert)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+	gc.Glob.AlertURL = server.URL
+
+	// A checker that crashes fails the tests it checks instead of the grader
+	taskPath := path.Join(gc.BasePath, "tasks", exampleTaskID)
+	manifest, err := ReadManifest(path.Join(taskPath, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Checker = "custom"
+	err = WriteManifest(path.Join(taskPath, "manifest.json"), manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(taskPath, "checker"), []byte("#!/bin/sh\nexit 1\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := gradeExample(t, gc, "test_broken_checker", correctSolution)
+	if result == nil || result.GroupResults[0].Status[0].Verdict != conf.IEVerdict {
+		t.Fatalf("Got result %+v, expected the first test to get %s", result, conf.IEVerdict)
+	}
+
+	// Alerts are posted without waiting, so they are waited for here
+	found := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, alert := range alerts {
+			if alert.TaskID == exampleTaskID && alert.SubmissionID == "test_broken_checker" && alert.Test == 1 {
+				return true
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !found() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !found() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		t.Errorf("Got alerts %+v, expected one for the first test", alerts)
+	}
+}
@@ -0,0 +1,91 @@
+package grader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/isolate"
+)
+
+// Placeholders in the commands of a language
+const (
+	srcPlaceholder    = "$SRC"
+	mainPlaceholder   = "$MAIN"
+	binPlaceholder    = "$BIN"
+	memoryPlaceholder = "$MEMORY" // In environment variables
+)
+
+// binName is the name of binaries built from the commands of a language
+const binName = "bin"
+
+// expandCommand fills in the placeholders of a command of a language. $SRC must be a whole argument,
+// and is replaced by all of srcNames. $MAIN is the first of srcNames, the entry point
+func expandCommand(command []string, srcNames []string, binName string) []string {
+	mainName := ""
+	if len(srcNames) > 0 {
+		mainName = srcNames[0]
+	}
+	expanded := make([]string, 0, len(command)+len(srcNames))
+	for _, arg := range command {
+		if arg == srcPlaceholder {
+			expanded = append(expanded, srcNames...)
+			continue
+		}
+		arg = strings.Replace(arg, mainPlaceholder, mainName, -1)
+		expanded = append(expanded, strings.Replace(arg, binPlaceholder, binName, -1))
+	}
+	return expanded
+}
+
+// langRunOptions applies the sandbox profile of a language to options: its environment, directories,
+// process and stack limits, and wall clock factor. options must already have its time and memory limits
+func langRunOptions(options isolate.RunOptions, langConfig conf.LangConfiguration) isolate.RunOptions {
+	memory := strconv.Itoa(options.MemoryLimit / 1024)
+	options.Env = make([]string, 0, len(langConfig.Env))
+	for key, value := range langConfig.Env {
+		options.Env = append(options.Env, key+"="+strings.Replace(value, memoryPlaceholder, memory, -1))
+	}
+	sort.Strings(options.Env) // Runs must not depend on the order of a map
+	options.Directories = langConfig.Directories
+	options.MaxProcesses = langConfig.MaxProcesses
+	options.StackLimit = langConfig.StackLimit * 1024
+	if langConfig.WallTimeFactor > 0 {
+		options.WallTime = options.WallClockLimit() * langConfig.WallTimeFactor
+	}
+	return options
+}
+
+func copyFile(srcPath string, dstPath string) error {
+	data, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot read %s", srcPath)
+	}
+	err = ioutil.WriteFile(dstPath, data, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot write %s", dstPath)
+	}
+	return nil
+}
+
+// listFiles returns the regular files in dir and its subdirectories, relative to dir
+func listFiles(dir string) ([]string, error) {
+	names := make([]string, 0)
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(dir, filePath)
+		names = append(names, name)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cannot list %s", dir)
+	}
+	return names, nil
+}
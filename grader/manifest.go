@@ -10,6 +10,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/programming-in-th/grader/api"
@@ -22,11 +23,16 @@ const BASE_SRC_PATH = BASE_TMP_PATH + "/source"
 
 // SingleTestResult denotes the metrics for one single test
 type SingleTestResult struct {
-	Verdict string
-	Score   string
-	Time    int
-	Memory  int
-	Message string
+	Verdict  string
+	Score    string
+	Time     int
+	Memory   int
+	Message  string
+	ExitCode int    // Exit code of the program if it exited by itself
+	Signal   string // Name of the signal that terminated the program, such as SIGSEGV, if any
+	Killed   bool   // Whether the sandbox killed the program for exceeding a limit
+	Stderr   string // End of the program's standard error. Only filled in if the manifest shows it
+	aborted  bool   // The test was cut off by aborting the grading job queue
 }
 
 // SingleGroupResult denotes the metrics for one single group (comprised of many tests)
@@ -41,11 +47,12 @@ type PrefixGroupResult struct {
 	Time         int
 	Memory       int
 	GroupResults []SingleGroupResult
+	TaskVersion  string // Version of the task's data that the result was produced with
 }
 
 /* MANIFEST TYPES */
 
-type indexRange struct {
+type IndexRange struct {
 	Start int
 	End   int
 }
@@ -53,7 +60,7 @@ type indexRange struct {
 type TestGroup struct {
 	FullScore    float64
 	Dependencies []int
-	TestIndices  indexRange
+	TestIndices  IndexRange
 }
 
 type LangRunLimit struct {
@@ -61,9 +68,37 @@ type LangRunLimit struct {
 	MemoryLimit int
 }
 
-// taskManifest is a type binding for the manifest.json stored in each task's directory.
-// This is mainly needed to validate the data in manifest.json
-type taskManifest struct {
+// continuesGroup reports whether the rest of a group is still judged after a test with this result.
+// A presentation error the checker gave points to is left for the grouper to score, like a partially correct output
+func continuesGroup(result SingleTestResult) bool {
+	switch result.Verdict {
+	case conf.ACVerdict, conf.PartialVerdict:
+		return true
+	case conf.PEVerdict:
+		score, err := strconv.ParseFloat(result.Score, 64)
+		return err == nil && score > 0
+	default:
+		return false
+	}
+}
+
+// ExpectedResult is what an author solution must get, either on the whole task or on one group
+type ExpectedResult struct {
+	Score   *float64 // Exact score, if set
+	Verdict string   // If set to "Correct", every test must be correct. Otherwise, at least one test must get this verdict
+}
+
+// AuthorSolution is a solution written by the task's authors, tagged with the result it should get
+type AuthorSolution struct {
+	Path     string // Relative to the task directory
+	Lang     string
+	Expected ExpectedResult
+	Groups   map[int]ExpectedResult // Keyed by group index (starting at 1)
+}
+
+// Manifest is a type binding for the manifest.json stored in each task's directory.
+// Indices in a Manifest are 1-based and inclusive, exactly as they are written on disk
+type Manifest struct {
 	ID            string
 	DefaultLimits *LangRunLimit
 	Limits        map[string]LangRunLimit
@@ -71,24 +106,58 @@ type taskManifest struct {
 	CompileFiles  map[string][]string
 	Checker       string
 	Grouper       string
+	OutputLimit   int  `json:",omitempty"` // Largest file a program may write in MB. Overrides the global output limit if set
+	ShowStderr    bool `json:",omitempty"` // Whether contestants may see the standard error of their programs in results
+
+	Interface *TaskInterface `json:",omitempty"` // Functions that submissions implement, for tasks without whole programs
+
+	NondeterministicScoring bool `json:",omitempty"` // Results may differ between runs of the same code, e.g. with a randomized checker, so they are never cached
+
+	AuthorSolutions []AuthorSolution `json:",omitempty"`
+}
+
+// taskManifest is a Manifest loaded for judging.
+// This is mainly needed to validate the data in manifest.json
+type taskManifest struct {
+	Manifest
 
 	numTests          int
+	version           string // Hash of the task's data, see taskVersion
 	taskBasePath      string
 	inputsBasePath    string
 	solutionsBasePath string
 }
 
-func readManifestFromFile(manifestPath string, config conf.Config) (taskManifest, error) {
+// ReadManifest reads manifest.json as it is stored on disk, without validating it for judging
+func ReadManifest(manifestPath string) (Manifest, error) {
 	manifestFileBytes, err := ioutil.ReadFile(manifestPath)
 	if err != nil {
-		return taskManifest{}, errors.Wrapf(err, "Failed to read manifest.json file at %s", manifestPath)
+		return Manifest{}, errors.Wrapf(err, "Failed to read manifest.json file at %s", manifestPath)
 	}
 
-	var manifestInstance taskManifest
-	err = json.Unmarshal(manifestFileBytes, &manifestInstance)
+	var manifest Manifest
+	err = json.Unmarshal(manifestFileBytes, &manifest)
 	if err != nil {
-		return taskManifest{}, errors.Wrapf(err, "Failed to unmarshal manifest.json from file at %s", manifestPath)
+		return Manifest{}, errors.Wrapf(err, "Failed to unmarshal manifest.json from file at %s", manifestPath)
 	}
+	return manifest, nil
+}
+
+func readManifestFromFile(manifestPath string, config conf.Config) (taskManifest, error) {
+	manifest, err := ReadManifest(manifestPath)
+	if err != nil {
+		return taskManifest{}, err
+	}
+	if len(manifest.Groups) == 0 {
+		return taskManifest{}, errors.Errorf("manifest.json at %s has no groups", manifestPath)
+	}
+	if manifest.Interface != nil {
+		err := manifest.Interface.validate()
+		if err != nil {
+			return taskManifest{}, errors.Wrapf(err, "manifest.json at %s has an invalid interface", manifestPath)
+		}
+	}
+	manifestInstance := taskManifest{Manifest: manifest}
 
 	// Decrease indices for easier handling and round full score
 	for i := 0; i < len(manifestInstance.Groups); i++ {
@@ -105,64 +174,200 @@ func readManifestFromFile(manifestPath string, config conf.Config) (taskManifest
 	manifestInstance.solutionsBasePath = path.Join(manifestInstance.taskBasePath, "solutions")
 	manifestInstance.numTests = manifestInstance.Groups[len(manifestInstance.Groups)-1].TestIndices.End
 
+	manifestInstance.version, err = taskVersion(manifestInstance, config)
+	if err != nil {
+		return taskManifest{}, errors.Wrapf(err, "Failed to compute version of task %s", manifestInstance.ID)
+	}
+	err = recordTaskVersion(manifestInstance.ID, manifestInstance.version, config)
+	if err != nil {
+		log.Println(err) // Results still carry the version
+	}
+
 	return manifestInstance, nil
 }
 
-// GradeSubmission is the method that is called when the web server wants to request a task to be judged
+// WriteManifest writes manifest to manifestPath in the same format that readManifestFromFile expects
+func WriteManifest(manifestPath string, manifest Manifest) error {
+	manifestFileBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal manifest.json")
+	}
+	err = ioutil.WriteFile(manifestPath, append(manifestFileBytes, '\n'), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write manifest.json file at %s", manifestPath)
+	}
+	return nil
+}
+
+// runLimits returns the time limit (in seconds) and memory limit (in KiB) for targLang
+func (manifest Manifest) runLimits(targLang string) (float64, int) {
+	if limits, exists := manifest.Limits[targLang]; exists {
+		return limits.TimeLimit, limits.MemoryLimit * 1024 // Convert to KiB
+	}
+	return manifest.DefaultLimits.TimeLimit, manifest.DefaultLimits.MemoryLimit * 1024
+}
+
+// outputLimit returns the largest file (in KiB) a program may write on this task
+func (manifest Manifest) outputLimit(config conf.Config) int {
+	if manifest.OutputLimit > 0 {
+		return manifest.OutputLimit * 1024
+	}
+	return config.Glob.OutputLimit * 1024
+}
+
+// taskCompileFilePaths returns the arguments for the compile script that add the task's compile files for targLang
+func taskCompileFilePaths(manifest Manifest, taskID string, targLang string, config conf.Config) []string {
+	compileFilePaths := []string{path.Join("-I", config.BasePath, "tasks", taskID, "compileFiles")}
+
+	if _, exists := manifest.CompileFiles[targLang]; exists {
+		for _, compileFile := range manifest.CompileFiles[targLang] {
+			compileFilePaths = append(compileFilePaths, path.Join(config.BasePath, "tasks", taskID, "compileFiles", compileFile))
+		}
+	}
+	return compileFilePaths
+}
+
+// GradeSubmission is the method that is called when the web server wants to request a task to be judged.
+// accepted is when the API accepted the submission, and is stored as the time it was submitted
 func GradeSubmission(submissionID string,
 	taskID string,
 	targLang string,
-	code []string,
+	source api.Source,
+	accepted time.Time,
 	gradingJobChannel chan GradingJob,
 	syncUpdateChannel chan api.SyncUpdate,
 	config conf.Config) error {
 
-	api.SendCompilingMessage(submissionID, syncUpdateChannel)
+	_, err := judgeSubmission(submissionID, taskID, targLang, source, judgeOptions{store: true, submitted: accepted}, gradingJobChannel, syncUpdateChannel, config)
+	return err
+}
 
-	taskBasePath := path.Join(config.BasePath, "tasks")
+// GradeRecoveredSubmission judges a submission again that the grader was judging when it stopped. Its
+// sync updates and stored judging are marked as rejudged after the crash
+func GradeRecoveredSubmission(submissionID string,
+	taskID string,
+	targLang string,
+	source api.Source,
+	accepted time.Time,
+	gradingJobChannel chan GradingJob,
+	syncUpdateChannel chan api.SyncUpdate,
+	config conf.Config) error {
 
-	langConfig := conf.GetLangCompileConfig(config, targLang)
-	if langConfig == nil {
-		api.SendCompilationErrorMessage(submissionID, syncUpdateChannel)
-		return errors.New("Language not supported")
-	}
+	options := judgeOptions{store: true, submitted: accepted, rejudgedAfterCrash: true}
+	_, err := judgeSubmission(submissionID, taskID, targLang, source, options, gradingJobChannel, syncUpdateChannel, config)
+	return err
+}
+
+// judgeOptions change how judgeSubmission judges a submission
+type judgeOptions struct {
+	store              bool      // Keep the submission and its judging in the store, if there is one
+	rejudgeID          string    // Rejudge the judging belongs to, if any
+	ignoreCachedResult bool      // Judge the submission even if its result is cached
+	rejudgedAfterCrash bool      // The grader stopped while judging the submission before
+	submitted          time.Time // When the submission was accepted, if known. Otherwise it is when judging started
+}
 
-	if len(code) == 0 {
-		api.SendCompilationErrorMessage(submissionID, syncUpdateChannel)
-		return errors.New("Code passed in is empty")
+// gradeSubmission judges a submission, sending sync updates along the way, and returns the final result.
+// The result is nil if the submission did not compile
+func gradeSubmission(submissionID string,
+	taskID string,
+	targLang string,
+	source api.Source,
+	gradingJobChannel chan GradingJob,
+	syncUpdateChannel chan api.SyncUpdate,
+	config conf.Config) (*PrefixGroupResult, error) {
+
+	return judgeSubmission(submissionID, taskID, targLang, source, judgeOptions{}, gradingJobChannel, syncUpdateChannel, config)
+}
+
+func judgeSubmission(submissionID string,
+	taskID string,
+	targLang string,
+	source api.Source,
+	options judgeOptions,
+	gradingJobChannel chan GradingJob,
+	syncUpdateChannel chan api.SyncUpdate,
+	config conf.Config) (result *PrefixGroupResult, err error) {
+
+	if options.rejudgedAfterCrash {
+		// Whatever is left of the submission from before the crash is removed first
+		os.RemoveAll(path.Join(BASE_TMP_PATH, submissionID))
+		os.RemoveAll(path.Join(BASE_SRC_PATH, submissionID))
+		var finishUpdates func()
+		syncUpdateChannel, finishUpdates = api.MarkRejudgedAfterCrash(syncUpdateChannel)
+		defer finishUpdates()
 	}
 
-	// Copy source code into tmp directory
-	srcFilePaths := make([]string, len(code))
-	for i := 0; i < len(code); i++ {
-		srcFilePaths[i] = path.Join(BASE_SRC_PATH, submissionID+"_"+strconv.Itoa(i)+"."+langConfig.Extension)
-		err := ioutil.WriteFile(srcFilePaths[i], []byte(code[i]), 0644)
-		if err != nil {
-			api.SendCompilationErrorMessage(submissionID, syncUpdateChannel)
-			return errors.Wrapf(err, "Cannot copy source code into tmp directory: %s", srcFilePaths[i])
+	// Every outcome is stored with the verdict the contestant was told
+	judgedVersion := ""
+	compileVerdict := conf.CEVerdict
+	compiled := compileResult{}
+	compileTime := 0.0
+	if options.store && storeEnabled(config) {
+		started := time.Now()
+		submitted := options.submitted
+		if submitted.IsZero() {
+			submitted = started
 		}
+		defer func() {
+			if err == ErrAborted {
+				return // The submission stays queued, and its judging is stored when it is judged again
+			}
+			judging := Judging{
+				Started:            started,
+				Judged:             time.Now(),
+				TaskVersion:        judgedVersion,
+				Verdict:            compileVerdict,
+				Result:             result,
+				CompileMessage:     compiled.message,
+				CompileTime:        compileTime,
+				RejudgeID:          options.rejudgeID,
+				RejudgedAfterCrash: options.rejudgedAfterCrash,
+			}
+			if result != nil {
+				judging.Verdict = judgingVerdict(*result)
+			}
+			if err != nil {
+				judging.Error = err.Error()
+			}
+			storeErr := storeJudging(StoredSubmission{ID: submissionID, TaskID: taskID, Lang: targLang, Source: source, Submitted: submitted}, judging, config)
+			if storeErr != nil {
+				log.Println(storeErr)
+			}
+		}()
 	}
 
-	// Remove source files after judging
-	defer func() {
-		for _, file := range srcFilePaths {
-			os.Remove(file)
-		}
-	}()
+	// Failures of the grader or the task give the submission "Judge Error" and alert operators
+	judgeError := func(err error) (*PrefixGroupResult, error) {
+		judgeErr := &JudgeError{SubmissionID: submissionID, TaskID: taskID, Err: err}
+		reportJudgeError(judgeErr, config)
+		compileVerdict = conf.IEVerdict
+		api.SendJudgeErrorMessage(submissionID, judgedVersion, syncUpdateChannel)
+		return nil, judgeErr
+	}
+
+	api.SendCompilingMessage(submissionID, "", syncUpdateChannel)
+
+	taskBasePath := path.Join(config.BasePath, "tasks")
+
+	langConfig := conf.GetLangCompileConfig(config, targLang)
+	if langConfig == nil {
+		api.SendCompilationErrorMessage(submissionID, "", syncUpdateChannel)
+		return nil, errors.New("Language not supported")
+	}
 
 	// Locate manifest file and read it
 	manifestPath := path.Join(taskBasePath, taskID, "manifest.json")
 	manifestInstance, err := readManifestFromFile(manifestPath, config)
 	if err != nil {
-		api.SendCompilationErrorMessage(submissionID, syncUpdateChannel)
-		return errors.Wrap(err, "Error reading manifest file")
+		return judgeError(errors.Wrap(err, "Error reading manifest file"))
 	}
+	judgedVersion = manifestInstance.version
 
 	// Create tmp directory for submission
 	err = util.CreateDirIfNotExist(path.Join(BASE_TMP_PATH, submissionID))
 	if err != nil {
-		api.SendCompilationErrorMessage(submissionID, syncUpdateChannel)
-		return errors.Wrap(err, "Error creating working tmp folder")
+		return judgeError(errors.Wrap(err, "Error creating working tmp folder"))
 	}
 
 	// Check if target language is supported
@@ -179,28 +384,65 @@ func GradeSubmission(submissionID string,
 		}
 	}
 	if !langSupportContainsTargLang {
-		api.SendCompilationErrorMessage(submissionID, syncUpdateChannel)
-		return errors.New("Language not supported")
+		api.SendCompilationErrorMessage(submissionID, manifestInstance.version, syncUpdateChannel)
+		return nil, errors.New("Language not supported")
 	}
 
-	// Add compileFiles path to srcFilePaths
-	compileFilePaths := []string{path.Join("-I", config.BasePath, "tasks", taskID, "compileFiles")}
+	// Write source code into its own directory, with the names it was submitted with
+	srcDir := path.Join(BASE_SRC_PATH, submissionID)
+	defer os.RemoveAll(srcDir)
+	srcNames, err := prepareSource(source, srcDir, manifestInstance.Manifest, *langConfig, config)
+	if err != nil {
+		api.SendCompilationErrorMessage(submissionID, manifestInstance.version, syncUpdateChannel)
+		return nil, errors.Wrap(err, "Invalid source code")
+	}
 
-	// Add compile files to srcFilePaths after defer statement so it doesn't delete
-	if _, exists := manifestInstance.CompileFiles[targLang]; exists {
-		for _, compileFile := range manifestInstance.CompileFiles[targLang] {
-			compileFilePaths = append(compileFilePaths, path.Join(config.BasePath, "tasks", taskID, "compileFiles", compileFile))
+	compileFilePaths := taskCompileFilePaths(manifestInstance.Manifest, taskID, targLang, config)
+
+	// Identical code on unchanged task data gets the result it got before, without being compiled or run again
+	resultCacheKey := ""
+	if cacheEnabled(config) && !manifestInstance.NondeterministicScoring && !options.ignoreCachedResult {
+		srcHash, err := sourceHash(*langConfig, srcDir, srcNames, compileFilePaths, config)
+		if err == nil {
+			resultCacheKey, err = resultKey(srcHash, manifestInstance, config)
+		}
+		if err != nil {
+			log.Println(errors.Wrapf(err, "Cannot look up result of submission %s in the cache", submissionID))
+		} else if cached := getCachedResult(resultCacheKey, config); cached != nil {
+			os.RemoveAll(path.Join(BASE_TMP_PATH, submissionID))
+			api.SendPrefixGroupResult(submissionID, manifestInstance.version, *cached, syncUpdateChannel)
+			api.SendJudgingCompleteMessage(submissionID, manifestInstance.version, syncUpdateChannel)
+			return cached, nil
 		}
 	}
 
-	// Compile program and return CE if fail
+	// Compile program on one of the workers and return CE if fail
 	// TODO: Handle other languages that don't need compiling
-	// TODO: Compile fails without absolute paths
-	compileSuccessful, userBinPath := compileSubmission(submissionID, taskID, targLang, srcFilePaths, compileFilePaths, config)
-	if !compileSuccessful {
-		api.SendCompilationErrorMessage(submissionID, syncUpdateChannel)
-		return nil
+	compileResultChannel := make(chan compileResult)
+	compileStarted := time.Now()
+	gradingJobChannel <- GradingJob{
+		submissionID: submissionID,
+		targLang:     targLang,
+		compile:      &compileJob{taskID, srcDir, srcNames, compileFilePaths, compileResultChannel},
+	}
+	compiled = <-compileResultChannel
+	compileTime = time.Since(compileStarted).Seconds()
+	if compiled.aborted {
+		return nil, ErrAborted
 	}
+	switch compiled.verdict {
+	case "":
+	case conf.CTLEVerdict:
+		compileVerdict = conf.CTLEVerdict
+		api.SendCompilationTimeLimitExceededMessage(submissionID, manifestInstance.version, syncUpdateChannel)
+		return nil, nil
+	case conf.IEVerdict:
+		return judgeError(errors.Wrap(compiled.err, "Error compiling submission"))
+	default:
+		api.SendCompilationErrorMessage(submissionID, manifestInstance.version, syncUpdateChannel)
+		return nil, nil
+	}
+	userBinPath := compiled.binPath
 
 	// Remove user output file to not clutter up disk
 	defer func() {
@@ -234,7 +476,7 @@ func GradeSubmission(submissionID string,
 		if foundInvalid {
 			currGroupResult.Score = 0
 			for j := 0; j < numTests; j++ {
-				currGroupResult.Status = append(currGroupResult.Status, SingleTestResult{conf.SKVerdict, "0", 0, 0, ""})
+				currGroupResult.Status[j] = SingleTestResult{Verdict: conf.SKVerdict, Score: "0"}
 			}
 			groupResults = append(groupResults, currGroupResult)
 			continue
@@ -245,16 +487,19 @@ func GradeSubmission(submissionID string,
 		willSkip := false
 		for testIndex := manifestInstance.Groups[i].TestIndices.Start; testIndex < manifestInstance.Groups[i].TestIndices.End; testIndex++ {
 			if !willSkip {
-				gradingJobChannel <- GradingJob{manifestInstance, submissionID, targLang, userBinPath, testIndex, resultChannel}
+				gradingJobChannel <- GradingJob{manifestInstance, submissionID, targLang, userBinPath, testIndex, resultChannel, nil}
 				currResult := <-resultChannel
+				if currResult.aborted {
+					return nil, ErrAborted
+				}
 				currGroupResult.Status[testIndex-manifestInstance.Groups[i].TestIndices.Start] = currResult
-				api.SendJudgedTestMessage(submissionID, testIndex, syncUpdateChannel)
-				if currResult.Verdict != conf.ACVerdict && currResult.Verdict != conf.PartialVerdict {
+				api.SendJudgedTestMessage(submissionID, manifestInstance.version, testIndex, syncUpdateChannel)
+				if !continuesGroup(currResult) {
 					willSkip = true
 				}
 			} else {
-				currGroupResult.Status[testIndex-manifestInstance.Groups[i].TestIndices.Start] = SingleTestResult{conf.SKVerdict, "0", 0, 0, ""}
-				api.SendJudgedTestMessage(submissionID, testIndex, syncUpdateChannel)
+				currGroupResult.Status[testIndex-manifestInstance.Groups[i].TestIndices.Start] = SingleTestResult{Verdict: conf.SKVerdict, Score: "0"}
+				api.SendJudgedTestMessage(submissionID, manifestInstance.version, testIndex, syncUpdateChannel)
 			}
 		}
 
@@ -274,13 +519,13 @@ func GradeSubmission(submissionID string,
 			strconv.Itoa(manifestInstance.Groups[i].TestIndices.End)).Output()
 
 		if err != nil {
-			log.Print(errors.Wrapf(err, "Grouper failed for task %s on submission ID %s", manifestInstance.ID, submissionID))
+			reportJudgeError(&JudgeError{SubmissionID: submissionID, TaskID: manifestInstance.ID, Err: errors.Wrapf(err, "Grouper failed on group %d", i+1)}, config)
 			allGroupsGroupedSucessfully = false
 			grouperOutput = []byte("0") // fall through
 		}
 		score, err := strconv.ParseFloat(strings.TrimSpace(string(grouperOutput)), 64)
 		if err != nil {
-			log.Print(errors.Wrapf(err, "Grouper failed for task %s on submission ID %s", manifestInstance.ID, submissionID))
+			reportJudgeError(&JudgeError{SubmissionID: submissionID, TaskID: manifestInstance.ID, Err: errors.Wrapf(err, "Grouper output of group %d is invalid", i+1)}, config)
 			allGroupsGroupedSucessfully = false
 			score = 0
 		}
@@ -309,11 +554,18 @@ func GradeSubmission(submissionID string,
 		currGroupResult.Score = math.Round(score*100) / 100 // CAREFUL: round of AFTER adding to running score
 		groupResults = append(groupResults, currGroupResult)
 
-		currPrefixGroupResult := PrefixGroupResult{math.Round(runningScore), runningTime, runningMemory, groupResults}
-		api.SendPrefixGroupResult(submissionID, currPrefixGroupResult, syncUpdateChannel)
+		currPrefixGroupResult := PrefixGroupResult{math.Round(runningScore), runningTime, runningMemory, groupResults, manifestInstance.version}
+		api.SendPrefixGroupResult(submissionID, manifestInstance.version, currPrefixGroupResult, syncUpdateChannel)
 	}
 
-	api.SendJudgingCompleteMessage(submissionID, syncUpdateChannel)
+	api.SendJudgingCompleteMessage(submissionID, manifestInstance.version, syncUpdateChannel)
 
-	return nil
+	finalResult := PrefixGroupResult{math.Round(runningScore), runningTime, runningMemory, groupResults, manifestInstance.version}
+	if resultCacheKey != "" && allGroupsGroupedSucessfully {
+		err := putCachedResult(resultCacheKey, finalResult, config)
+		if err != nil {
+			log.Println(errors.Wrapf(err, "Cannot cache result of submission %s", submissionID))
+		}
+	}
+	return &finalResult, nil
 }
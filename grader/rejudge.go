@@ -0,0 +1,241 @@
+package grader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/api"
+	"github.com/programming-in-th/grader/conf"
+)
+
+// rejudgeReportsDir is the directory in the store that the reports of rejudges are written to
+const rejudgeReportsDir = "rejudges"
+
+// RejudgeReport lists every submission whose result changed in a rejudge
+type RejudgeReport struct {
+	ID       string
+	Request  api.RejudgeRequest
+	Started  time.Time
+	Finished time.Time
+	Rejudged int             // Number of submissions judged again, not counting those in Errors
+	Changes  []RejudgeChange // In the order the submissions were submitted
+	Errors   []string        // Submissions the grader could not judge again, and why
+}
+
+// RejudgeChange is how the result of a submission changed in a rejudge
+type RejudgeChange struct {
+	SubmissionID   string
+	TaskID         string
+	OldVerdict     string
+	NewVerdict     string
+	OldScore       float64
+	NewScore       float64
+	OldTaskVersion string       `json:",omitempty"`
+	NewTaskVersion string       `json:",omitempty"`
+	Tests          []TestChange // Tests whose verdict or score changed
+}
+
+// TestChange is how the result of one test changed in a rejudge. A test that only exists in one of the
+// results has an empty verdict and score in the other
+type TestChange struct {
+	Group      int // Index of the group, starting at 1
+	Test       int // Position of the test in its group, starting at 1
+	OldVerdict string
+	NewVerdict string
+	OldScore   string
+	NewScore   string
+}
+
+// rejudgeQuery is the query for the stored submissions selected by a rejudge request
+func rejudgeQuery(request api.RejudgeRequest) api.SubmissionQuery {
+	return api.SubmissionQuery{
+		SubmissionIDs: request.SubmissionIDs,
+		TaskIDs:       request.TaskIDs,
+		Langs:         request.Langs,
+		Verdict:       request.Verdict,
+		Since:         request.Since,
+		Until:         request.Until,
+	}
+}
+
+// judgingScore is the score of a judging, which is 0 if the submission was not judged on the tests
+func judgingScore(judging Judging) float64 {
+	if judging.Result == nil {
+		return 0
+	}
+	return judging.Result.Score
+}
+
+// diffJudgings describes how a judging changed into another. It returns nil if nothing changed
+func diffJudgings(submission StoredSubmission, oldJudging Judging, newJudging Judging) *RejudgeChange {
+	change := RejudgeChange{
+		SubmissionID:   submission.ID,
+		TaskID:         submission.TaskID,
+		OldVerdict:     oldJudging.Verdict,
+		NewVerdict:     newJudging.Verdict,
+		OldScore:       judgingScore(oldJudging),
+		NewScore:       judgingScore(newJudging),
+		OldTaskVersion: oldJudging.TaskVersion,
+		NewTaskVersion: newJudging.TaskVersion,
+		Tests:          make([]TestChange, 0),
+	}
+	groups := func(judging Judging) []SingleGroupResult {
+		if judging.Result == nil {
+			return nil
+		}
+		return judging.Result.GroupResults
+	}
+	oldGroups, newGroups := groups(oldJudging), groups(newJudging)
+	for i := 0; i < len(oldGroups) || i < len(newGroups); i++ {
+		var oldTests, newTests []SingleTestResult
+		if i < len(oldGroups) {
+			oldTests = oldGroups[i].Status
+		}
+		if i < len(newGroups) {
+			newTests = newGroups[i].Status
+		}
+		for j := 0; j < len(oldTests) || j < len(newTests); j++ {
+			testChange := TestChange{Group: i + 1, Test: j + 1}
+			if j < len(oldTests) {
+				testChange.OldVerdict, testChange.OldScore = oldTests[j].Verdict, oldTests[j].Score
+			}
+			if j < len(newTests) {
+				testChange.NewVerdict, testChange.NewScore = newTests[j].Verdict, newTests[j].Score
+			}
+			if testChange.OldVerdict != testChange.NewVerdict || testChange.OldScore != testChange.NewScore {
+				change.Tests = append(change.Tests, testChange)
+			}
+		}
+	}
+	if change.OldVerdict == change.NewVerdict && math.Abs(change.OldScore-change.NewScore) < 0.005 && len(change.Tests) == 0 {
+		return nil
+	}
+	return &change
+}
+
+// Rejudge judges the stored submissions selected by request again on gradingJobChannel, up to workers at a
+// time, and reports every verdict and score that changed. Rejudged submissions are judged from scratch,
+// without cached results, and their results are stored and sent to the sync client like any other.
+// The report is written to the store, and sent to the sync client if request has a channel
+func Rejudge(request api.RejudgeRequest, gradingJobChannel chan GradingJob, workers int, config conf.Config) (RejudgeReport, error) {
+	if !storeEnabled(config) {
+		return RejudgeReport{}, errors.New("Cannot rejudge without a store")
+	}
+	if request.ID == "" {
+		request.ID = "rejudge_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	report := RejudgeReport{ID: request.ID, Request: request, Started: time.Now(), Changes: make([]RejudgeChange, 0), Errors: make([]string, 0)}
+
+	selected, err := QueryStoredSubmissions(rejudgeQuery(request), config)
+	if err != nil {
+		return report, err
+	}
+
+	syncUpdateChannel := request.SyncUpdateChannel
+	if syncUpdateChannel == nil {
+		syncUpdateChannel = make(chan api.SyncUpdate)
+		defer close(syncUpdateChannel)
+		go func() {
+			for range syncUpdateChannel {
+			}
+		}()
+	}
+
+	// Every submission is judged by one of the workers, and its change or error is kept in its place
+	changes := make([]*RejudgeChange, len(selected))
+	judgeErrors := make([]error, len(selected))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	if workers < 1 {
+		workers = 1
+	}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				submission := selected[index]
+				_, err := judgeSubmission(submission.ID, submission.TaskID, submission.Lang, submission.Source,
+					judgeOptions{store: true, rejudgeID: request.ID, ignoreCachedResult: true},
+					gradingJobChannel, syncUpdateChannel, config)
+				if err != nil {
+					judgeErrors[index] = err
+					continue
+				}
+				rejudged, err := ReadStoredSubmission(submission.ID, config)
+				if err != nil {
+					judgeErrors[index] = err
+					continue
+				}
+				old := submission.latestJudging()
+				if old == nil {
+					continue // Nothing to compare against
+				}
+				changes[index] = diffJudgings(submission, *old, *rejudged.latestJudging())
+			}
+		}()
+	}
+	for index := range selected {
+		indices <- index
+	}
+	close(indices)
+	wg.Wait()
+
+	for index := range selected {
+		if judgeErrors[index] != nil {
+			report.Errors = append(report.Errors, selected[index].ID+": "+judgeErrors[index].Error())
+			continue
+		}
+		report.Rejudged++
+		if changes[index] != nil {
+			report.Changes = append(report.Changes, *changes[index])
+		}
+	}
+	report.Finished = time.Now()
+
+	err = writeRejudgeReport(report, config)
+	if request.SyncUpdateChannel != nil {
+		api.SendRejudgeReport(request.ID, report, request.SyncUpdateChannel)
+	}
+	return report, err
+}
+
+// writeRejudgeReport writes the report of a rejudge to the store
+func writeRejudgeReport(report RejudgeReport, config conf.Config) error {
+	reportBytes, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal rejudge report")
+	}
+	reportsPath := path.Join(config.Glob.StorePath, rejudgeReportsDir)
+	err = os.MkdirAll(reportsPath, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create rejudge report directory")
+	}
+	err = ioutil.WriteFile(path.Join(reportsPath, report.ID+".json"), append(reportBytes, '\n'), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write rejudge report %s", report.ID)
+	}
+	return nil
+}
+
+// ReadRejudgeReport reads the report of a finished rejudge from the store
+func ReadRejudgeReport(rejudgeID string, config conf.Config) (RejudgeReport, error) {
+	reportPath := path.Join(config.Glob.StorePath, rejudgeReportsDir, rejudgeID+".json")
+	reportBytes, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		return RejudgeReport{}, errors.Wrapf(err, "Failed to read rejudge report %s", rejudgeID)
+	}
+	var report RejudgeReport
+	err = json.Unmarshal(reportBytes, &report)
+	if err != nil {
+		return RejudgeReport{}, errors.Wrapf(err, "Failed to unmarshal rejudge report %s", rejudgeID)
+	}
+	return report, nil
+}
@@ -0,0 +1,136 @@
+package grader
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/programming-in-th/grader/api"
+	"github.com/programming-in-th/grader/conf"
+)
+
+func TestRejudgeQuery(t *testing.T) {
+	submitted := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	submission := StoredSubmission{ID: "42", TaskID: "a_time_b", Lang: "cpp14", Submitted: submitted,
+		Judgings: []Judging{{Verdict: conf.WAVerdict}, {Verdict: conf.ACVerdict}}}
+	tests := []struct {
+		name     string
+		request  api.RejudgeRequest
+		expected bool
+	}{
+		{"Everything", api.RejudgeRequest{}, true},
+		{"Task", api.RejudgeRequest{TaskIDs: []string{"other", "a_time_b"}}, true},
+		{"Other task", api.RejudgeRequest{TaskIDs: []string{"other"}}, false},
+		{"Other language", api.RejudgeRequest{Langs: []string{"python3"}}, false},
+		{"Other submission", api.RejudgeRequest{SubmissionIDs: []string{"43"}}, false},
+		{"Latest verdict", api.RejudgeRequest{Verdict: conf.ACVerdict}, true},
+		{"Earlier verdict", api.RejudgeRequest{Verdict: conf.WAVerdict}, false},
+		{"Since", api.RejudgeRequest{Since: submitted}, true},
+		{"Until", api.RejudgeRequest{Until: submitted}, false},
+		{"Contest", api.RejudgeRequest{Since: submitted.Add(-time.Hour), Until: submitted.Add(time.Hour), Verdict: conf.ACVerdict}, true},
+	}
+	for _, test := range tests {
+		if got := submissionMatches(rejudgeQuery(test.request), submission); got != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestRejudge(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	gc.Glob.StorePath = path.Join(gc.BasePath, "store")
+
+	done := make(chan bool)
+	jobQueue := NewGradingJobQueue(1, done, gc)
+	defer func() {
+		done <- true
+	}()
+	ch := make(chan api.SyncUpdate)
+	defer close(ch)
+	go func() {
+		for range ch {
+		}
+	}()
+	submissions := map[string]string{
+		"test_rejudge_correct": correctSolution,
+		"test_rejudge_wrong":   "#include <iostream>\nint main() { long long a, b; std::cin >> a >> b; std::cout << a + b << std::endl; }\n",
+		"test_rejudge_ce":      "int main() {",
+	}
+	for _, submissionID := range []string{"test_rejudge_correct", "test_rejudge_wrong", "test_rejudge_ce"} {
+		err := GradeSubmission(submissionID, exampleTaskID, "cpp14", api.Source{Code: []string{submissions[submissionID]}}, time.Now(), jobQueue, ch, gc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for submissionID, verdict := range map[string]string{"test_rejudge_correct": conf.ACVerdict, "test_rejudge_wrong": conf.WAVerdict, "test_rejudge_ce": conf.CEVerdict} {
+		submission, err := ReadStoredSubmission(submissionID, gc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(submission.Judgings) != 1 || submission.Judgings[0].Verdict != verdict {
+			t.Errorf("%s: got judgings %+v, expected one with verdict %s", submissionID, submission.Judgings, verdict)
+		}
+	}
+
+	// Fix the first test, which the correct submission then fails
+	err := ioutil.WriteFile(path.Join(gc.BasePath, "tasks", exampleTaskID, "solutions", "1.sol"), []byte("11\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := Rejudge(api.RejudgeRequest{TaskIDs: []string{exampleTaskID}, Verdict: conf.ACVerdict}, jobQueue, 2, gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rejudged != 1 || len(report.Errors) != 0 || len(report.Changes) != 1 {
+		t.Fatalf("Got report %+v, expected one change", report)
+	}
+	change := report.Changes[0]
+	if change.SubmissionID != "test_rejudge_correct" || change.OldVerdict != conf.ACVerdict || change.NewVerdict != conf.WAVerdict ||
+		change.OldScore != 100 || change.NewScore != 0 || change.OldTaskVersion == change.NewTaskVersion {
+		t.Errorf("Got change %+v", change)
+	}
+	// The first test is wrong, and the rest of the first group and the second group are skipped
+	if len(change.Tests) != 10 || change.Tests[0].NewVerdict != conf.WAVerdict || change.Tests[9].NewVerdict != conf.SKVerdict {
+		t.Errorf("Got test changes %+v", change.Tests)
+	}
+
+	stored, err := ReadRejudgeReport(report.ID, gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Changes) != 1 {
+		t.Errorf("Stored report has %d changes, expected 1", len(stored.Changes))
+	}
+	submission, err := ReadStoredSubmission("test_rejudge_correct", gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(submission.Judgings) != 2 || submission.Judgings[1].RejudgeID != report.ID {
+		t.Errorf("Got judgings %+v, expected the rejudge to be stored", submission.Judgings)
+	}
+
+	// Nothing changes when the submissions are rejudged again
+	report, err = Rejudge(api.RejudgeRequest{}, jobQueue, 2, gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rejudged != 3 || len(report.Changes) != 0 || len(report.Errors) != 0 {
+		t.Errorf("Got report %+v, expected three submissions without changes", report)
+	}
+
+	// Submissions that cannot be judged again are reported as errors, and not counted as rejudged
+	err = writeStoredSubmission(StoredSubmission{ID: "test_rejudge_missing", TaskID: "missing", Lang: "cpp14",
+		Source: api.Source{Code: []string{correctSolution}}, Submitted: time.Now(), Judgings: []Judging{}}, gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = Rejudge(api.RejudgeRequest{}, jobQueue, 2, gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rejudged != 3 || len(report.Errors) != 1 {
+		t.Errorf("Got report %+v, expected three submissions rejudged and one error", report)
+	}
+}
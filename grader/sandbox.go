@@ -0,0 +1,170 @@
+package grader
+
+import (
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/fakebox"
+	"github.com/programming-in-th/grader/isolate"
+	"github.com/programming-in-th/grader/nativebox"
+)
+
+// Sandbox is a box that untrusted programs are run in, from initialization to cleanup
+type Sandbox interface {
+	// Init creates an empty box. A box must be cleaned up before it can be initialized again
+	Init() error
+	// CopyIn copies the file at srcPath into the box as name. Directories in name are created
+	CopyIn(srcPath string, name string) error
+	// Run runs command inside the box with the given limits and reports its verdict and usage
+	Run(options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics)
+	// CopyOut copies the file name out of the box to dstPath
+	CopyOut(name string, dstPath string) error
+	// Reset empties the box so it can be used for another run
+	Reset() error
+	// Cleanup destroys the box
+	Cleanup() error
+}
+
+// sandboxBackends maps each backend name accepted in the Sandbox field of the global configuration
+// to a function creating the box with the given ID
+var sandboxBackends = map[string]func(boxID int, config conf.Config) Sandbox{
+	"isolate": func(boxID int, config conf.Config) Sandbox {
+		return isolate.NewInstance(config.Glob.IsolateBinPath, boxID, "/tmp/tmp_isolate_grader_"+strconv.Itoa(boxID), boxQuota(config))
+	},
+	"fake": func(boxID int, config conf.Config) Sandbox {
+		return fakebox.New(boxID)
+	},
+	"native": func(boxID int, config conf.Config) Sandbox {
+		return nativebox.New(boxID, config.Glob.CgroupPath, boxQuota(config))
+	},
+}
+
+// boxQuota returns the quota of every box set in the global configuration. Boxes have no quota without a disk quota
+func boxQuota(config conf.Config) isolate.Quota {
+	if config.Glob.DiskQuota <= 0 {
+		return isolate.Quota{}
+	}
+	return isolate.Quota{Blocks: config.Glob.DiskQuota * 1024, Inodes: config.Glob.FileQuota}
+}
+
+// sandboxBackend returns the name of the backend chosen in the global configuration. isolate is used if
+// none is chosen
+func sandboxBackend(config conf.Config) string {
+	if config.Glob.Sandbox == "" {
+		return "isolate"
+	}
+	return config.Glob.Sandbox
+}
+
+// CheckSandbox fails if the backend chosen in the global configuration does not exist, or is the fake
+// backend without AllowFakeSandbox
+func CheckSandbox(config conf.Config) error {
+	backend := sandboxBackend(config)
+	if _, exists := sandboxBackends[backend]; !exists {
+		return errors.Errorf("Unknown sandbox backend %s", backend)
+	}
+	if backend == "fake" && !config.Glob.AllowFakeSandbox {
+		return errors.New("The fake sandbox backend does not confine programs, and is only used with AllowFakeSandbox")
+	}
+	return nil
+}
+
+// newSandbox creates the box with the given ID using the backend chosen in the global configuration
+func newSandbox(boxID int, config conf.Config) (Sandbox, error) {
+	err := CheckSandbox(config)
+	if err != nil {
+		return nil, err
+	}
+	return sandboxBackends[sandboxBackend(config)](boxID, config), nil
+}
+
+type sandboxTestResult struct {
+	verdict isolate.RunVerdict
+	metrics isolate.RunMetrics
+	err     error
+}
+
+// WaitGroup should be started outside of this.
+// The binary is run with the run command of targLang, or with its runner script if it has none
+func runInSandbox(
+	userBinPath string,
+	timeLimit float64,
+	memoryLimit int,
+	outputLimit int,
+	inputPath string,
+	outputPath string,
+	stderrPath string,
+	targLang string,
+	pool *boxPool,
+) sandboxTestResult {
+	langConfig := conf.GetLangCompileConfig(pool.config, targLang)
+	if langConfig == nil {
+		return sandboxTestResult{verdict: isolate.IsolateRunOther, err: errors.Errorf("Language %s is not configured", targLang)}
+	}
+	entry, err := pool.get()
+	if err != nil {
+		return sandboxTestResult{verdict: isolate.IsolateRunOther, err: err}
+	}
+	box := entry.box
+
+	result := func() sandboxTestResult {
+		// Copy input, executable and runner script into the box. Interpreted programs need all of their source files
+		files := [][2]string{{inputPath, "input"}}
+		if !langConfig.Interpreted {
+			files = append(files, [2]string{userBinPath, filepath.Base(userBinPath)})
+		} else {
+			programFiles, err := listFiles(filepath.Dir(userBinPath))
+			if err != nil {
+				return sandboxTestResult{verdict: isolate.IsolateRunOther, err: err}
+			}
+			for _, name := range programFiles {
+				files = append(files, [2]string{path.Join(filepath.Dir(userBinPath), name), name})
+			}
+		}
+		command := expandCommand(langConfig.RunCommands, nil, filepath.Base(userBinPath))
+		if len(langConfig.RunCommands) == 0 {
+			files = append(files, [2]string{path.Join(pool.config.BasePath, "config", "runnerScripts", targLang), targLang})
+			command = []string{targLang}
+		}
+		for _, file := range files {
+			err := box.CopyIn(file[0], file[1])
+			if err != nil {
+				return sandboxTestResult{verdict: isolate.IsolateRunOther, err: err}
+			}
+		}
+
+		verdict, metrics := box.Run(langRunOptions(isolate.RunOptions{
+			TimeLimit:   timeLimit,
+			ExtraTime:   timeLimit + 1,
+			MemoryLimit: memoryLimit,
+			OutputLimit: outputLimit,
+			Stdin:       "input",
+			Stdout:      "output",
+			Stderr:      "stderr",
+		}, *langConfig), command)
+		if verdict == isolate.IsolateRunXX || verdict == isolate.IsolateRunOther {
+			return sandboxTestResult{verdict, metrics, nil}
+		}
+
+		// Standard error is kept whether or not the program succeeded. It is only used to explain results,
+		// so a box that has none does not fail the run
+		box.CopyOut("stderr", stderrPath)
+		if verdict != isolate.IsolateRunOK {
+			return sandboxTestResult{verdict, metrics, nil}
+		}
+
+		// IMPORTANT: copy output out of the box
+		err := box.CopyOut("output", outputPath)
+		if err != nil {
+			return sandboxTestResult{verdict: isolate.IsolateRunOther, err: err}
+		}
+		return sandboxTestResult{verdict, metrics, nil}
+	}()
+
+	// A box the sandbox itself failed in is rebuilt before it is used again
+	pool.put(entry, result.verdict == isolate.IsolateRunXX || result.verdict == isolate.IsolateRunOther)
+	return result
+}
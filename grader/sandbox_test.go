@@ -0,0 +1,32 @@
+package grader
+
+import (
+	"testing"
+
+	"github.com/programming-in-th/grader/conf"
+)
+
+func TestCheckSandbox(t *testing.T) {
+	tests := []struct {
+		name  string
+		glob  conf.GlobalConfiguration
+		valid bool
+	}{
+		{"Default", conf.GlobalConfiguration{}, true},
+		{"Native", conf.GlobalConfiguration{Sandbox: "native"}, true},
+		{"Unknown", conf.GlobalConfiguration{Sandbox: "missing"}, false},
+		{"Fake", conf.GlobalConfiguration{Sandbox: "fake"}, false},
+		{"Fake allowed", conf.GlobalConfiguration{Sandbox: "fake", AllowFakeSandbox: true}, true},
+	}
+	for _, test := range tests {
+		err := CheckSandbox(conf.Config{Glob: test.glob})
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+
+	// Boxes are not created with a backend that is refused
+	if _, err := newSandbox(0, conf.Config{Glob: conf.GlobalConfiguration{Sandbox: "fake"}}); err == nil {
+		t.Error("Created a fake box without AllowFakeSandbox")
+	}
+}
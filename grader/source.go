@@ -0,0 +1,273 @@
+package grader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/api"
+	"github.com/programming-in-th/grader/conf"
+)
+
+// maxSourceFiles is the largest number of files a submission may have
+const maxSourceFiles = 100
+
+// prepareSource writes the source files of a submission into srcDir, together with the stubs of the task's
+// interface if it has one, and returns their names with the entry point first
+func prepareSource(source api.Source, srcDir string, manifest Manifest, langConfig conf.LangConfiguration, config conf.Config) ([]string, error) {
+	if manifest.Interface == nil {
+		return writeSource(source, srcDir, langConfig, config)
+	}
+	stubs, solutionName, err := manifest.Interface.stubs(langConfig)
+	if err != nil {
+		return nil, err
+	}
+	// The stub is the program, and the submission only one of its files
+	langConfig.EntryPoint = solutionName
+	names, err := writeSource(source, srcDir, langConfig, config)
+	if err != nil {
+		return nil, err
+	}
+	stubNames := make([]string, len(stubs))
+	for i, stub := range stubs {
+		for _, name := range names {
+			if name == stub.Name {
+				return nil, errors.Errorf("File name %s is used by the task", name)
+			}
+		}
+		err := ioutil.WriteFile(path.Join(srcDir, stub.Name), []byte(stub.Content), 0644)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Cannot write %s", stub.Name)
+		}
+		stubNames[i] = stub.Name
+	}
+	return append(stubNames, names...), nil
+}
+
+// readAuthorSolution reads an author solution of a task as a submission
+func readAuthorSolution(taskID string, solutionPath string, config conf.Config) (api.Source, error) {
+	code, err := ioutil.ReadFile(path.Join(config.BasePath, "tasks", taskID, solutionPath))
+	if err != nil {
+		return api.Source{}, errors.Wrapf(err, "Cannot read author solution %s", solutionPath)
+	}
+	return api.Source{Files: []api.SourceFile{{Name: path.Base(solutionPath), Content: string(code)}}}, nil
+}
+
+// prepareAuthorSolution writes an author solution into the source directory of submissionID as prepareSource
+// does, for commands that compile it themselves. It returns the source directory and the names of the files
+func prepareAuthorSolution(manifest Manifest, taskID string, submissionID string, targLang string, solutionPath string, config conf.Config) (string, []string, error) {
+	langConfig := conf.GetLangCompileConfig(config, targLang)
+	if langConfig == nil {
+		return "", nil, errors.Errorf("Language %s is not configured", targLang)
+	}
+	source, err := readAuthorSolution(taskID, solutionPath, config)
+	if err != nil {
+		return "", nil, err
+	}
+	srcDir := path.Join(BASE_SRC_PATH, submissionID)
+	os.RemoveAll(srcDir) // Left behind by an earlier run that crashed
+	srcNames, err := prepareSource(source, srcDir, manifest, *langConfig, config)
+	if err != nil {
+		os.RemoveAll(srcDir)
+		return "", nil, errors.Wrapf(err, "Cannot prepare author solution %s", solutionPath)
+	}
+	return srcDir, srcNames, nil
+}
+
+// writeSource writes the source files of a submission into dir, keeping their names and directories, and
+// returns their names with the entry point first. Every error is caused by the submission itself
+func writeSource(source api.Source, dir string, langConfig conf.LangConfiguration, config conf.Config) ([]string, error) {
+	sizeLimit := int64(config.Glob.SourceSizeLimit) * 1024
+	var files []api.SourceFile
+	switch {
+	case len(source.Archive) > 0:
+		var err error
+		files, err = unpackArchive(source.Archive, sizeLimit)
+		if err != nil {
+			return nil, err
+		}
+		files = stripTopDirectory(files)
+	case len(source.Files) > 0:
+		files = source.Files
+	default:
+		files = codeFiles(source.Code, langConfig)
+	}
+	if len(files) == 0 {
+		return nil, errors.New("Submission has no source files")
+	}
+	if len(files) > maxSourceFiles {
+		return nil, errors.Errorf("Submission has more than %d source files", maxSourceFiles)
+	}
+
+	names := make([]string, 0, len(files))
+	written := make(map[string]bool)
+	size := int64(0)
+	for _, file := range files {
+		name, err := cleanSourceName(file.Name)
+		if err != nil {
+			return nil, err
+		}
+		if written[name] {
+			return nil, errors.Errorf("Submission has two files named %s", name)
+		}
+		size += int64(len(file.Content))
+		if size > sizeLimit {
+			return nil, errors.Errorf("Submission is larger than %d KB", config.Glob.SourceSizeLimit)
+		}
+		err = os.MkdirAll(path.Dir(path.Join(dir, name)), 0755)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Cannot create directory for %s", name)
+		}
+		err = ioutil.WriteFile(path.Join(dir, name), []byte(file.Content), 0644)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Cannot write %s", name)
+		}
+		written[name] = true
+		names = append(names, name)
+	}
+	return entryPointFirst(names, langConfig)
+}
+
+// codeFiles names the unnamed source files of a submission. The first file is the entry point
+func codeFiles(code []string, langConfig conf.LangConfiguration) []api.SourceFile {
+	files := make([]api.SourceFile, len(code))
+	for i := range code {
+		files[i] = api.SourceFile{Name: "source_" + strconv.Itoa(i) + "." + langConfig.Extension, Content: code[i]}
+	}
+	if len(files) > 0 && langConfig.EntryPoint != "" {
+		files[0].Name = langConfig.EntryPoint
+	}
+	return files
+}
+
+// cleanSourceName checks that a file name stays inside the submission and returns it in its shortest form
+func cleanSourceName(name string) (string, error) {
+	cleaned := path.Clean(strings.Replace(name, "\\", "/", -1))
+	if name == "" || cleaned == "." || path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") ||
+		strings.ContainsRune(cleaned, 0) {
+		return "", errors.Errorf("Invalid file name %q", name)
+	}
+	return cleaned, nil
+}
+
+// entryPointFirst moves the entry point of the language to the front of names: the file named EntryPoint,
+// or else the first file with the language's extension
+func entryPointFirst(names []string, langConfig conf.LangConfiguration) ([]string, error) {
+	entry := -1
+	for i, name := range names {
+		if langConfig.EntryPoint != "" && name == langConfig.EntryPoint {
+			entry = i
+			break
+		}
+		if entry == -1 && path.Ext(name) == "."+langConfig.Extension {
+			entry = i
+		}
+	}
+	if entry == -1 {
+		return nil, errors.Errorf("Submission has no .%s file", langConfig.Extension)
+	}
+	// Interpreters look for other modules next to the entry point, which is run from the top of the box
+	if langConfig.Interpreted && strings.Contains(names[entry], "/") {
+		return nil, errors.Errorf("Entry point %s is not at the top of the submission", names[entry])
+	}
+	ordered := append([]string{names[entry]}, names[:entry]...)
+	return append(ordered, names[entry+1:]...), nil
+}
+
+// stripTopDirectory removes the directory that every file is in, as in archives of a whole directory
+func stripTopDirectory(files []api.SourceFile) []api.SourceFile {
+	top := ""
+	for _, file := range files {
+		parts := strings.SplitN(path.Clean(file.Name), "/", 2)
+		if len(parts) == 1 || (top != "" && parts[0] != top) {
+			return files
+		}
+		top = parts[0]
+	}
+	stripped := make([]api.SourceFile, len(files))
+	for i, file := range files {
+		stripped[i] = api.SourceFile{Name: strings.SplitN(path.Clean(file.Name), "/", 2)[1], Content: file.Content}
+	}
+	return stripped
+}
+
+// unpackArchive reads the regular files of a zip or tar archive, which may be gzipped. Other entries,
+// such as directories and links, are skipped. Archives that unpack to more than sizeLimit bytes are rejected
+// without unpacking them further
+func unpackArchive(archive []byte, sizeLimit int64) ([]api.SourceFile, error) {
+	files := make([]api.SourceFile, 0)
+	remaining := sizeLimit
+	readFile := func(name string, reader io.Reader) error {
+		if len(files) == maxSourceFiles {
+			return errors.Errorf("Submission has more than %d source files", maxSourceFiles)
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(reader, remaining+1))
+		if err != nil {
+			return errors.Wrapf(err, "Cannot unpack %s", name)
+		}
+		remaining -= int64(len(content))
+		if remaining < 0 {
+			return errors.Errorf("Submission is larger than %d KB", sizeLimit/1024)
+		}
+		files = append(files, api.SourceFile{Name: name, Content: string(content)})
+		return nil
+	}
+
+	if bytes.HasPrefix(archive, []byte("PK\x03\x04")) {
+		zipReader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid zip archive")
+		}
+		for _, entry := range zipReader.File {
+			if !entry.Mode().IsRegular() {
+				continue
+			}
+			reader, err := entry.Open()
+			if err != nil {
+				return nil, errors.Wrapf(err, "Cannot unpack %s", entry.Name)
+			}
+			err = readFile(entry.Name, reader)
+			reader.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return files, nil
+	}
+
+	var reader io.Reader = bytes.NewReader(archive)
+	if bytes.HasPrefix(archive, []byte{0x1f, 0x8b}) {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid gzip archive")
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid tar archive")
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		err = readFile(header.Name, tarReader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,131 @@
+package grader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/programming-in-th/grader/api"
+	"github.com/programming-in-th/grader/conf"
+)
+
+func zipArchive(t *testing.T, files []api.SourceFile) []byte {
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for _, file := range files {
+		fileWriter, err := writer.Create(file.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileWriter.Write([]byte(file.Content))
+	}
+	writer.Close()
+	return buffer.Bytes()
+}
+
+func tarGzArchive(t *testing.T, files []api.SourceFile) []byte {
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	writer := tar.NewWriter(gzipWriter)
+	writer.WriteHeader(&tar.Header{Name: "src/", Typeflag: tar.TypeDir, Mode: 0755})
+	writer.WriteHeader(&tar.Header{Name: "src/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"})
+	for _, file := range files {
+		err := writer.WriteHeader(&tar.Header{Name: file.Name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(file.Content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte(file.Content))
+	}
+	writer.Close()
+	gzipWriter.Close()
+	return buffer.Bytes()
+}
+
+func TestWriteSource(t *testing.T) {
+	config := conf.Config{Glob: conf.GlobalConfiguration{SourceSizeLimit: 1}}
+	java := conf.LangConfiguration{ID: "java8", Extension: "java", EntryPoint: "Main.java"}
+	cpp := conf.LangConfiguration{ID: "cpp14", Extension: "cpp"}
+	python := conf.LangConfiguration{ID: "python3", Extension: "py", Interpreted: true}
+	moduleFiles := []api.SourceFile{
+		{Name: "src/lib/mul.h", Content: "long long mul(long long, long long);\n"},
+		{Name: "src/lib/mul.cpp", Content: "long long mul(long long a, long long b) { return a * b; }\n"},
+		{Name: "src/main.cpp", Content: "int main() {}\n"},
+	}
+	tests := []struct {
+		name     string
+		source   api.Source
+		lang     conf.LangConfiguration
+		expected string // Names in order, or the start of the error
+	}{
+		{"Code", api.Source{Code: []string{"class Main {}", "class Helper {}"}}, java, "Main.java source_1.java"},
+		{"Code without entry point", api.Source{Code: []string{"int main() {}"}}, cpp, "source_0.cpp"},
+		{"Files", api.Source{Files: []api.SourceFile{{Name: "Helper.java", Content: ""}, {Name: "./Main.java", Content: ""}}}, java, "Main.java Helper.java"},
+		{"First file with extension", api.Source{Files: []api.SourceFile{{Name: "a.h", Content: ""}, {Name: "lib/b.cpp", Content: ""}, {Name: "c.cpp", Content: ""}}}, cpp, "lib/b.cpp a.h c.cpp"},
+		{"Zip with top directory", api.Source{Archive: zipArchive(t, moduleFiles)}, cpp, "lib/mul.cpp lib/mul.h main.cpp"},
+		{"Gzipped tar", api.Source{Archive: tarGzArchive(t, moduleFiles)}, cpp, "lib/mul.cpp lib/mul.h main.cpp"},
+		{"No source file", api.Source{Files: []api.SourceFile{{Name: "a.h", Content: ""}}}, cpp, "Submission has no .cpp file"},
+		{"Empty", api.Source{}, cpp, "Submission has no source files"},
+		{"Escaping name", api.Source{Files: []api.SourceFile{{Name: "../a.cpp", Content: ""}}}, cpp, "Invalid file name"},
+		{"Absolute name", api.Source{Files: []api.SourceFile{{Name: "/tmp/a.cpp", Content: ""}}}, cpp, "Invalid file name"},
+		{"Duplicate name", api.Source{Files: []api.SourceFile{{Name: "a.cpp", Content: ""}, {Name: "./a.cpp", Content: ""}}}, cpp, "Submission has two files"},
+		{"Too large", api.Source{Code: []string{strings.Repeat("x", 1025)}}, cpp, "Submission is larger than 1 KB"},
+		{"Too large archive", api.Source{Archive: zipArchive(t, []api.SourceFile{{Name: "a.cpp", Content: strings.Repeat("x", 2048)}})}, cpp, "Submission is larger than 1 KB"},
+		{"Invalid archive", api.Source{Archive: []byte("not an archive")}, cpp, "Invalid tar archive"},
+		{"Nested interpreted entry point", api.Source{Files: []api.SourceFile{{Name: "app/main.py", Content: ""}, {Name: "util.py", Content: ""}}}, python, "Entry point app/main.py"},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "source_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := writeSource(test.source, dir, test.lang, config)
+		got := strings.Join(names, " ")
+		if err != nil {
+			got = err.Error()
+		}
+		if !strings.HasPrefix(got, test.expected) {
+			t.Errorf("%s: got %q, expected %q", test.name, got, test.expected)
+		}
+		for _, name := range names {
+			if _, err := os.Stat(path.Join(dir, name)); err != nil {
+				t.Errorf("%s: %s was not written", test.name, name)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// TestGradeModules grades a submission whose modules and headers are in a directory, through a zip archive
+func TestGradeModules(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+
+	archive := zipArchive(t, []api.SourceFile{
+		{Name: "lib/mul.h", Content: "long long mul(long long a, long long b);\n"},
+		{Name: "lib/mul.cpp", Content: "#include \"mul.h\"\nlong long mul(long long a, long long b) { return a * b; }\n"},
+		{Name: "main.cpp", Content: "#include <iostream>\n#include \"lib/mul.h\"\n" +
+			"int main() { long long a, b; std::cin >> a >> b; std::cout << mul(a, b) << std::endl; }\n"},
+	})
+	done := make(chan bool)
+	jobQueue := NewGradingJobQueue(1, done, gc)
+	defer func() {
+		done <- true
+	}()
+	ch := make(chan api.SyncUpdate)
+	defer close(ch)
+	go func() {
+		for range ch {
+		}
+	}()
+	result, err := gradeSubmission("test_grade_modules", exampleTaskID, "cpp14", api.Source{Archive: archive}, jobQueue, ch, gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResult(t, "Modules", result, 100, []float64{30, 70}, repeatVerdicts(conf.ACVerdict, 10))
+}
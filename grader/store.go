@@ -0,0 +1,325 @@
+package grader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/api"
+	"github.com/programming-in-th/grader/conf"
+)
+
+// storeSubmissionsDir is the directory in the store path of the global configuration that submissions are kept in
+const storeSubmissionsDir = "submissions"
+
+// storeLockFile is the file in the store path that processes lock while they update stored submissions
+const storeLockFile = ".lock"
+
+// storeMutex serializes updates to stored submissions within this process
+var storeMutex sync.Mutex
+
+// StoredSubmission is a submission kept in the store, with every time it was judged
+type StoredSubmission struct {
+	ID        string
+	TaskID    string
+	Lang      string
+	Source    api.Source
+	Submitted time.Time
+	Judgings  []Judging // Oldest first
+}
+
+// Judging is one outcome of judging a stored submission
+type Judging struct {
+	Started            time.Time
+	Judged             time.Time
+	TaskVersion        string             `json:",omitempty"`
+	Verdict            string             // Verdict of the whole submission, see judgingVerdict
+	Result             *PrefixGroupResult `json:",omitempty"` // nil if the submission was not judged on the tests
+	CompileMessage     string             `json:",omitempty"` // What the compiler printed, cut to compileMessageLimit
+	CompileTime        float64            `json:",omitempty"` // Seconds from asking for the compilation to its result, waiting for a worker included
+	Error              string             `json:",omitempty"` // Why the grader could not judge the submission, for operators
+	RejudgeID          string             `json:",omitempty"` // Rejudge that produced the judging, if any
+	RejudgedAfterCrash bool               `json:",omitempty"` // The grader stopped while judging the submission before
+}
+
+// latestJudging returns the last judging of a submission, or nil if it was never judged
+func (submission StoredSubmission) latestJudging() *Judging {
+	if len(submission.Judgings) == 0 {
+		return nil
+	}
+	return &submission.Judgings[len(submission.Judgings)-1]
+}
+
+// lastJudged is when a submission was last judged, or submitted if it never was
+func (submission StoredSubmission) lastJudged() time.Time {
+	if latest := submission.latestJudging(); latest != nil {
+		return latest.Judged
+	}
+	return submission.Submitted
+}
+
+// judgingVerdict sums up a result in one verdict: "Correct" if every test is correct, and otherwise the
+// verdict of the first test that is neither correct nor skipped
+func judgingVerdict(result PrefixGroupResult) string {
+	for _, group := range result.GroupResults {
+		for _, test := range group.Status {
+			if test.Verdict != conf.ACVerdict && test.Verdict != conf.SKVerdict {
+				return test.Verdict
+			}
+		}
+	}
+	return conf.ACVerdict
+}
+
+// storeEnabled reports whether the global configuration has a store
+func storeEnabled(config conf.Config) bool {
+	return config.Glob.StorePath != ""
+}
+
+// storedSubmissionPath returns the file a submission is stored in. IDs are escaped, so that they cannot
+// leave the store
+func storedSubmissionPath(submissionID string, config conf.Config) string {
+	return path.Join(config.Glob.StorePath, storeSubmissionsDir, url.PathEscape(submissionID)+".json")
+}
+
+// ReadStoredSubmission reads a submission from the store
+func ReadStoredSubmission(submissionID string, config conf.Config) (StoredSubmission, error) {
+	submissionPath := storedSubmissionPath(submissionID, config)
+	submissionBytes, err := ioutil.ReadFile(submissionPath)
+	if err != nil {
+		return StoredSubmission{}, errors.Wrapf(err, "Failed to read stored submission %s", submissionID)
+	}
+	var submission StoredSubmission
+	err = json.Unmarshal(submissionBytes, &submission)
+	if err != nil {
+		return StoredSubmission{}, errors.Wrapf(err, "Failed to unmarshal stored submission %s", submissionID)
+	}
+	return submission, nil
+}
+
+// ListStoredSubmissions reads every submission in the store, in the order they were submitted
+func ListStoredSubmissions(config conf.Config) ([]StoredSubmission, error) {
+	entries, err := ioutil.ReadDir(path.Join(config.Glob.StorePath, storeSubmissionsDir))
+	if os.IsNotExist(err) {
+		return []StoredSubmission{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list stored submissions")
+	}
+	submissions := make([]StoredSubmission, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		submissionID, err := url.PathUnescape(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		submission, err := ReadStoredSubmission(submissionID, config)
+		if err != nil {
+			return nil, err
+		}
+		submissions = append(submissions, submission)
+	}
+	sort.SliceStable(submissions, func(i, j int) bool {
+		return submissions[i].Submitted.Before(submissions[j].Submitted)
+	})
+	return submissions, nil
+}
+
+// submissionMatches reports whether a stored submission is selected by every non-empty field of a query
+func submissionMatches(query api.SubmissionQuery, submission StoredSubmission) bool {
+	contains := func(list []string, value string) bool {
+		if len(list) == 0 {
+			return true
+		}
+		for _, element := range list {
+			if element == value {
+				return true
+			}
+		}
+		return false
+	}
+	if !contains(query.SubmissionIDs, submission.ID) || !contains(query.TaskIDs, submission.TaskID) || !contains(query.Langs, submission.Lang) {
+		return false
+	}
+	if !query.Since.IsZero() && submission.Submitted.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !submission.Submitted.Before(query.Until) {
+		return false
+	}
+	if query.Verdict != "" {
+		latest := submission.latestJudging()
+		if latest == nil || latest.Verdict != query.Verdict {
+			return false
+		}
+	}
+	return true
+}
+
+// QueryStoredSubmissions reads the stored submissions that match every non-empty field of query, in the
+// order they were submitted. With a limit, only the ones submitted last are returned
+func QueryStoredSubmissions(query api.SubmissionQuery, config conf.Config) ([]StoredSubmission, error) {
+	var submissions []StoredSubmission
+	if len(query.SubmissionIDs) > 0 {
+		// Submissions asked for by ID are read on their own, and ones that are not stored are left out
+		submissions = make([]StoredSubmission, 0, len(query.SubmissionIDs))
+		for _, submissionID := range query.SubmissionIDs {
+			submission, err := ReadStoredSubmission(submissionID, config)
+			if os.IsNotExist(errors.Cause(err)) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			submissions = append(submissions, submission)
+		}
+		sort.SliceStable(submissions, func(i, j int) bool {
+			return submissions[i].Submitted.Before(submissions[j].Submitted)
+		})
+	} else {
+		var err error
+		submissions, err = ListStoredSubmissions(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	selected := make([]StoredSubmission, 0)
+	for _, submission := range submissions {
+		if submissionMatches(query, submission) {
+			selected = append(selected, submission)
+		}
+	}
+	if query.Limit > 0 && len(selected) > query.Limit {
+		selected = selected[len(selected)-query.Limit:]
+	}
+	return selected, nil
+}
+
+// lockStore takes the lock of the store, which is shared with every other process using the same store path,
+// such as a rejudge run from the command line next to a server. It returns the function that releases it
+func lockStore(config conf.Config) (func(), error) {
+	storeMutex.Lock()
+	err := os.MkdirAll(config.Glob.StorePath, 0755)
+	if err != nil {
+		storeMutex.Unlock()
+		return nil, errors.Wrap(err, "Failed to create store directory")
+	}
+	file, err := os.OpenFile(path.Join(config.Glob.StorePath, storeLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		storeMutex.Unlock()
+		return nil, errors.Wrap(err, "Failed to open store lock")
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		file.Close()
+		storeMutex.Unlock()
+		return nil, errors.Wrap(err, "Failed to lock store")
+	}
+	return func() {
+		file.Close()
+		storeMutex.Unlock()
+	}, nil
+}
+
+// writeStoredSubmission replaces the stored copy of a submission whole, so it is never read half written
+func writeStoredSubmission(submission StoredSubmission, config conf.Config) error {
+	submissionBytes, err := json.Marshal(submission)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to marshal stored submission %s", submission.ID)
+	}
+	submissionPath := storedSubmissionPath(submission.ID, config)
+	err = os.MkdirAll(path.Dir(submissionPath), 0755)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create store directory")
+	}
+	err = ioutil.WriteFile(submissionPath+".tmp", submissionBytes, 0644)
+	if err == nil {
+		err = os.Rename(submissionPath+".tmp", submissionPath)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write stored submission %s", submission.ID)
+	}
+	return nil
+}
+
+// storeJudging adds a judging to a stored submission, storing the submission first if it is new
+func storeJudging(newSubmission StoredSubmission, judging Judging, config conf.Config) error {
+	unlock, err := lockStore(config)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	submission, err := ReadStoredSubmission(newSubmission.ID, config)
+	if err != nil {
+		if _, statErr := os.Stat(storedSubmissionPath(newSubmission.ID, config)); !os.IsNotExist(statErr) {
+			return err
+		}
+		submission = newSubmission
+	}
+	submission.Judgings = append(submission.Judgings, judging)
+	if maxJudgings := config.Glob.StoreJudgings; maxJudgings > 0 && len(submission.Judgings) > maxJudgings {
+		submission.Judgings = submission.Judgings[len(submission.Judgings)-maxJudgings:]
+	}
+	return writeStoredSubmission(submission, config)
+}
+
+// PruneStore removes the submissions that were last judged, and the reports of rejudges that finished,
+// longer ago than the retention of the global configuration. It returns the number of submissions removed
+func PruneStore(config conf.Config) (int, error) {
+	if !storeEnabled(config) || config.Glob.StoreRetention <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -config.Glob.StoreRetention)
+
+	submissions, err := ListStoredSubmissions(config)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, listed := range submissions {
+		if !listed.lastJudged().Before(cutoff) {
+			continue
+		}
+		// The submission is read again under the lock, in case it was judged since it was listed
+		unlock, err := lockStore(config)
+		if err != nil {
+			return removed, err
+		}
+		submission, err := ReadStoredSubmission(listed.ID, config)
+		if err == nil && submission.lastJudged().Before(cutoff) {
+			err = os.Remove(storedSubmissionPath(submission.ID, config))
+			if err == nil {
+				removed++
+			}
+		}
+		unlock()
+		if err != nil {
+			return removed, errors.Wrapf(err, "Failed to remove stored submission %s", listed.ID)
+		}
+	}
+
+	reports, err := ioutil.ReadDir(path.Join(config.Glob.StorePath, rejudgeReportsDir))
+	if err != nil && !os.IsNotExist(err) {
+		return removed, errors.Wrap(err, "Failed to list rejudge reports")
+	}
+	for _, report := range reports {
+		if report.ModTime().Before(cutoff) {
+			err := os.Remove(path.Join(config.Glob.StorePath, rejudgeReportsDir, report.Name()))
+			if err != nil {
+				return removed, errors.Wrapf(err, "Failed to remove rejudge report %s", report.Name())
+			}
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,254 @@
+package grader
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/programming-in-th/grader/api"
+	"github.com/programming-in-th/grader/conf"
+)
+
+// newStoreConfig returns a configuration with an empty store, and a function that removes it
+func newStoreConfig(t *testing.T) (conf.Config, func()) {
+	storePath, err := ioutil.TempDir("", "store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf.Config{Glob: conf.GlobalConfiguration{StorePath: storePath}}, func() {
+		os.RemoveAll(storePath)
+	}
+}
+
+func TestStoreJudging(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	gc.Glob.StorePath = path.Join(gc.BasePath, "store")
+	gc.Glob.StoreJudgings = 2
+
+	done := make(chan bool)
+	jobQueue := NewGradingJobQueue(1, done, gc)
+	defer func() {
+		done <- true
+	}()
+	ch := make(chan api.SyncUpdate)
+	defer close(ch)
+	go func() {
+		for range ch {
+		}
+	}()
+	judge := func(submissionID string, code string) StoredSubmission {
+		_, err := judgeSubmission(submissionID, exampleTaskID, "cpp14", api.Source{Code: []string{code}}, judgeOptions{store: true}, jobQueue, ch, gc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		submission, err := ReadStoredSubmission(submissionID, gc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return submission
+	}
+
+	// The compiler's messages are kept with a submission that does not compile
+	submission := judge("test_store_ce", "int main() { return x; }")
+	judging := submission.latestJudging()
+	if judging == nil || judging.Verdict != conf.CEVerdict || judging.Result != nil {
+		t.Fatalf("Got judgings %+v, expected a compilation error", submission.Judgings)
+	}
+	if !strings.Contains(judging.CompileMessage, "x") || judging.CompileTime <= 0 || judging.Judged.Before(judging.Started) {
+		t.Errorf("Got judging %+v, expected the compiler's messages and timing", *judging)
+	}
+
+	// Only the latest judgings are kept
+	for i := 0; i < 3; i++ {
+		submission = judge("test_store_correct", correctSolution)
+	}
+	if len(submission.Judgings) != 2 || submission.Judgings[1].Result == nil || submission.Judgings[1].Result.Score != 100 ||
+		submission.Judgings[1].TaskVersion == "" || submission.Source.Code[0] != correctSolution {
+		t.Errorf("Got submission %+v, expected two correct judgings", submission)
+	}
+}
+
+func TestQueryStoredSubmissions(t *testing.T) {
+	config, cleanup := newStoreConfig(t)
+	defer cleanup()
+
+	submitted := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	stored := []StoredSubmission{
+		{ID: "1", TaskID: "a_time_b", Lang: "cpp14", Submitted: submitted, Judgings: []Judging{{Verdict: conf.ACVerdict}}},
+		{ID: "2", TaskID: "a_time_b", Lang: "python3", Submitted: submitted.Add(time.Minute), Judgings: []Judging{{Verdict: conf.WAVerdict}}},
+		{ID: "3/3", TaskID: "other", Lang: "cpp14", Submitted: submitted.Add(2 * time.Minute), Judgings: []Judging{{Verdict: conf.ACVerdict}}},
+	}
+	for _, submission := range stored {
+		err := writeStoredSubmission(submission, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		query    api.SubmissionQuery
+		expected []string
+	}{
+		{"Everything", api.SubmissionQuery{}, []string{"1", "2", "3/3"}},
+		{"IDs", api.SubmissionQuery{SubmissionIDs: []string{"3/3", "missing", "1"}}, []string{"1", "3/3"}},
+		{"Task", api.SubmissionQuery{TaskIDs: []string{"a_time_b"}}, []string{"1", "2"}},
+		{"Verdict", api.SubmissionQuery{Verdict: conf.ACVerdict, Langs: []string{"cpp14"}}, []string{"1", "3/3"}},
+		{"Until", api.SubmissionQuery{Until: submitted.Add(time.Minute)}, []string{"1"}},
+		{"Limit", api.SubmissionQuery{Limit: 2}, []string{"2", "3/3"}},
+	}
+	for _, test := range tests {
+		submissions, err := QueryStoredSubmissions(test.query, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, 0)
+		for _, submission := range submissions {
+			ids = append(ids, submission.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: got %v, expected %v", test.name, ids, test.expected)
+		}
+	}
+}
+
+func TestStoreLock(t *testing.T) {
+	config, cleanup := newStoreConfig(t)
+	defer cleanup()
+
+	// Another process holding the lock is stood in for by a lock on a file opened separately
+	other, err := os.OpenFile(path.Join(config.Glob.StorePath, storeLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	err = syscall.Flock(int(other.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := make(chan error)
+	go func() {
+		stored <- storeJudging(StoredSubmission{ID: "locked"}, Judging{Verdict: conf.ACVerdict}, config)
+	}()
+	select {
+	case <-stored:
+		t.Fatal("Judging was stored while another process held the store lock")
+	case <-time.After(200 * time.Millisecond):
+	}
+	syscall.Flock(int(other.Fd()), syscall.LOCK_UN)
+	err = <-stored
+	if err != nil {
+		t.Fatal(err)
+	}
+	submission, err := ReadStoredSubmission("locked", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(submission.Judgings) != 1 {
+		t.Errorf("Got %d judgings, expected 1", len(submission.Judgings))
+	}
+}
+
+func TestPruneStore(t *testing.T) {
+	config, cleanup := newStoreConfig(t)
+	defer cleanup()
+	config.Glob.StoreRetention = 30
+
+	now := time.Now()
+	stored := []StoredSubmission{
+		// Submitted long ago, but rejudged recently
+		{ID: "rejudged", Submitted: now.AddDate(0, 0, -60), Judgings: []Judging{{Judged: now.AddDate(0, 0, -60)}, {Judged: now.AddDate(0, 0, -1)}}},
+		{ID: "old", Submitted: now.AddDate(0, 0, -40), Judgings: []Judging{{Judged: now.AddDate(0, 0, -40)}}},
+		{ID: "new", Submitted: now, Judgings: []Judging{}},
+	}
+	for _, submission := range stored {
+		err := writeStoredSubmission(submission, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, report := range []RejudgeReport{{ID: "old_rejudge"}, {ID: "new_rejudge"}} {
+		err := writeRejudgeReport(report, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := now.AddDate(0, 0, -31)
+	os.Chtimes(path.Join(config.Glob.StorePath, rejudgeReportsDir, "old_rejudge.json"), old, old)
+
+	removed, err := PruneStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("Removed %d submissions, expected 1", removed)
+	}
+	submissions, err := ListStoredSubmissions(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(submissions) != 2 || submissions[0].ID != "rejudged" || submissions[1].ID != "new" {
+		t.Errorf("Got submissions %+v, expected rejudged and new to be kept", submissions)
+	}
+	if _, err := ReadRejudgeReport("old_rejudge", config); err == nil {
+		t.Error("Old rejudge report was kept")
+	}
+	if _, err := ReadRejudgeReport("new_rejudge", config); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGradeRecoveredSubmission(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	gc.Glob.StorePath = path.Join(gc.BasePath, "store")
+
+	// The grader stopped while the submission was being judged, leaving its files behind
+	submissionID := "test_recovered"
+	for _, dir := range []string{path.Join(BASE_TMP_PATH, submissionID), path.Join(BASE_SRC_PATH, submissionID)} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path.Join(dir, "stale.cpp"), []byte("int main() {"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan bool)
+	jobQueue := NewGradingJobQueue(1, done, gc)
+	defer func() {
+		done <- true
+	}()
+	ch := make(chan api.SyncUpdate)
+	defer close(ch)
+	go func() {
+		for range ch {
+		}
+	}()
+	accepted := time.Now().Add(-time.Hour).Round(0)
+	err := GradeRecoveredSubmission(submissionID, exampleTaskID, "cpp14", api.Source{Code: []string{correctSolution}}, accepted, jobQueue, ch, gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submission, err := ReadStoredSubmission(submissionID, gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	judging := submission.latestJudging()
+	if judging == nil || !judging.RejudgedAfterCrash || judging.Verdict != conf.ACVerdict {
+		t.Errorf("Got judgings %+v, expected a correct judging marked as rejudged after the crash", submission.Judgings)
+	}
+	if !submission.Submitted.Equal(accepted) {
+		t.Errorf("Submitted at %s, expected the time it was accepted %s", submission.Submitted, accepted)
+	}
+	if _, err := os.Stat(path.Join(BASE_SRC_PATH, submissionID, "stale.cpp")); !os.IsNotExist(err) {
+		t.Error("Stale source file was kept")
+	}
+}
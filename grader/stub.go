@@ -0,0 +1,462 @@
+package grader
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/api"
+	"github.com/programming-in-th/grader/conf"
+)
+
+// TaskInterface declares the functions that submissions to a function-signature task implement instead of
+// a whole program. The grader generates a stub for every supported language that reads calls from the
+// input, makes them, and prints their results.
+//
+// Every call in the input is the function name followed by its arguments, separated by whitespace. Strings
+// may not contain whitespace, and arrays are their length followed by their elements. Results are printed
+// one per line, with the elements of arrays separated by spaces and doubles to 9 decimal places
+type TaskInterface struct {
+	Functions []InterfaceFunction
+}
+
+// InterfaceFunction is a function that submissions implement
+type InterfaceFunction struct {
+	Name    string
+	Params  []InterfaceParam
+	Returns string `json:",omitempty"` // Type of the result. The function returns nothing if empty
+}
+
+// InterfaceParam is a parameter of an InterfaceFunction
+type InterfaceParam struct {
+	Name string
+	Type string // One of the interfaceTypes, or an array of one, such as "int[]"
+}
+
+// interfaceType is how a type of an interface is written in each language
+type interfaceType struct {
+	cpp       string
+	java      string
+	javaParse string // Converts a token into the type. Tokens are already strings if empty
+	python    string // Converts a token into the type
+	rust      string
+}
+
+// interfaceTypes are the types of parameters and results
+var interfaceTypes = map[string]interfaceType{
+	"int":    {"int", "int", "Integer.parseInt", "int", "i32"},
+	"long":   {"long long", "long", "Long.parseLong", "int", "i64"},
+	"double": {"double", "double", "Double.parseDouble", "float", "f64"},
+	"string": {"std::string", "String", "", "str", "String"},
+}
+
+var identifierRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// reservedNames cannot name functions or parameters, since they are keywords or used by the stub in some language
+var reservedNames = strings.Fields(`
+	auto bool break case char class const continue default delete do double else enum extern float for friend
+	goto if inline int long namespace new operator private protected public return short signed sizeof static
+	struct switch template this throw try typedef union unsigned using virtual void volatile while std main
+	abstract assert boolean byte catch extends final finally implements import instanceof interface native
+	package super synchronized throws transient String Main Solution
+	and as def del elif except False from global in is lambda None nonlocal not or pass raise True with yield
+	sys solution
+	async await crate dyn fn impl let loop match mod move mut pub ref self Self trait type unsafe use where`)
+
+// validName reports whether name can be used as a function or parameter name in every language
+func validName(name string) bool {
+	if !identifierRegexp.MatchString(name) || strings.HasPrefix(strings.ToLower(name), "grader") {
+		return false
+	}
+	for _, reserved := range reservedNames {
+		if name == reserved {
+			return false
+		}
+	}
+	return true
+}
+
+// stubGenerator generates the stub of a language. The submission is named solutionName, and the files
+// generated for it start with the entry point of the program
+type stubGenerator struct {
+	solutionName string
+	generate     func(TaskInterface) []api.SourceFile
+}
+
+// stubGenerators are the languages stubs can be generated for, by their extension
+var stubGenerators = map[string]stubGenerator{
+	"cpp":  {"solution.cpp", cppStub},
+	"java": {"Solution.java", javaStub},
+	"py":   {"solution.py", pythonStub},
+	"rs":   {"solution.rs", rustStub},
+}
+
+// splitType splits a type into its element type and whether it is an array
+func splitType(typeName string) (interfaceType, bool) {
+	isArray := strings.HasSuffix(typeName, "[]")
+	return interfaceTypes[strings.TrimSuffix(typeName, "[]")], isArray
+}
+
+// validate checks that the names and types of an interface can be used in every language
+func (taskInterface TaskInterface) validate() error {
+	if len(taskInterface.Functions) == 0 {
+		return errors.New("Interface has no functions")
+	}
+	validType := func(typeName string) bool {
+		_, exists := interfaceTypes[strings.TrimSuffix(typeName, "[]")]
+		return exists
+	}
+	functionNames := make(map[string]bool)
+	for _, function := range taskInterface.Functions {
+		if !validName(function.Name) || functionNames[function.Name] {
+			return errors.Errorf("Invalid or duplicate function name %q", function.Name)
+		}
+		functionNames[function.Name] = true
+		if function.Returns != "" && !validType(function.Returns) {
+			return errors.Errorf("Function %s returns unknown type %q", function.Name, function.Returns)
+		}
+		paramNames := make(map[string]bool)
+		for _, param := range function.Params {
+			if !validName(param.Name) || paramNames[param.Name] {
+				return errors.Errorf("Function %s has invalid or duplicate parameter name %q", function.Name, param.Name)
+			}
+			paramNames[param.Name] = true
+			if !validType(param.Type) {
+				return errors.Errorf("Parameter %s of function %s has unknown type %q", param.Name, function.Name, param.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// stubs generates the stub of an interface for a language. It returns the generated files, starting with the
+// entry point of the program, and the name that the submission's first file must have
+func (taskInterface TaskInterface) stubs(langConfig conf.LangConfiguration) ([]api.SourceFile, string, error) {
+	err := taskInterface.validate()
+	if err != nil {
+		return nil, "", err
+	}
+	generator, exists := stubGenerators[langConfig.Extension]
+	if !exists {
+		return nil, "", errors.Errorf("Cannot generate stubs for language %s", langConfig.ID)
+	}
+	return generator.generate(taskInterface), generator.solutionName, nil
+}
+
+func cppType(typeName string) string {
+	elementType, isArray := splitType(typeName)
+	if isArray {
+		return "std::vector<" + elementType.cpp + ">"
+	}
+	return elementType.cpp
+}
+
+func cppStub(taskInterface TaskInterface) []api.SourceFile {
+	var header strings.Builder
+	header.WriteString("#include <string>\n#include <vector>\n\n")
+	for _, function := range taskInterface.Functions {
+		params := make([]string, len(function.Params))
+		for i, param := range function.Params {
+			params[i] = cppType(param.Type) + " " + param.Name
+		}
+		returns := "void"
+		if function.Returns != "" {
+			returns = cppType(function.Returns)
+		}
+		fmt.Fprintf(&header, "%s %s(%s);\n", returns, function.Name, strings.Join(params, ", "))
+	}
+
+	var grader strings.Builder
+	grader.WriteString(`#include <iomanip>
+#include <iostream>
+#include "interface.h"
+
+template <class T> static void grader_read(T &value) { std::cin >> value; }
+template <class T> static void grader_read(std::vector<T> &values) {
+    size_t length;
+    std::cin >> length;
+    values.resize(length);
+    for (auto &value : values) grader_read(value);
+}
+template <class T> static void grader_write(const T &value) { std::cout << value; }
+template <class T> static void grader_write(const std::vector<T> &values) {
+    for (size_t i = 0; i < values.size(); i++) {
+        if (i > 0) std::cout << ' ';
+        grader_write(values[i]);
+    }
+}
+
+int main() {
+    std::ios::sync_with_stdio(false);
+    std::cin.tie(nullptr);
+    std::cout << std::fixed << std::setprecision(9);
+    std::string grader_name;
+    while (std::cin >> grader_name) {
+`)
+	for _, function := range taskInterface.Functions {
+		fmt.Fprintf(&grader, "        if (grader_name == \"%s\") {\n", function.Name)
+		args := make([]string, len(function.Params))
+		for i, param := range function.Params {
+			fmt.Fprintf(&grader, "            %s %s;\n            grader_read(%s);\n", cppType(param.Type), param.Name, param.Name)
+			args[i] = param.Name
+		}
+		call := function.Name + "(" + strings.Join(args, ", ") + ")"
+		if function.Returns != "" {
+			fmt.Fprintf(&grader, "            grader_write(%s);\n            std::cout << '\\n';\n", call)
+		} else {
+			fmt.Fprintf(&grader, "            %s;\n", call)
+		}
+		grader.WriteString("            continue;\n        }\n")
+	}
+	grader.WriteString("        return 1;\n    }\n}\n")
+
+	return []api.SourceFile{
+		{Name: "grader.cpp", Content: grader.String()},
+		{Name: "interface.h", Content: header.String()},
+	}
+}
+
+func javaType(typeName string) string {
+	elementType, isArray := splitType(typeName)
+	if isArray {
+		return elementType.java + "[]"
+	}
+	return elementType.java
+}
+
+func javaStub(taskInterface TaskInterface) []api.SourceFile {
+	var stub strings.Builder
+	stub.WriteString(`import java.io.*;
+import java.util.*;
+
+public class Main {
+    private static StreamTokenizer graderTokens;
+
+    private static String graderNext() throws IOException {
+        if (graderTokens.nextToken() == StreamTokenizer.TT_EOF) {
+            return null;
+        }
+        return graderTokens.sval;
+    }
+
+    private static String graderFormat(Object value) {
+        if (value instanceof Double) {
+            return String.format(Locale.ROOT, "%.9f", (Double) value);
+        }
+        if (value instanceof int[]) {
+            return graderJoin(Arrays.stream((int[]) value).boxed().toArray());
+        }
+        if (value instanceof long[]) {
+            return graderJoin(Arrays.stream((long[]) value).boxed().toArray());
+        }
+        if (value instanceof double[]) {
+            return graderJoin(Arrays.stream((double[]) value).boxed().toArray());
+        }
+        if (value instanceof Object[]) {
+            return graderJoin((Object[]) value);
+        }
+        return String.valueOf(value);
+    }
+
+    private static String graderJoin(Object[] values) {
+        StringBuilder joined = new StringBuilder();
+        for (int i = 0; i < values.length; i++) {
+            if (i > 0) {
+                joined.append(' ');
+            }
+            joined.append(graderFormat(values[i]));
+        }
+        return joined.toString();
+    }
+
+    public static void main(String[] args) throws IOException {
+        graderTokens = new StreamTokenizer(new BufferedReader(new InputStreamReader(System.in)));
+        graderTokens.resetSyntax();
+        graderTokens.wordChars(33, 255);
+        graderTokens.whitespaceChars(0, 32);
+        PrintWriter graderOut = new PrintWriter(new BufferedWriter(new OutputStreamWriter(System.out)));
+        String graderName;
+        while ((graderName = graderNext()) != null) {
+            switch (graderName) {
+`)
+	for _, function := range taskInterface.Functions {
+		fmt.Fprintf(&stub, "            case \"%s\": {\n", function.Name)
+		args := make([]string, len(function.Params))
+		for i, param := range function.Params {
+			elementType, isArray := splitType(param.Type)
+			parse := "graderNext()"
+			if elementType.javaParse != "" {
+				parse = elementType.javaParse + "(graderNext())"
+			}
+			if isArray {
+				fmt.Fprintf(&stub, "                %s %s = new %s[Integer.parseInt(graderNext())];\n", javaType(param.Type), param.Name, elementType.java)
+				fmt.Fprintf(&stub, "                for (int graderI = 0; graderI < %s.length; graderI++) {\n", param.Name)
+				fmt.Fprintf(&stub, "                    %s[graderI] = %s;\n                }\n", param.Name, parse)
+			} else {
+				fmt.Fprintf(&stub, "                %s %s = %s;\n", javaType(param.Type), param.Name, parse)
+			}
+			args[i] = param.Name
+		}
+		call := "Solution." + function.Name + "(" + strings.Join(args, ", ") + ")"
+		if function.Returns != "" {
+			fmt.Fprintf(&stub, "                graderOut.println(graderFormat(%s));\n", call)
+		} else {
+			fmt.Fprintf(&stub, "                %s;\n", call)
+		}
+		stub.WriteString("                break;\n            }\n")
+	}
+	stub.WriteString(`            default:
+                graderOut.flush();
+                System.exit(1);
+            }
+        }
+        graderOut.flush();
+    }
+}
+`)
+	return []api.SourceFile{{Name: "Main.java", Content: stub.String()}}
+}
+
+func pythonStub(taskInterface TaskInterface) []api.SourceFile {
+	var stub strings.Builder
+	stub.WriteString(`import sys
+
+import solution
+
+
+def grader_format(value):
+    if isinstance(value, float):
+        return "%.9f" % value
+    if isinstance(value, (list, tuple)):
+        return " ".join(grader_format(element) for element in value)
+    return str(value)
+
+
+def grader_main():
+    grader_tokens = iter(sys.stdin.read().split())
+    grader_out = []
+    for grader_name in grader_tokens:
+`)
+	for i, function := range taskInterface.Functions {
+		keyword := "if"
+		if i > 0 {
+			keyword = "elif"
+		}
+		fmt.Fprintf(&stub, "        %s grader_name == \"%s\":\n", keyword, function.Name)
+		args := make([]string, len(function.Params))
+		for i, param := range function.Params {
+			elementType, isArray := splitType(param.Type)
+			if isArray {
+				fmt.Fprintf(&stub, "            %s = [%s(next(grader_tokens)) for _ in range(int(next(grader_tokens)))]\n", param.Name, elementType.python)
+			} else {
+				fmt.Fprintf(&stub, "            %s = %s(next(grader_tokens))\n", param.Name, elementType.python)
+			}
+			args[i] = param.Name
+		}
+		call := "solution." + function.Name + "(" + strings.Join(args, ", ") + ")"
+		if function.Returns != "" {
+			fmt.Fprintf(&stub, "            grader_out.append(grader_format(%s))\n", call)
+		} else {
+			fmt.Fprintf(&stub, "            %s\n", call)
+		}
+	}
+	stub.WriteString(`        else:
+            break
+    sys.stdout.write("".join(line + "\n" for line in grader_out))
+
+
+grader_main()
+`)
+	return []api.SourceFile{{Name: "main.py", Content: stub.String()}}
+}
+
+func rustType(typeName string) string {
+	elementType, isArray := splitType(typeName)
+	if isArray {
+		return "Vec<" + elementType.rust + ">"
+	}
+	return elementType.rust
+}
+
+func rustStub(taskInterface TaskInterface) []api.SourceFile {
+	var stub strings.Builder
+	stub.WriteString(`mod solution;
+
+use std::io::{self, Read, Write};
+
+trait GraderFormat {
+    fn grader_format(&self) -> String;
+}
+
+impl GraderFormat for i32 {
+    fn grader_format(&self) -> String {
+        self.to_string()
+    }
+}
+
+impl GraderFormat for i64 {
+    fn grader_format(&self) -> String {
+        self.to_string()
+    }
+}
+
+impl GraderFormat for f64 {
+    fn grader_format(&self) -> String {
+        format!("{:.9}", self)
+    }
+}
+
+impl GraderFormat for String {
+    fn grader_format(&self) -> String {
+        self.clone()
+    }
+}
+
+impl<T: GraderFormat> GraderFormat for Vec<T> {
+    fn grader_format(&self) -> String {
+        self.iter().map(|value| value.grader_format()).collect::<Vec<_>>().join(" ")
+    }
+}
+
+fn main() {
+    let mut grader_input = String::new();
+    io::stdin().read_to_string(&mut grader_input).unwrap();
+    let mut grader_tokens = grader_input.split_ascii_whitespace();
+    let grader_stdout = io::stdout();
+    let mut grader_out = io::BufWriter::new(grader_stdout.lock());
+    while let Some(grader_name) = grader_tokens.next() {
+        match grader_name {
+`)
+	for _, function := range taskInterface.Functions {
+		fmt.Fprintf(&stub, "            \"%s\" => {\n", function.Name)
+		args := make([]string, len(function.Params))
+		for i, param := range function.Params {
+			elementType, isArray := splitType(param.Type)
+			if isArray {
+				fmt.Fprintf(&stub, "                let grader_length: usize = grader_tokens.next().unwrap().parse().unwrap();\n")
+				fmt.Fprintf(&stub, "                let %s: %s = (0..grader_length).map(|_| grader_tokens.next().unwrap().parse().unwrap()).collect();\n",
+					param.Name, rustType(param.Type))
+			} else {
+				fmt.Fprintf(&stub, "                let %s: %s = grader_tokens.next().unwrap().parse().unwrap();\n", param.Name, elementType.rust)
+			}
+			args[i] = param.Name
+		}
+		call := "solution::" + function.Name + "(" + strings.Join(args, ", ") + ")"
+		if function.Returns != "" {
+			fmt.Fprintf(&stub, "                writeln!(grader_out, \"{}\", %s.grader_format()).unwrap();\n", call)
+		} else {
+			fmt.Fprintf(&stub, "                %s;\n", call)
+		}
+		stub.WriteString("            }\n")
+	}
+	stub.WriteString(`            _ => {
+                grader_out.flush().unwrap();
+                std::process::exit(1);
+            }
+        }
+    }
+}
+`)
+	return []api.SourceFile{{Name: "main.rs", Content: stub.String()}}
+}
@@ -0,0 +1,270 @@
+package grader
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/programming-in-th/grader/api"
+	"github.com/programming-in-th/grader/conf"
+)
+
+// stubTestInterface uses every type, as a parameter and as a result
+var stubTestInterface = TaskInterface{Functions: []InterfaceFunction{
+	{Name: "multiply", Params: []InterfaceParam{{Name: "a", Type: "long"}, {Name: "b", Type: "long"}}, Returns: "long"},
+	{Name: "scale", Params: []InterfaceParam{{Name: "values", Type: "int[]"}, {Name: "factor", Type: "double"}}, Returns: "double[]"},
+	{Name: "greet", Params: []InterfaceParam{{Name: "name", Type: "string"}}, Returns: "string"},
+	{Name: "remember", Params: []InterfaceParam{{Name: "words", Type: "string[]"}}},
+	{Name: "count", Returns: "int"},
+}}
+
+const stubTestInput = "multiply 3000000000 3\nscale 3 1 2 3 0.5\ngreet world\nremember 2 a b\nremember 0\ncount\n"
+
+const stubTestOutput = "9000000000\n0.500000000 1.000000000 1.500000000\nhello world\n2\n"
+
+func TestInterfaceValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		functions []InterfaceFunction
+		expected  string // Start of the error, or empty if valid
+	}{
+		{"Valid", stubTestInterface.Functions, ""},
+		{"No functions", nil, "Interface has no functions"},
+		{"Keyword", []InterfaceFunction{{Name: "match"}}, "Invalid or duplicate function name"},
+		{"Stub name", []InterfaceFunction{{Name: "grader_read"}}, "Invalid or duplicate function name"},
+		{"Duplicate function", []InterfaceFunction{{Name: "f"}, {Name: "f"}}, "Invalid or duplicate function name"},
+		{"Duplicate parameter", []InterfaceFunction{{Name: "f", Params: []InterfaceParam{{Name: "a", Type: "int"}, {Name: "a", Type: "int"}}}},
+			"Function f has invalid or duplicate parameter name"},
+		{"Unknown parameter type", []InterfaceFunction{{Name: "f", Params: []InterfaceParam{{Name: "a", Type: "int[][]"}}}},
+			"Parameter a of function f has unknown type"},
+		{"Unknown result type", []InterfaceFunction{{Name: "f", Returns: "char"}}, "Function f returns unknown type"},
+	}
+	for _, test := range tests {
+		err := TaskInterface{Functions: test.functions}.validate()
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if (test.expected == "") != (got == "") || !strings.HasPrefix(got, test.expected) {
+			t.Errorf("%s: got %q, expected %q", test.name, got, test.expected)
+		}
+	}
+}
+
+// TestStubs builds the stub of every language whose compiler is installed with a solution, and runs it on
+// calls of every function
+func TestStubs(t *testing.T) {
+	tests := []struct {
+		lang     conf.LangConfiguration
+		tool     string
+		solution string
+		build    func(dir string, names []string) []string // Returns the command that runs the program
+	}{
+		{conf.LangConfiguration{ID: "cpp14", Extension: "cpp"}, "c++", `#include "interface.h"
+long long multiply(long long a, long long b) { return a * b; }
+std::vector<double> scale(std::vector<int> values, double factor) {
+    std::vector<double> scaled;
+    for (int value : values) scaled.push_back(value * factor);
+    return scaled;
+}
+std::string greet(std::string name) { return "hello " + name; }
+static int remembered = 0;
+void remember(std::vector<std::string> words) { remembered += words.size(); }
+int count() { return remembered; }
+`, func(dir string, names []string) []string {
+			out, err := exec.Command("c++", append([]string{"--std=c++14", "-o", path.Join(dir, "bin")}, cppSources(dir, names)...)...).CombinedOutput()
+			if err != nil {
+				t.Fatalf("Cannot compile C++ stub: %v\n%s", err, out)
+			}
+			return []string{path.Join(dir, "bin")}
+		}},
+		{conf.LangConfiguration{ID: "python3", Extension: "py", Interpreted: true}, "python3", `remembered = 0
+
+
+def multiply(a, b):
+    return a * b
+
+
+def scale(values, factor):
+    return [value * factor for value in values]
+
+
+def greet(name):
+    return "hello " + name
+
+
+def remember(words):
+    global remembered
+    remembered += len(words)
+
+
+def count():
+    return remembered
+`, func(dir string, names []string) []string {
+			return []string{"python3", path.Join(dir, names[0])}
+		}},
+		{conf.LangConfiguration{ID: "rust", Extension: "rs"}, "rustc", `use std::sync::atomic::{AtomicUsize, Ordering};
+
+static REMEMBERED: AtomicUsize = AtomicUsize::new(0);
+
+pub fn multiply(a: i64, b: i64) -> i64 {
+    a * b
+}
+
+pub fn scale(values: Vec<i32>, factor: f64) -> Vec<f64> {
+    values.iter().map(|&value| value as f64 * factor).collect()
+}
+
+pub fn greet(name: String) -> String {
+    format!("hello {}", name)
+}
+
+pub fn remember(words: Vec<String>) {
+    REMEMBERED.fetch_add(words.len(), Ordering::SeqCst);
+}
+
+pub fn count() -> i32 {
+    REMEMBERED.load(Ordering::SeqCst) as i32
+}
+`, func(dir string, names []string) []string {
+			out, err := exec.Command("rustc", "-o", path.Join(dir, "bin"), path.Join(dir, names[0])).CombinedOutput()
+			if err != nil {
+				t.Fatalf("Cannot compile Rust stub: %v\n%s", err, out)
+			}
+			return []string{path.Join(dir, "bin")}
+		}},
+	}
+	config := conf.Config{Glob: conf.GlobalConfiguration{SourceSizeLimit: 64}}
+	manifest := Manifest{Interface: &stubTestInterface}
+	for _, test := range tests {
+		if _, err := exec.LookPath(test.tool); err != nil {
+			t.Logf("%s is not installed, skipping %s", test.tool, test.lang.ID)
+			continue
+		}
+		dir, err := ioutil.TempDir("", "stub_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := prepareSource(api.Source{Code: []string{test.solution}}, dir, manifest, test.lang, config)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("%s: %v", test.lang.ID, err)
+		}
+		command := test.build(dir, names)
+		run := exec.Command(command[0], command[1:]...)
+		run.Stdin = strings.NewReader(stubTestInput)
+		out, err := run.CombinedOutput()
+		if err != nil || string(out) != stubTestOutput {
+			t.Errorf("%s: got %q (%v), expected %q", test.lang.ID, out, err, stubTestOutput)
+		}
+		os.RemoveAll(dir)
+	}
+
+	// The Java stub cannot be run without a JDK, so only its calls are checked
+	stubs, solutionName, err := stubTestInterface.stubs(conf.LangConfiguration{ID: "java8", Extension: "java"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if solutionName != "Solution.java" || len(stubs) != 1 || stubs[0].Name != "Main.java" {
+		t.Errorf("Java: got stubs for %s, expected Main.java for Solution.java", solutionName)
+	}
+	for _, call := range []string{"Solution.multiply(a, b)", "Solution.scale(values, factor)", "Solution.remember(words);"} {
+		if !strings.Contains(stubs[0].Content, call) {
+			t.Errorf("Java: stub does not call %s", call)
+		}
+	}
+}
+
+// cppSources returns the paths of the C++ sources among names
+func cppSources(dir string, names []string) []string {
+	sources := make([]string, 0)
+	for _, name := range names {
+		if path.Ext(name) == ".cpp" {
+			sources = append(sources, path.Join(dir, name))
+		}
+	}
+	return sources
+}
+
+func TestPrepareSourceCollision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stub_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := conf.Config{Glob: conf.GlobalConfiguration{SourceSizeLimit: 64}}
+	source := api.Source{Files: []api.SourceFile{{Name: "solution.cpp", Content: ""}, {Name: "interface.h", Content: ""}}}
+	_, err = prepareSource(source, dir, Manifest{Interface: &stubTestInterface}, conf.LangConfiguration{ID: "cpp14", Extension: "cpp"}, config)
+	if err == nil || !strings.HasPrefix(err.Error(), "File name interface.h is used by the task") {
+		t.Errorf("Got %v, expected the file name to be rejected", err)
+	}
+}
+
+// TestGradeInterface grades submissions in C++ and Python on the example task turned into a function-signature task
+func TestGradeInterface(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+
+	taskPath := path.Join(gc.BasePath, "tasks", exampleTaskID)
+	manifest, err := ReadManifest(path.Join(taskPath, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Interface = &TaskInterface{Functions: []InterfaceFunction{
+		{Name: "multiply", Params: []InterfaceParam{{Name: "a", Type: "long"}, {Name: "b", Type: "long"}}, Returns: "long"},
+	}}
+	err = WriteManifest(path.Join(taskPath, "manifest.json"), manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, err := ioutil.ReadDir(path.Join(taskPath, "inputs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range inputs {
+		inputPath := path.Join(taskPath, "inputs", input.Name())
+		content, err := ioutil.ReadFile(inputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(inputPath, append([]byte("multiply "), content...), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan bool)
+	jobQueue := NewGradingJobQueue(1, done, gc)
+	defer func() {
+		done <- true
+	}()
+	ch := make(chan api.SyncUpdate)
+	defer close(ch)
+	go func() {
+		for range ch {
+		}
+	}()
+	submissions := []struct {
+		lang string
+		code string
+	}{
+		{"cpp14", "#include \"interface.h\"\nlong long multiply(long long a, long long b) { return a * b; }\n"},
+		{"python3", "def multiply(a, b):\n    return a * b\n"},
+	}
+	for _, submission := range submissions {
+		if submission.lang == "python3" {
+			if _, err := exec.LookPath("python3"); err != nil {
+				continue
+			}
+		}
+		result, err := gradeSubmission("test_grade_interface_"+submission.lang, exampleTaskID, submission.lang,
+			api.Source{Code: []string{submission.code}}, jobQueue, ch, gc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkResult(t, "Interface "+submission.lang, result, 100, []float64{30, 70}, repeatVerdicts(conf.ACVerdict, 10))
+	}
+}
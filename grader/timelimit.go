@@ -0,0 +1,248 @@
+package grader
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/isolate"
+	"github.com/programming-in-th/grader/util"
+)
+
+// TimeLimitOptions configures how time limits are proposed from measured running times
+type TimeLimitOptions struct {
+	Runs                int                // Number of times each solution is run on each test
+	ProbeTimeLimit      float64            // Time limit (seconds) used while measuring, so slow solutions still finish
+	Multiplier          float64            // Proposed limit = slowest time * multiplier
+	LanguageMultipliers map[string]float64 // Overrides Multiplier for specific languages
+	BaseLang            string             // Language whose limit becomes DefaultLimits. Defaults to the first solution's language
+	NoisySpread         float64            // Tests whose spread exceeds this fraction of their max time are reported as noisy
+}
+
+// DefaultTimeLimitOptions are the options used when none are given on the command line
+var DefaultTimeLimitOptions = TimeLimitOptions{
+	Runs:           5,
+	ProbeTimeLimit: 10,
+	Multiplier:     2,
+	NoisySpread:    0.2,
+}
+
+// TestTiming is the running time of one solution on one test over all runs, in milliseconds
+type TestTiming struct {
+	TestIndex int // Starting at 1
+	Max       int
+	Spread    int // Max - min
+}
+
+// SolutionTiming is the running time of one accepted solution on every test
+type SolutionTiming struct {
+	Solution AuthorSolution
+	Tests    []TestTiming
+	Max      int
+}
+
+// TimeLimitProposal is the result of measuring a task's accepted solutions
+type TimeLimitProposal struct {
+	Solutions     []SolutionTiming
+	DefaultLimits LangRunLimit
+	Limits        map[string]LangRunLimit // Only for languages whose limit differs from DefaultLimits
+	NoisyTests    []string
+}
+
+// roundUpTimeLimit rounds a time limit in seconds up to the next tenth of a second.
+// A limit of 0 would disallow the language, so the smallest limit is a tenth of a second
+func roundUpTimeLimit(timeLimit float64) float64 {
+	return math.Max(math.Ceil(timeLimit*10-1e-9)/10, 0.1)
+}
+
+// timeSolution runs an accepted solution options.Runs times on every test and collects its running times
+func timeSolution(manifest Manifest, taskID string, solution AuthorSolution, submissionID string, options TimeLimitOptions, pool *boxPool, config conf.Config) (SolutionTiming, error) {
+	timing := SolutionTiming{Solution: solution}
+	taskPath := path.Join(config.BasePath, "tasks", taskID)
+
+	err := util.CreateDirIfNotExist(path.Join(BASE_TMP_PATH, submissionID))
+	if err != nil {
+		return timing, errors.Wrap(err, "Error creating working tmp folder")
+	}
+	defer os.RemoveAll(path.Join(BASE_TMP_PATH, submissionID))
+	srcDir, srcNames, err := prepareAuthorSolution(manifest, taskID, submissionID, solution.Lang, solution.Path, config)
+	if err != nil {
+		return timing, err
+	}
+	defer os.RemoveAll(srcDir)
+	compiled := compileSubmission(submissionID,
+		taskID,
+		solution.Lang,
+		srcDir,
+		srcNames,
+		taskCompileFilePaths(manifest, taskID, solution.Lang, config),
+		pool,
+		config)
+	if compiled.verdict != "" {
+		return timing, errors.Errorf("%s does not compile: %s %v", solution.Path, compiled.verdict, compiled.err)
+	}
+	userBinPath := compiled.binPath
+
+	_, memoryLimit := manifest.runLimits(solution.Lang)
+	numTests := manifest.Groups[len(manifest.Groups)-1].TestIndices.End
+	for testIndex := 1; testIndex <= numTests; testIndex++ {
+		testTiming := TestTiming{TestIndex: testIndex}
+		minTime := -1
+		for run := 0; run < options.Runs; run++ {
+			result := runInSandbox(userBinPath,
+				options.ProbeTimeLimit,
+				memoryLimit,
+				manifest.outputLimit(config),
+				path.Join(taskPath, "inputs", strconv.Itoa(testIndex)+".in"),
+				path.Join(BASE_TMP_PATH, submissionID, strconv.Itoa(testIndex)+".out"),
+				path.Join(BASE_TMP_PATH, submissionID, strconv.Itoa(testIndex)+".err"),
+				solution.Lang,
+				pool,
+			)
+			if result.verdict != isolate.IsolateRunOK {
+				return timing, errors.Errorf("%s got %s on test %d", solution.Path, result.verdict, testIndex)
+			}
+			if result.metrics.TimeElapsed > testTiming.Max {
+				testTiming.Max = result.metrics.TimeElapsed
+			}
+			if minTime == -1 || result.metrics.TimeElapsed < minTime {
+				minTime = result.metrics.TimeElapsed
+			}
+		}
+		testTiming.Spread = testTiming.Max - minTime
+		timing.Tests = append(timing.Tests, testTiming)
+		if testTiming.Max > timing.Max {
+			timing.Max = testTiming.Max
+		}
+	}
+	return timing, nil
+}
+
+// ProposeTimeLimits runs the task's accepted author solutions (those expected to be "Correct") repeatedly
+// and proposes time limits for every language they are written in. Memory limits are kept as they are
+func ProposeTimeLimits(taskID string, options TimeLimitOptions, config conf.Config) (TimeLimitProposal, error) {
+	proposal := TimeLimitProposal{Limits: make(map[string]LangRunLimit)}
+	manifest, err := ReadManifest(path.Join(config.BasePath, "tasks", taskID, "manifest.json"))
+	if err != nil {
+		return proposal, err
+	}
+	if len(manifest.Groups) == 0 {
+		return proposal, errors.New("Task has no tests")
+	}
+	if options.Runs < 1 {
+		return proposal, errors.New("Solutions must be run at least once")
+	}
+
+	pool := newBoxPool(1, config)
+	defer pool.close()
+	timings := make([]SolutionTiming, 0)
+	for i, solution := range manifest.AuthorSolutions {
+		if solution.Expected.Verdict != conf.ACVerdict {
+			continue
+		}
+		if _, exists := manifest.Limits[solution.Lang]; !exists && manifest.DefaultLimits == nil {
+			return proposal, errors.Errorf("Task has no memory limit for %s", solution.Lang)
+		}
+		timing, err := timeSolution(manifest, taskID, solution, "timelimit_"+taskID+"_"+strconv.Itoa(i+1), options, pool, config)
+		if err != nil {
+			return proposal, err
+		}
+		timings = append(timings, timing)
+	}
+	if len(timings) == 0 {
+		return proposal, errors.New("Task declares no author solutions expected to be Correct")
+	}
+	return proposeTimeLimits(manifest, timings, options)
+}
+
+// proposeTimeLimits turns measured running times into limits for every language that was measured
+func proposeTimeLimits(manifest Manifest, timings []SolutionTiming, options TimeLimitOptions) (TimeLimitProposal, error) {
+	proposal := TimeLimitProposal{Solutions: timings, Limits: make(map[string]LangRunLimit)}
+
+	slowest := make(map[string]int) // Language -> slowest time of any solution in milliseconds
+	for _, timing := range timings {
+		lang := timing.Solution.Lang
+		if currMax, exists := slowest[lang]; !exists || timing.Max > currMax {
+			slowest[lang] = timing.Max
+		}
+		for _, test := range timing.Tests {
+			if test.Max > 0 && float64(test.Spread) > options.NoisySpread*float64(test.Max) {
+				proposal.NoisyTests = append(proposal.NoisyTests,
+					fmt.Sprintf("%s on test %d: max %d ms, spread %d ms", timing.Solution.Path, test.TestIndex, test.Max, test.Spread))
+			}
+		}
+	}
+
+	baseLang := options.BaseLang
+	if baseLang == "" {
+		baseLang = timings[0].Solution.Lang
+	}
+	if _, exists := slowest[baseLang]; !exists {
+		return proposal, errors.Errorf("No accepted solution in base language %s", baseLang)
+	}
+
+	languages := make([]string, 0, len(slowest))
+	for lang := range slowest {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+	limits := make(map[string]LangRunLimit)
+	for _, lang := range languages {
+		multiplier, exists := options.LanguageMultipliers[lang]
+		if !exists {
+			multiplier = options.Multiplier
+		}
+		_, memoryLimit := manifest.runLimits(lang)
+		limits[lang] = LangRunLimit{
+			TimeLimit:   roundUpTimeLimit(float64(slowest[lang]) / 1000 * multiplier),
+			MemoryLimit: memoryLimit / 1024,
+		}
+	}
+
+	proposal.DefaultLimits = limits[baseLang]
+	for _, lang := range languages {
+		if limits[lang] != proposal.DefaultLimits {
+			proposal.Limits[lang] = limits[lang]
+		}
+	}
+	return proposal, nil
+}
+
+// ApplyTimeLimits writes the proposed time limits of the measured languages into a task's manifest, as
+// entries in Limits. Their memory limits stay as they are, and DefaultLimits is not changed, so languages
+// without measurements keep the limits they had. Languages that were explicitly disallowed (limits of 0)
+// are left untouched
+func ApplyTimeLimits(taskID string, proposal TimeLimitProposal, config conf.Config) error {
+	manifestPath := path.Join(config.BasePath, "tasks", taskID, "manifest.json")
+	manifest, err := ReadManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	if manifest.Limits == nil {
+		manifest.Limits = make(map[string]LangRunLimit)
+	}
+	for _, timing := range proposal.Solutions {
+		lang := timing.Solution.Lang
+		existing, exists := manifest.Limits[lang]
+		if exists && (existing.TimeLimit == 0 || existing.MemoryLimit == 0) {
+			continue
+		}
+		proposed, differs := proposal.Limits[lang]
+		if !differs {
+			proposed = proposal.DefaultLimits
+		}
+		limit := proposed
+		if exists {
+			limit.MemoryLimit = existing.MemoryLimit
+		} else if manifest.DefaultLimits != nil {
+			limit.MemoryLimit = manifest.DefaultLimits.MemoryLimit
+		}
+		manifest.Limits[lang] = limit
+	}
+	return WriteManifest(manifestPath, manifest)
+}
@@ -0,0 +1,103 @@
+package grader
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/programming-in-th/grader/conf"
+)
+
+func TestProposeTimeLimits(t *testing.T) {
+	manifest := Manifest{
+		DefaultLimits: &LangRunLimit{TimeLimit: 1, MemoryLimit: 256},
+		Limits:        map[string]LangRunLimit{"java8": {TimeLimit: 3, MemoryLimit: 512}},
+	}
+	timings := []SolutionTiming{
+		{Solution: AuthorSolution{Path: "main.cpp", Lang: "cpp14"}, Max: 310, Tests: []TestTiming{{1, 120, 10}, {2, 310, 100}}},
+		{Solution: AuthorSolution{Path: "alt.cpp", Lang: "cpp14"}, Max: 250, Tests: []TestTiming{{1, 250, 5}}},
+		{Solution: AuthorSolution{Path: "Main.java", Lang: "java8"}, Max: 700, Tests: []TestTiming{{1, 700, 20}}},
+		{Solution: AuthorSolution{Path: "main.py", Lang: "python3"}, Max: 0, Tests: []TestTiming{{1, 0, 0}}},
+	}
+	options := DefaultTimeLimitOptions
+	options.LanguageMultipliers = map[string]float64{"java8": 1.5}
+
+	proposal, err := proposeTimeLimits(manifest, timings, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proposal.DefaultLimits != (LangRunLimit{TimeLimit: 0.7, MemoryLimit: 256}) {
+		t.Errorf("Unexpected default limits %#v", proposal.DefaultLimits)
+	}
+	if len(proposal.Limits) != 2 ||
+		proposal.Limits["java8"] != (LangRunLimit{TimeLimit: 1.1, MemoryLimit: 512}) ||
+		proposal.Limits["python3"] != (LangRunLimit{TimeLimit: 0.1, MemoryLimit: 256}) {
+		t.Errorf("Unexpected limits %#v", proposal.Limits)
+	}
+	if len(proposal.NoisyTests) != 1 {
+		t.Errorf("Expected test 2 of main.cpp to be noisy, got %v", proposal.NoisyTests)
+	}
+
+	options.BaseLang = "rust"
+	if _, err := proposeTimeLimits(manifest, timings, options); err == nil {
+		t.Error("Base language without solutions was accepted")
+	}
+}
+
+func TestApplyTimeLimits(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "timelimit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	taskPath := path.Join(baseDir, "tasks", "task")
+	err = os.MkdirAll(taskPath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteManifest(path.Join(taskPath, "manifest.json"), Manifest{
+		ID:            "task",
+		DefaultLimits: &LangRunLimit{TimeLimit: 1, MemoryLimit: 256},
+		Limits:        map[string]LangRunLimit{"java8": {TimeLimit: 3, MemoryLimit: 512}, "c11": {TimeLimit: 0, MemoryLimit: 0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proposal := TimeLimitProposal{
+		Solutions: []SolutionTiming{
+			{Solution: AuthorSolution{Lang: "cpp14"}},
+			{Solution: AuthorSolution{Lang: "java8"}},
+			{Solution: AuthorSolution{Lang: "c11"}},
+		},
+		DefaultLimits: LangRunLimit{TimeLimit: 0.7, MemoryLimit: 1024},
+		Limits:        map[string]LangRunLimit{"java8": {TimeLimit: 1.1, MemoryLimit: 1024}},
+	}
+	err = ApplyTimeLimits("task", proposal, conf.Config{BasePath: baseDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ReadManifest(path.Join(taskPath, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the time limits of measured languages change. Unmeasured and disallowed languages keep theirs
+	if *manifest.DefaultLimits != (LangRunLimit{TimeLimit: 1, MemoryLimit: 256}) {
+		t.Errorf("Default limits changed to %#v", *manifest.DefaultLimits)
+	}
+	expected := map[string]LangRunLimit{
+		"cpp14": {TimeLimit: 0.7, MemoryLimit: 256},
+		"java8": {TimeLimit: 1.1, MemoryLimit: 512},
+		"c11":   {TimeLimit: 0, MemoryLimit: 0},
+	}
+	if len(manifest.Limits) != len(expected) {
+		t.Errorf("Got limits %#v", manifest.Limits)
+	}
+	for lang, limit := range expected {
+		if manifest.Limits[lang] != limit {
+			t.Errorf("Got limits %#v for %s, expected %#v", manifest.Limits[lang], lang, limit)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package grader
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/api"
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/util"
+)
+
+// compilationErrorVerdict is the verdict an author solution can expect when it must not compile
+const compilationErrorVerdict = conf.CEVerdict
+
+// VerificationResult is the outcome of judging one author solution
+type VerificationResult struct {
+	Solution   AuthorSolution
+	Result     *PrefixGroupResult // nil if the solution did not compile
+	Mismatches []string
+}
+
+// checkExpectation compares the results of some groups against expected and describes every mismatch
+func checkExpectation(what string, expected ExpectedResult, score float64, groups []SingleGroupResult) []string {
+	mismatches := make([]string, 0)
+	if expected.Score != nil && math.Abs(*expected.Score-score) > 0.005 {
+		mismatches = append(mismatches, fmt.Sprintf("%s: expected score %v, got %v", what, *expected.Score, score))
+	}
+	if expected.Verdict == "" {
+		return mismatches
+	}
+
+	allCorrect := true
+	found := false
+	for _, group := range groups {
+		for _, test := range group.Status {
+			if test.Verdict != conf.ACVerdict {
+				allCorrect = false
+			}
+			if test.Verdict == expected.Verdict {
+				found = true
+			}
+		}
+	}
+	if expected.Verdict == conf.ACVerdict && !allCorrect {
+		mismatches = append(mismatches, fmt.Sprintf("%s: expected every test to be %s", what, conf.ACVerdict))
+	} else if expected.Verdict != conf.ACVerdict && !found {
+		mismatches = append(mismatches, fmt.Sprintf("%s: expected at least one test to be %s", what, expected.Verdict))
+	}
+	return mismatches
+}
+
+// checkAuthorSolution describes every way in which result differs from what solution expects
+func checkAuthorSolution(solution AuthorSolution, result *PrefixGroupResult) []string {
+	if result == nil {
+		if solution.Expected.Verdict == compilationErrorVerdict {
+			return []string{}
+		}
+		return []string{"Solution did not compile"}
+	}
+	if solution.Expected.Verdict == compilationErrorVerdict {
+		return []string{"Solution compiled, but was expected not to"}
+	}
+
+	mismatches := checkExpectation("Task", solution.Expected, result.Score, result.GroupResults)
+	groupIndices := make([]int, 0, len(solution.Groups))
+	for groupIndex := range solution.Groups {
+		groupIndices = append(groupIndices, groupIndex)
+	}
+	sort.Ints(groupIndices)
+	for _, groupIndex := range groupIndices {
+		expected := solution.Groups[groupIndex]
+		if groupIndex < 1 || groupIndex > len(result.GroupResults) {
+			mismatches = append(mismatches, fmt.Sprintf("Group %d does not exist", groupIndex))
+			continue
+		}
+		group := result.GroupResults[groupIndex-1]
+		mismatches = append(mismatches, checkExpectation("Group "+strconv.Itoa(groupIndex), expected, group.Score, []SingleGroupResult{group})...)
+	}
+	return mismatches
+}
+
+// VerifyTask judges every author solution declared in a task's manifest through the grading pipeline
+// and reports where the results differ from what the solutions declare
+func VerifyTask(taskID string, config conf.Config) ([]VerificationResult, error) {
+	taskPath := path.Join(config.BasePath, "tasks", taskID)
+	manifest, err := ReadManifest(path.Join(taskPath, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.AuthorSolutions) == 0 {
+		return nil, errors.New("Task declares no author solutions")
+	}
+
+	for _, dir := range []string{BASE_TMP_PATH, BASE_SRC_PATH} {
+		err = util.CreateDirIfNotExist(dir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Cannot create %s", dir)
+		}
+	}
+
+	done := make(chan bool)
+	gradingJobChannel := NewGradingJobQueue(1, done, config)
+	defer func() {
+		done <- true
+	}()
+
+	// Progress updates are not needed, only the final results
+	syncUpdateChannel := make(chan api.SyncUpdate)
+	defer close(syncUpdateChannel)
+	go func() {
+		for range syncUpdateChannel {
+		}
+	}()
+
+	results := make([]VerificationResult, 0, len(manifest.AuthorSolutions))
+	for i, solution := range manifest.AuthorSolutions {
+		source, err := readAuthorSolution(taskID, solution.Path, config)
+		if err != nil {
+			return results, err
+		}
+		submissionID := "verify_" + taskID + "_" + strconv.Itoa(i+1)
+		result, err := gradeSubmission(submissionID,
+			taskID,
+			solution.Lang,
+			source,
+			gradingJobChannel,
+			syncUpdateChannel,
+			config)
+		if err != nil {
+			return results, errors.Wrapf(err, "Cannot judge author solution %s", solution.Path)
+		}
+		results = append(results, VerificationResult{solution, result, checkAuthorSolution(solution, result)})
+	}
+	return results, nil
+}
@@ -0,0 +1,50 @@
+package grader
+
+import (
+	"testing"
+
+	"github.com/programming-in-th/grader/conf"
+)
+
+func TestCheckAuthorSolution(t *testing.T) {
+	result := &PrefixGroupResult{
+		Score: 30,
+		GroupResults: []SingleGroupResult{
+			{Score: 30, FullScore: 30, Status: []SingleTestResult{{Verdict: conf.ACVerdict}, {Verdict: conf.ACVerdict}}},
+			{Score: 0, FullScore: 70, Status: []SingleTestResult{{Verdict: conf.ACVerdict}, {Verdict: conf.TLEVerdict}, {Verdict: conf.SKVerdict}}},
+		},
+	}
+	fullScore := 100.0
+	partialScore := 30.0
+
+	mainCorrect := AuthorSolution{Path: "main.cpp", Lang: "cpp14", Expected: ExpectedResult{Score: &fullScore, Verdict: conf.ACVerdict}}
+	if mismatches := checkAuthorSolution(mainCorrect, result); len(mismatches) != 2 {
+		t.Errorf("Expected a score and a verdict mismatch, got %v", mismatches)
+	}
+
+	slow := AuthorSolution{
+		Path:     "slow.cpp",
+		Lang:     "cpp14",
+		Expected: ExpectedResult{Score: &partialScore},
+		Groups: map[int]ExpectedResult{
+			1: {Verdict: conf.ACVerdict},
+			2: {Verdict: conf.TLEVerdict},
+		},
+	}
+	if mismatches := checkAuthorSolution(slow, result); len(mismatches) != 0 {
+		t.Errorf("Unexpected mismatches %v", mismatches)
+	}
+
+	wrongGroup := AuthorSolution{Groups: map[int]ExpectedResult{1: {Verdict: conf.WAVerdict}, 3: {}}}
+	if mismatches := checkAuthorSolution(wrongGroup, result); len(mismatches) != 2 {
+		t.Errorf("Expected a verdict mismatch and a missing group, got %v", mismatches)
+	}
+
+	notCompiling := AuthorSolution{Expected: ExpectedResult{Verdict: compilationErrorVerdict}}
+	if mismatches := checkAuthorSolution(notCompiling, nil); len(mismatches) != 0 {
+		t.Errorf("Unexpected mismatches %v", mismatches)
+	}
+	if mismatches := checkAuthorSolution(notCompiling, result); len(mismatches) != 1 {
+		t.Errorf("Expected a compilation mismatch, got %v", mismatches)
+	}
+}
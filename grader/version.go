@@ -0,0 +1,106 @@
+package grader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/util"
+)
+
+// taskHistoryName is the file in the directory of a task that lists the versions of its data
+const taskHistoryName = "versions.json"
+
+// TaskVersion is a version of the data of a task in its history
+type TaskVersion struct {
+	Version string
+	Loaded  time.Time // When the grader first loaded this version
+}
+
+// taskHistoryMutex serializes updates to the histories of tasks
+var taskHistoryMutex sync.Mutex
+
+// taskVersion hashes the data of a task that results on it depend on: its manifest, tests and compile files,
+// and its checker and grouper. A checker or grouper that is missing hashes differently from any file
+func taskVersion(manifestInstance taskManifest, config conf.Config) (string, error) {
+	checkerPath := path.Join(config.BasePath, "config", "defaultCheckers", manifestInstance.Checker)
+	if manifestInstance.Checker == "custom" {
+		checkerPath = path.Join(manifestInstance.taskBasePath, "checker")
+	}
+	grouperPath := path.Join(config.BasePath, "config", "defaultGroupers", manifestInstance.Grouper)
+	if manifestInstance.Grouper == "custom" {
+		grouperPath = path.Join(manifestInstance.taskBasePath, "grouper")
+	}
+	parts := []string{"task"}
+	for _, filePath := range []string{path.Join(manifestInstance.taskBasePath, "manifest.json"), checkerPath, grouperPath} {
+		hash, err := hashFileCached(filePath)
+		if os.IsNotExist(err) {
+			hash, err = "missing", nil
+		}
+		if err != nil {
+			return "", errors.Wrapf(err, "Cannot hash %s", filePath)
+		}
+		parts = append(parts, hash)
+	}
+	for _, dir := range []string{manifestInstance.inputsBasePath, manifestInstance.solutionsBasePath, path.Join(manifestInstance.taskBasePath, "compileFiles")} {
+		hash, err := hashDirectory(dir)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, hash)
+	}
+	return util.HashStrings(parts...), nil
+}
+
+// ReadTaskHistory reads the versions of the data of a task, oldest first. Tasks the grader has not loaded
+// have no versions
+func ReadTaskHistory(taskID string, config conf.Config) ([]TaskVersion, error) {
+	historyPath := path.Join(config.BasePath, "tasks", taskID, taskHistoryName)
+	historyBytes, err := ioutil.ReadFile(historyPath)
+	if os.IsNotExist(err) {
+		return []TaskVersion{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read task history at %s", historyPath)
+	}
+	var history []TaskVersion
+	err = json.Unmarshal(historyBytes, &history)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to unmarshal task history at %s", historyPath)
+	}
+	return history, nil
+}
+
+// recordTaskVersion adds version to the history of a task, unless it is already the latest version.
+// A task whose data is changed back gets its old version again
+func recordTaskVersion(taskID string, version string, config conf.Config) error {
+	taskHistoryMutex.Lock()
+	defer taskHistoryMutex.Unlock()
+	history, err := ReadTaskHistory(taskID, config)
+	if err != nil {
+		return err
+	}
+	if len(history) > 0 && history[len(history)-1].Version == version {
+		return nil
+	}
+	history = append(history, TaskVersion{version, time.Now()})
+	historyBytes, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal task history")
+	}
+	// The history is replaced whole, so it is never read half written
+	historyPath := path.Join(config.BasePath, "tasks", taskID, taskHistoryName)
+	err = ioutil.WriteFile(historyPath+".tmp", append(historyBytes, '\n'), 0644)
+	if err == nil {
+		err = os.Rename(historyPath+".tmp", historyPath)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write task history at %s", historyPath)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package grader
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestTaskVersion(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	manifestPath := path.Join(gc.BasePath, "tasks", exampleTaskID, "manifest.json")
+	inputPath := path.Join(gc.BasePath, "tasks", exampleTaskID, "inputs", "1.in")
+	original, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	load := func() string {
+		manifestInstance, err := readManifestFromFile(manifestPath, gc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return manifestInstance.version
+	}
+	first := load()
+	if load() != first {
+		t.Error("Version changed without the task changing")
+	}
+	err = ioutil.WriteFile(inputPath, []byte("5 20\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := load()
+	if second == first {
+		t.Error("Version did not change with an input")
+	}
+	err = ioutil.WriteFile(inputPath, original, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if load() != first {
+		t.Error("Version did not change back with the input")
+	}
+
+	history, err := ReadTaskHistory(exampleTaskID, gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{first, second, first}
+	if len(history) != len(expected) {
+		t.Fatalf("Got %d versions in the history, expected %d", len(history), len(expected))
+	}
+	for i, version := range history {
+		if version.Version != expected[i] {
+			t.Errorf("Version %d: got %s, expected %s", i+1, version.Version, expected[i])
+		}
+		if i > 0 && version.Loaded.Before(history[i-1].Loaded) {
+			t.Errorf("Version %d was loaded before the version preceding it", i+1)
+		}
+	}
+
+	result := gradeExample(t, gc, "test_task_version", correctSolution)
+	if result != nil && result.TaskVersion != first {
+		t.Errorf("Got result for task version %q, expected %q", result.TaskVersion, first)
+	}
+}
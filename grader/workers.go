@@ -1,11 +1,16 @@
 package grader
 
 import (
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
 	"path"
 	"strconv"
 	"sync"
+	"syscall"
 
+	"github.com/pkg/errors"
 	"github.com/programming-in-th/grader/conf"
 	"github.com/programming-in-th/grader/isolate"
 )
@@ -17,11 +22,61 @@ type GradingJob struct {
 	userBinPath      string
 	testIndex        int
 	resultChannel    chan SingleTestResult
+	compile          *compileJob // Set for jobs that compile the submission instead of running a test
 }
 
-type safeBoxIDPool struct {
-	BoxIDs map[int]bool
-	Mux    sync.Mutex
+// sandboxVerdicts maps each verdict of a program the sandbox stopped to the verdict of the test
+var sandboxVerdicts = map[isolate.RunVerdict]string{
+	isolate.IsolateRunTLE: conf.TLEVerdict,
+	isolate.IsolateRunMLE: conf.MLEVerdict,
+	isolate.IsolateRunRE:  conf.REVerdict,
+	isolate.IsolateRunILE: conf.ILEVerdict,
+	isolate.IsolateRunOLE: conf.OLEVerdict,
+	isolate.IsolateRunSV:  conf.SVVerdict,
+}
+
+// stderrTailSize is how much of the end of a program's standard error is kept in its test result, in bytes
+const stderrTailSize = 2048
+
+// readStderrTail reads the last stderrTailSize bytes of the standard error saved at stderrPath.
+// Standard error that was cut is marked with a leading ellipsis
+func readStderrTail(stderrPath string) (string, error) {
+	file, err := os.Open(stderrPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	prefix := ""
+	if info.Size() > stderrTailSize {
+		_, err = file.Seek(-stderrTailSize, io.SeekEnd)
+		if err != nil {
+			return "", err
+		}
+		prefix = "..."
+	}
+	tail, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+	return prefix + string(tail), nil
+}
+
+// newTestResult creates the result of a test from its verdict and how the sandbox says the program ended
+func newTestResult(verdict string, score string, message string, sandboxResult sandboxTestResult) SingleTestResult {
+	return SingleTestResult{
+		Verdict:  verdict,
+		Score:    score,
+		Time:     sandboxResult.metrics.TimeElapsed,
+		Memory:   sandboxResult.metrics.MemoryUsage,
+		Message:  message,
+		ExitCode: sandboxResult.metrics.ExitCode,
+		Signal:   isolate.SignalName(syscall.Signal(sandboxResult.metrics.ExitSignal)),
+		Killed:   sandboxResult.metrics.Killed,
+	}
 }
 
 func waitForTestResult(manifestInstance taskManifest,
@@ -30,52 +85,56 @@ func waitForTestResult(manifestInstance taskManifest,
 	userBinPath string,
 	testIndex int,
 	config conf.Config,
-	boxIDPool *safeBoxIDPool,
+	pool *boxPool,
 ) SingleTestResult {
 	// Convert time and memory limits
-	var timeLimit float64
-	var memoryLimit int
-	if limits, exists := manifestInstance.Limits[targLang]; exists {
-		timeLimit = limits.TimeLimit
-		memoryLimit = limits.MemoryLimit * 1024 // Convert to KiB
-	} else {
-		timeLimit = manifestInstance.DefaultLimits.TimeLimit
-		memoryLimit = manifestInstance.DefaultLimits.MemoryLimit * 1024
-	}
+	timeLimit, memoryLimit := manifestInstance.runLimits(targLang)
 
-	// Run isolate job
-	isolateResult := runIsolate(
+	// Run the program in a sandbox
+	stderrPath := path.Join(BASE_TMP_PATH, submissionID, strconv.Itoa(testIndex+1)+".err")
+	isolateResult := runInSandbox(
 		userBinPath,
 		timeLimit,
 		memoryLimit,
+		manifestInstance.outputLimit(config),
 		path.Join(manifestInstance.inputsBasePath, strconv.Itoa(testIndex+1)+".in"),
 		path.Join(BASE_TMP_PATH, submissionID, strconv.Itoa(testIndex+1)+".out"),
-		config.Glob.IsolateBinPath,
-		path.Join(config.BasePath, "config", "runnerScripts", targLang),
-		boxIDPool,
+		stderrPath,
+		targLang,
+		pool,
 	)
 
+	// A failure of the grader or the task fails only this test, and operators are alerted. The grouper
+	// still gets a result if one can be written
+	judgeErrorResult := func(err error) SingleTestResult {
+		reportJudgeError(&JudgeError{SubmissionID: submissionID, TaskID: manifestInstance.ID, Test: testIndex + 1, Err: err}, config)
+		checkErr := writeCheckFile(submissionID, testIndex, conf.IEVerdict, "0", config.Glob.DefaultMessages[conf.IEVerdict])
+		if checkErr != nil {
+			log.Println(errors.Wrapf(checkErr, "Unable to write result of test %d of submission %s", testIndex+1, submissionID))
+		}
+		return newTestResult(conf.IEVerdict, "0", config.Glob.DefaultMessages[conf.IEVerdict], isolateResult)
+	}
+
 	// Check for fatal errors first and return corresponding results without running checker
 	if isolateResult.verdict == isolate.IsolateRunXX || isolateResult.verdict == isolate.IsolateRunOther {
-		writeCheckFile(submissionID, testIndex, conf.IEVerdict, "0", config.Glob.DefaultMessages[conf.IEVerdict])
-		log.Println(isolateResult.err)
-		return SingleTestResult{conf.IEVerdict, "0", isolateResult.metrics.TimeElapsed, isolateResult.metrics.MemoryUsage, config.Glob.DefaultMessages[conf.IEVerdict]}
+		err := isolateResult.err
+		if err == nil {
+			err = errors.Errorf("Sandbox failed with verdict %s", isolateResult.verdict)
+		}
+		return judgeErrorResult(err)
 	}
 
+	var result SingleTestResult
 	if isolateResult.verdict != isolate.IsolateRunOK {
-		if isolateResult.verdict == isolate.IsolateRunMLE {
-			writeCheckFile(submissionID, testIndex, conf.MLEVerdict, "0", config.Glob.DefaultMessages[conf.MLEVerdict])
-			return SingleTestResult{conf.MLEVerdict, "0", isolateResult.metrics.TimeElapsed, isolateResult.metrics.MemoryUsage, config.Glob.DefaultMessages[conf.MLEVerdict]}
-		} else if isolateResult.verdict == isolate.IsolateRunRE {
-			writeCheckFile(submissionID, testIndex, conf.REVerdict, "0", config.Glob.DefaultMessages[conf.REVerdict])
-			return SingleTestResult{conf.REVerdict, "0", isolateResult.metrics.TimeElapsed, isolateResult.metrics.MemoryUsage, config.Glob.DefaultMessages[conf.REVerdict]}
-		} else if isolateResult.verdict == isolate.IsolateRunTLE {
-			writeCheckFile(submissionID, testIndex, conf.TLEVerdict, "0", config.Glob.DefaultMessages[conf.TLEVerdict])
-			return SingleTestResult{conf.TLEVerdict, "0", isolateResult.metrics.TimeElapsed, isolateResult.metrics.MemoryUsage, config.Glob.DefaultMessages[conf.TLEVerdict]}
-		} else {
-			writeCheckFile(submissionID, testIndex, conf.IEVerdict, "0", config.Glob.DefaultMessages[conf.IEVerdict])
-			return SingleTestResult{conf.IEVerdict, "0", isolateResult.metrics.TimeElapsed, isolateResult.metrics.MemoryUsage, config.Glob.DefaultMessages[conf.IEVerdict]}
+		verdict, exists := sandboxVerdicts[isolateResult.verdict]
+		if !exists {
+			return judgeErrorResult(errors.Errorf("Sandbox returned unknown verdict %s", isolateResult.verdict))
+		}
+		err := writeCheckFile(submissionID, testIndex, verdict, "0", config.Glob.DefaultMessages[verdict])
+		if err != nil {
+			return judgeErrorResult(err)
 		}
+		result = newTestResult(verdict, "0", config.Glob.DefaultMessages[verdict], isolateResult)
 	} else {
 		// Assuming the verdict is isolate.IsolateRunOK, we run the checker
 		var checkerPath string
@@ -84,7 +143,7 @@ func waitForTestResult(manifestInstance taskManifest,
 		} else {
 			checkerPath = path.Join(manifestInstance.taskBasePath, "checker")
 		}
-		checkerResult := runChecker(
+		checkerResult, err := runChecker(
 			submissionID,
 			testIndex,
 			checkerPath,
@@ -93,35 +152,98 @@ func waitForTestResult(manifestInstance taskManifest,
 			path.Join(manifestInstance.solutionsBasePath, strconv.Itoa(testIndex+1)+".sol"),
 			config,
 		)
+		if err != nil {
+			return judgeErrorResult(err)
+		}
 
-		return SingleTestResult{checkerResult.verdict, checkerResult.score, isolateResult.metrics.TimeElapsed, isolateResult.metrics.MemoryUsage, checkerResult.message}
+		result = newTestResult(checkerResult.verdict, checkerResult.score, checkerResult.message, isolateResult)
 	}
+
+	if manifestInstance.ShowStderr {
+		stderr, err := readStderrTail(stderrPath)
+		if err != nil {
+			log.Println(errors.Wrapf(err, "Unable to read standard error of test %d of submission %s", testIndex+1, submissionID))
+		}
+		result.Stderr = stderr
+	}
+	return result
 }
 
 func NewGradingJobQueue(maxWorkers int, done chan bool, config conf.Config) chan GradingJob {
-	ch := make(chan GradingJob)
+	ch, _, _, _ := NewPrioritizedGradingJobQueue(maxWorkers, done, config)
+	return ch
+}
+
+// ErrAborted is returned for submissions whose judging was cut off by aborting the grading job queue. Their
+// judging is neither stored nor finished, so they are judged again from the on-disk queue
+var ErrAborted = errors.New("Judging was aborted")
+
+// NewPrioritizedGradingJobQueue starts grading workers that take jobs from two queues. Jobs in the
+// background queue, such as those of rejudges, only start while no job is waiting in the first queue.
+// Closing done stops every worker once its current job is finished. The returned stopped channel is closed
+// when all of them have stopped and their boxes are cleaned up. Calling abort cleans up every box at once,
+// killing the jobs still running, for when they cannot be waited for
+func NewPrioritizedGradingJobQueue(maxWorkers int, done chan bool, config conf.Config) (ch chan GradingJob, background chan GradingJob, stopped chan bool, abort func()) {
+	ch = make(chan GradingJob)
+	background = make(chan GradingJob)
+	stopped = make(chan bool)
 	var wg sync.WaitGroup
 
+	pool := newBoxPool(maxWorkers, config)
+	wg.Add(maxWorkers)
 	go func() {
 		wg.Wait()
-		close(ch)
+		pool.close()
+		close(stopped)
 	}()
 
-	boxIDPool := safeBoxIDPool{BoxIDs: make(map[int]bool)}
-	wg.Add(maxWorkers)
+	// Results of jobs that finish after the queue is aborted are marked, since their boxes were cleaned up
+	// under them
+	runJob := func(job GradingJob) {
+		if job.compile != nil {
+			result := compileSubmission(job.submissionID,
+				job.compile.taskID,
+				job.targLang,
+				job.compile.srcDir,
+				job.compile.srcNames,
+				job.compile.compileFilePaths,
+				pool,
+				config)
+			result.aborted = pool.isAborted()
+			job.compile.resultChannel <- result
+			return
+		}
+		result := waitForTestResult(job.manifestInstance,
+			job.submissionID,
+			job.targLang,
+			job.userBinPath,
+			job.testIndex,
+			config,
+			pool)
+		result.aborted = pool.isAborted()
+		job.resultChannel <- result
+	}
+
 	for i := 0; i < maxWorkers; i++ {
 		go func(i int) {
 			for {
 				select {
 				case job := <-ch:
-					result := waitForTestResult(job.manifestInstance,
-						job.submissionID,
-						job.targLang,
-						job.userBinPath,
-						job.testIndex,
-						config,
-						&boxIDPool)
-					job.resultChannel <- result
+					runJob(job)
+					continue
+				default:
+				}
+				select {
+				case <-done: // Background jobs are not started once the workers are stopping
+					wg.Done()
+					return
+				default:
+				}
+				select {
+				case job := <-ch:
+					runJob(job)
+				case job := <-background:
+					runJob(job)
 				case <-done:
 					wg.Done()
 					return
@@ -129,5 +251,5 @@ func NewGradingJobQueue(maxWorkers int, done chan bool, config conf.Config) chan
 			}
 		}(i)
 	}
-	return ch
+	return ch, background, stopped, pool.abort
 }
@@ -0,0 +1,159 @@
+package grader
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/programming-in-th/grader/api"
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/fakebox"
+	"github.com/programming-in-th/grader/isolate"
+)
+
+func TestGradingJobQueueShutdown(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+
+	// The compiler runs until it is released, in a box that must be cleaned up afterwards
+	running := make(chan string)
+	release := make(chan bool)
+	sandboxBackends["scripted"] = func(boxID int, config conf.Config) Sandbox {
+		return fakebox.NewScripted(boxID, func(dir string, options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics) {
+			running <- dir
+			<-release
+			return isolate.IsolateRunOK, isolate.RunMetrics{}
+		})
+	}
+	defer delete(sandboxBackends, "scripted")
+	gc.Glob.Sandbox = "scripted"
+
+	submissionID := "test_shutdown"
+	srcDir := path.Join(BASE_SRC_PATH, submissionID)
+	err := os.MkdirAll(srcDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	defer os.RemoveAll(path.Join(BASE_TMP_PATH, submissionID))
+	err = ioutil.WriteFile(path.Join(srcDir, "main.cpp"), []byte(correctSolution), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan bool)
+	ch, _, stopped, _ := NewPrioritizedGradingJobQueue(1, done, gc)
+	compiled := make(chan compileResult, 1)
+	ch <- GradingJob{submissionID: submissionID, targLang: "cpp14", compile: &compileJob{exampleTaskID, srcDir, []string{"main.cpp"}, nil, compiled}}
+	boxDir := <-running
+
+	// The job that is running is finished before the worker stops
+	close(done)
+	select {
+	case <-stopped:
+		t.Fatal("Workers stopped while a job was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	<-compiled
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Workers did not stop")
+	}
+	if _, err := os.Stat(boxDir); !os.IsNotExist(err) {
+		t.Errorf("Box %s was not cleaned up", boxDir)
+	}
+}
+
+func TestGradingJobQueueAbort(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+
+	// The compiler runs until it is released, long after the queue is aborted
+	running := make(chan string)
+	release := make(chan bool)
+	sandboxBackends["scripted"] = func(boxID int, config conf.Config) Sandbox {
+		return fakebox.NewScripted(boxID, func(dir string, options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics) {
+			running <- dir
+			<-release
+			return isolate.IsolateRunOK, isolate.RunMetrics{}
+		})
+	}
+	defer delete(sandboxBackends, "scripted")
+	gc.Glob.Sandbox = "scripted"
+
+	submissionID := "test_abort"
+	srcDir := path.Join(BASE_SRC_PATH, submissionID)
+	err := os.MkdirAll(srcDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	defer os.RemoveAll(path.Join(BASE_TMP_PATH, submissionID))
+	err = ioutil.WriteFile(path.Join(srcDir, "main.cpp"), []byte(correctSolution), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan bool)
+	ch, _, _, abort := NewPrioritizedGradingJobQueue(1, done, gc)
+	compiled := make(chan compileResult, 1)
+	ch <- GradingJob{submissionID: submissionID, targLang: "cpp14", compile: &compileJob{exampleTaskID, srcDir, []string{"main.cpp"}, nil, compiled}}
+	boxDir := <-running
+
+	// The box in use is cleaned up without waiting for the job
+	abort()
+	if _, err := os.Stat(boxDir); !os.IsNotExist(err) {
+		t.Errorf("Box %s was not cleaned up", boxDir)
+	}
+	close(release)
+	<-compiled
+	close(done)
+}
+
+func TestAbortedSubmission(t *testing.T) {
+	gc, cleanup := newExampleConfig(t)
+	defer cleanup()
+	gc.Glob.StorePath = path.Join(gc.BasePath, "store")
+
+	// The compiler runs until it is released, long after the queue is aborted
+	running := make(chan bool)
+	release := make(chan bool)
+	sandboxBackends["scripted"] = func(boxID int, config conf.Config) Sandbox {
+		return fakebox.NewScripted(boxID, func(dir string, options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics) {
+			running <- true
+			<-release
+			return isolate.IsolateRunOK, isolate.RunMetrics{}
+		})
+	}
+	defer delete(sandboxBackends, "scripted")
+	gc.Glob.Sandbox = "scripted"
+
+	done := make(chan bool)
+	ch, _, _, abort := NewPrioritizedGradingJobQueue(1, done, gc)
+	defer close(done)
+	updates := make(chan api.SyncUpdate)
+	graded := make(chan error, 1)
+	go func() {
+		graded <- GradeSubmission("test_aborted", exampleTaskID, "cpp14", api.Source{Code: []string{correctSolution}}, time.Now(), ch, updates, gc)
+		close(updates)
+	}()
+	<-updates // Compiling
+	<-running
+	abort()
+	close(release)
+
+	// Nothing is sent or stored for the submission that was cut off
+	for update := range updates {
+		t.Errorf("Got update %+v after the queue was aborted", update)
+	}
+	if err := <-graded; err != ErrAborted {
+		t.Errorf("Got error %v, expected the judging to be aborted", err)
+	}
+	if _, err := ReadStoredSubmission("test_aborted", gc); err == nil {
+		t.Error("Judging of the aborted submission was stored")
+	}
+}
@@ -0,0 +1,210 @@
+package importer
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/grader"
+)
+
+// readCMSSubtasks reads the "# ST: <points>" markers of gen/GEN. Every other non-comment line, as
+// well as every "#COPY:" line, produces one test in order
+func readCMSSubtasks(report *Report, genPath string, tests []testCase, perTest bool) ([]testGroup, error) {
+	genFileBytes, err := ioutil.ReadFile(genPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read %s", genPath)
+	}
+
+	groups := make([]testGroup, 0)
+	numTests := 0
+	for _, line := range strings.Split(string(genFileBytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			directive := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+			if strings.HasPrefix(directive, "ST:") {
+				points, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(directive, "ST:")), 64)
+				if err != nil {
+					return nil, errors.Wrapf(err, "Invalid subtask line in %s: %s", genPath, line)
+				}
+				groups = append(groups, testGroup{
+					name:      strconv.Itoa(len(groups)),
+					fullScore: points,
+					perTest:   perTest,
+				})
+				continue
+			}
+			if !strings.HasPrefix(directive, "COPY:") {
+				continue
+			}
+		}
+		if numTests >= len(tests) {
+			return nil, errors.Errorf("%s describes more tests than n_input", genPath)
+		}
+		if len(groups) == 0 {
+			report.warnf("Tests before the first subtask in gen/GEN were put in a subtask worth 0 points")
+			groups = append(groups, testGroup{name: "0", perTest: perTest})
+		}
+		groups[len(groups)-1].tests = append(groups[len(groups)-1].tests, tests[numTests])
+		numTests++
+	}
+	if numTests != len(tests) {
+		return nil, errors.Errorf("%s describes %d tests but n_input is %d", genPath, numTests, len(tests))
+	}
+	return groups, nil
+}
+
+// installCMSChecker installs the checker from check/ (or cor/ in older packages) as a custom checker.
+// It returns the name of the checker to put in the manifest
+func installCMSChecker(report *Report, packagePath string, taskPath string) (string, error) {
+	for _, dir := range []string{"check", "cor"} {
+		for _, name := range []string{"manager", "manager.cpp", "stub.cpp"} {
+			if _, err := os.Stat(path.Join(packagePath, dir, name)); err == nil {
+				return "", errors.Errorf("%s/%s found: communication tasks cannot be represented", dir, name)
+			}
+		}
+	}
+	for _, candidate := range []string{"check/checker", "cor/correttore"} {
+		srcPath := path.Join(packagePath, candidate+".cpp")
+		if _, err := os.Stat(srcPath); err == nil {
+			err = installWrappedChecker(taskPath, []string{srcPath}, []string{path.Dir(srcPath)}, "cms_checker", cmsCheckerWrapper)
+			if err != nil {
+				return "", err
+			}
+			return "custom", nil
+		}
+		binPath := path.Join(packagePath, candidate)
+		if _, err := os.Stat(binPath); err == nil {
+			report.warnf("Checker %s has no source and was copied as a binary", candidate)
+			err = copyFile(binPath, path.Join(taskPath, "cms_checker"))
+			if err == nil {
+				err = os.Chmod(path.Join(taskPath, "cms_checker"), 0755)
+			}
+			if err == nil {
+				err = ioutil.WriteFile(path.Join(taskPath, "checker"), []byte(cmsCheckerWrapper), 0755)
+			}
+			if err != nil {
+				return "", errors.Wrap(err, "Cannot install checker")
+			}
+			return "custom", nil
+		}
+	}
+	// CMS compares outputs token by token when there is no checker
+	return "wcmp", nil
+}
+
+// ImportCMS converts the CMS (italy_yaml) task at packagePath into a new task with ID taskID.
+// If taskID is empty, the name in task.yaml is used
+func ImportCMS(packagePath string, taskID string, config conf.Config) (Report, error) {
+	report := Report{}
+
+	taskYAML, err := readYAMLFile(path.Join(packagePath, "task.yaml"))
+	if err != nil {
+		return report, err
+	}
+	if taskID == "" {
+		taskID, _ = yamlString(taskYAML, "name")
+	}
+	if taskID == "" {
+		return report, errors.New("Task ID not provided and task.yaml has no name")
+	}
+
+	numInputs, ok := yamlFloat(taskYAML, "n_input")
+	if !ok || numInputs < 1 {
+		return report, errors.New("task.yaml has no n_input")
+	}
+	timeLimit, ok := yamlFloat(taskYAML, "time_limit")
+	if !ok {
+		report.warnf("task.yaml has no time_limit: using 1 second")
+		timeLimit = 1
+	}
+	memoryLimit, ok := yamlFloat(taskYAML, "memory_limit")
+	if !ok {
+		report.warnf("task.yaml has no memory_limit: using 256 MB")
+		memoryLimit = 256
+	}
+	for _, key := range []string{"infile", "outfile"} {
+		if fileName, _ := yamlString(taskYAML, key); fileName != "" {
+			report.warnf("Task uses %s \"%s\", but the grader only supports standard input and output", key, fileName)
+		}
+	}
+	if outputOnly, _ := taskYAML["output_only"].(bool); outputOnly {
+		return report, errors.New("Output-only CMS tasks cannot be represented")
+	}
+
+	tests := make([]testCase, int(numInputs))
+	for i := range tests {
+		tests[i] = testCase{
+			inputPath:    path.Join(packagePath, "input", "input"+strconv.Itoa(i)+".txt"),
+			solutionPath: path.Join(packagePath, "output", "output"+strconv.Itoa(i)+".txt"),
+		}
+		for _, file := range []string{tests[i].inputPath, tests[i].solutionPath} {
+			if _, err := os.Stat(file); err != nil {
+				return report, errors.Wrapf(err, "Test %d is missing. Was the task generated?", i)
+			}
+		}
+	}
+
+	// GroupMin scores a subtask by its worst test and Sum by the sum of its tests
+	scoreType, _ := yamlString(taskYAML, "score_type")
+	perTest := false
+	switch scoreType {
+	case "", "GroupMin":
+	case "Sum":
+		perTest = true
+	default:
+		report.warnf("Score type %s is not supported: subtasks are scored by their worst test", scoreType)
+	}
+
+	var groups []testGroup
+	genPath := path.Join(packagePath, "gen", "GEN")
+	if _, err := os.Stat(genPath); err == nil {
+		groups, err = readCMSSubtasks(&report, genPath, tests, perTest)
+		if err != nil {
+			return report, err
+		}
+	} else {
+		groups = []testGroup{{name: "0", fullScore: 100, perTest: perTest, tests: tests}}
+	}
+	manifestGroups, tests, grouper, err := layoutGroups(&report, groups)
+	if err != nil {
+		return report, err
+	}
+
+	taskPath, err := createTaskDir(taskID, config)
+	if err != nil {
+		return report, err
+	}
+	err = func() error {
+		checker, err := installCMSChecker(&report, packagePath, taskPath)
+		if err != nil {
+			return err
+		}
+		manifest := grader.Manifest{
+			ID: taskID,
+			DefaultLimits: &grader.LangRunLimit{
+				TimeLimit:   timeLimit,
+				MemoryLimit: int(math.Ceil(memoryLimit)),
+			},
+			Limits:       map[string]grader.LangRunLimit{},
+			Groups:       manifestGroups,
+			CompileFiles: map[string][]string{},
+			Checker:      checker,
+			Grouper:      grouper,
+		}
+		return finishImport(&report, taskPath, manifest, tests)
+	}()
+	if err != nil {
+		os.RemoveAll(taskPath)
+		return report, err
+	}
+	return report, nil
+}
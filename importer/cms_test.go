@@ -0,0 +1,92 @@
+package importer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/grader"
+)
+
+// writePackage creates a package in a new base directory from a map of relative paths to contents
+func writePackage(t *testing.T, files map[string]string) (string, string) {
+	baseDir, err := ioutil.TempDir("", "grader_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packagePath := path.Join(baseDir, "package")
+	for name, contents := range files {
+		os.MkdirAll(path.Dir(path.Join(packagePath, name)), 0755)
+		ioutil.WriteFile(path.Join(packagePath, name), []byte(contents), 0644)
+	}
+	return baseDir, packagePath
+}
+
+func readImportedManifest(t *testing.T, baseDir string, taskID string) grader.Manifest {
+	manifestBytes, err := ioutil.ReadFile(path.Join(baseDir, "tasks", taskID, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := grader.Manifest{}
+	err = json.Unmarshal(manifestBytes, &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func TestImportCMS(t *testing.T) {
+	files := map[string]string{
+		"task.yaml": "name: sum\ntitle: \"Sum: the task\"\ntime_limit: 0.5\nmemory_limit: 128\nn_input: 5\ninfile: ''\noutfile: ''\nscore_type: GroupMin\n",
+		"gen/GEN":   "# ST: 40\n1 2\n#COPY: manual.txt\n\n# ST: 60\n# a comment\n3\n4\n5\n",
+	}
+	for i := 0; i < 5; i++ {
+		files["input/input"+strconv.Itoa(i)+".txt"] = strconv.Itoa(i)
+		files["output/output"+strconv.Itoa(i)+".txt"] = strconv.Itoa(i)
+	}
+	baseDir, packagePath := writePackage(t, files)
+	defer os.RemoveAll(baseDir)
+
+	report, err := Import("", packagePath, "", conf.Config{BasePath: baseDir})
+	if err != nil {
+		t.Fatal("Import failed: ", err)
+	}
+	if report.TaskID != "sum" || report.NumTests != 5 || len(report.Warnings) != 0 {
+		t.Errorf("Unexpected report %#v", report)
+	}
+
+	manifest := readImportedManifest(t, baseDir, "sum")
+	if manifest.Checker != "wcmp" || manifest.Grouper != "min" {
+		t.Errorf("Unexpected checker %s and grouper %s", manifest.Checker, manifest.Grouper)
+	}
+	if manifest.DefaultLimits.TimeLimit != 0.5 || manifest.DefaultLimits.MemoryLimit != 128 {
+		t.Errorf("Unexpected limits %#v", manifest.DefaultLimits)
+	}
+	if len(manifest.Groups) != 2 ||
+		manifest.Groups[0].FullScore != 40 || manifest.Groups[0].TestIndices != (grader.IndexRange{Start: 1, End: 2}) ||
+		manifest.Groups[1].FullScore != 60 || manifest.Groups[1].TestIndices != (grader.IndexRange{Start: 3, End: 5}) {
+		t.Errorf("Unexpected groups %#v", manifest.Groups)
+	}
+}
+
+func TestImportCMSCommunication(t *testing.T) {
+	baseDir, packagePath := writePackage(t, map[string]string{
+		"task.yaml":          "name: talk\nn_input: 1\n",
+		"input/input0.txt":   "",
+		"output/output0.txt": "",
+		"check/manager.cpp":  "",
+	})
+	defer os.RemoveAll(baseDir)
+
+	_, err := ImportCMS(packagePath, "", conf.Config{BasePath: baseDir})
+	if err == nil {
+		t.Error("Communication task was imported")
+	}
+	if _, err := os.Stat(path.Join(baseDir, "tasks", "talk")); !os.IsNotExist(err) {
+		t.Error("Failed import left a task directory behind")
+	}
+}
@@ -0,0 +1,456 @@
+package importer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/grader"
+	"github.com/programming-in-th/grader/util"
+)
+
+// Report describes the outcome of an import. Anything in the source package that could not be
+// represented exactly in the grader's task format is listed in Warnings
+type Report struct {
+	TaskID   string
+	NumTests int
+	Warnings []string
+}
+
+func (report *Report) warnf(format string, args ...interface{}) {
+	report.Warnings = append(report.Warnings, fmt.Sprintf(format, args...))
+}
+
+// importers maps each supported package format to its importer
+var importers = map[string]func(packagePath string, taskID string, config conf.Config) (Report, error){
+	"polygon": ImportPolygon,
+	"cms":     ImportCMS,
+	"kattis":  ImportKattis,
+}
+
+// descriptorFiles maps the file at the root of a package that identifies its format to that format
+var descriptorFiles = map[string]string{
+	"problem.xml":  "polygon",
+	"task.yaml":    "cms",
+	"problem.yaml": "kattis",
+}
+
+// DetectFormat guesses the format of the package at packagePath from the descriptor file at its root
+func DetectFormat(packagePath string) (string, error) {
+	for descriptor, format := range descriptorFiles {
+		if _, err := os.Stat(path.Join(packagePath, descriptor)); err == nil {
+			return format, nil
+		}
+	}
+	return "", errors.Errorf("Cannot detect format of package %s", packagePath)
+}
+
+// Import converts the package at packagePath into a new task with ID taskID. If format is empty, it
+// is detected from the package. If taskID is empty, the importer takes it from the package
+func Import(format string, packagePath string, taskID string, config conf.Config) (Report, error) {
+	if format == "" {
+		detected, err := DetectFormat(packagePath)
+		if err != nil {
+			return Report{}, err
+		}
+		format = detected
+	}
+	importer, exists := importers[format]
+	if !exists {
+		return Report{}, errors.Errorf("Unsupported package format %s", format)
+	}
+	return importer(packagePath, taskID, config)
+}
+
+// testCase is a pair of input and solution files taken from the source package
+type testCase struct {
+	inputPath    string
+	solutionPath string
+}
+
+// checkerWrappers adapt checkers written for other judges to the grader's checker protocol
+// (verdict, score and message on stdout). Each one runs the real checker, which is installed
+// next to it in the task directory, with the arguments the grader passes to "checker":
+// input, user's output and solution
+const (
+	// testlibCheckerWrapper wraps a testlib checker, which reports through its exit code
+	testlibCheckerWrapper = `#!/usr/bin/python3
+import os
+import subprocess
+import sys
+
+checker = os.path.join(os.path.dirname(os.path.abspath(__file__)), "testlib_checker")
+capture = subprocess.run([checker, sys.argv[1], sys.argv[2], sys.argv[3]],
+                         stdout=subprocess.PIPE,
+                         stderr=subprocess.PIPE)
+message = capture.stderr.decode("utf-8", "replace").strip().split("\n")[0]
+
+if capture.returncode == 0:
+    print("Correct")
+    print(100)
+elif capture.returncode in (1, 2, 4, 8):
+    print("Incorrect")
+    print(0)
+elif capture.returncode == 7:
+    # testlib prints "points <value> <message>" for quitp. The value is taken as the fraction of the
+    # test's score, so checkers that give points on another scale get Judge Error instead of a wrong score
+    try:
+        fraction = float(message.split()[1])
+    except (IndexError, ValueError):
+        fraction = -1
+    if 0 <= fraction <= 1:
+        print("Partially Correct")
+        print(fraction * 100)
+    else:
+        print("Judge Error")
+        print(0)
+else:
+    print("Judge Error")
+    print(0)
+print(message)
+`
+
+	// cmsCheckerWrapper wraps a CMS checker, which takes the solution before the user's output and
+	// prints a score between 0 and 1 on stdout and a message on stderr
+	cmsCheckerWrapper = `#!/usr/bin/python3
+import os
+import subprocess
+import sys
+
+checker = os.path.join(os.path.dirname(os.path.abspath(__file__)), "cms_checker")
+capture = subprocess.run([checker, sys.argv[1], sys.argv[3], sys.argv[2]],
+                         stdout=subprocess.PIPE,
+                         stderr=subprocess.PIPE)
+message = capture.stderr.decode("utf-8", "replace").strip().split("\n")[0]
+
+try:
+    score = float(capture.stdout.decode("utf-8").split()[0])
+except (IndexError, ValueError):
+    score = None
+
+if capture.returncode != 0 or score is None:
+    print("Judge Error")
+    print(0)
+elif score >= 1:
+    print("Correct")
+    print(100)
+elif score <= 0:
+    print("Incorrect")
+    print(0)
+else:
+    print("Partially Correct")
+    print(score * 100)
+print(message)
+`
+
+	// kattisCheckerWrapper wraps a Kattis output validator, which reads the user's output from stdin,
+	// exits with 42 to accept or 43 to reject and writes its feedback to a directory. The points in
+	// score.txt are scaled against the test's share of its group's points, read from kattisPointsFile.
+	// Without that file, as in pass-fail problems, score.txt is ignored
+	kattisCheckerWrapper = `#!/usr/bin/python3
+import os
+import shutil
+import subprocess
+import sys
+import tempfile
+
+validator = os.path.join(os.path.dirname(os.path.abspath(__file__)), "output_validator")
+points_path = os.path.join(os.path.dirname(os.path.abspath(__file__)), "output_validator_points")
+feedback_dir = tempfile.mkdtemp()
+with open(sys.argv[2], "r") as user_output:
+    capture = subprocess.run([validator, sys.argv[1], sys.argv[3], feedback_dir],
+                             stdin=user_output,
+                             stdout=subprocess.PIPE,
+                             stderr=subprocess.PIPE)
+
+
+def read_feedback(name):
+    feedback_path = os.path.join(feedback_dir, name)
+    if not os.path.exists(feedback_path):
+        return None
+    with open(feedback_path, "r") as f:
+        return f.read().strip()
+
+
+def max_points():
+    # Tests are named by their index in the inputs directory, starting at 1
+    test = os.path.splitext(os.path.basename(sys.argv[1]))[0]
+    with open(points_path, "r") as f:
+        return float(f.read().split()[int(test) - 1])
+
+
+message = (read_feedback("judgemessage.txt") or "").split("\n")[0]
+score = read_feedback("score.txt")
+shutil.rmtree(feedback_dir, ignore_errors=True)
+
+fraction = 1
+if capture.returncode == 42 and score is not None and os.path.exists(points_path):
+    try:
+        points = max_points()
+        fraction = float(score) / points if points > 0 else 1
+    except (IndexError, ValueError):
+        fraction = None
+
+if capture.returncode == 42 and fraction is None:
+    print("Judge Error")
+    print(0)
+elif capture.returncode == 42:
+    if fraction >= 1:
+        print("Correct")
+        print(100)
+    elif fraction <= 0:
+        print("Incorrect")
+        print(0)
+    else:
+        print("Partially Correct")
+        print(fraction * 100)
+elif capture.returncode == 43:
+    print("Incorrect")
+    print(0)
+else:
+    print("Judge Error")
+    print(0)
+print(message)
+`
+)
+
+func copyFile(srcPath string, dstPath string) error {
+	data, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot read %s", srcPath)
+	}
+	err = ioutil.WriteFile(dstPath, data, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot write %s", dstPath)
+	}
+	return nil
+}
+
+// createTaskDir creates an empty task directory with inputs and solutions subdirectories.
+// Importing never overwrites an existing task
+func createTaskDir(taskID string, config conf.Config) (string, error) {
+	taskPath := path.Join(config.BasePath, "tasks", taskID)
+	if _, err := os.Stat(taskPath); err == nil {
+		return "", errors.Errorf("Task directory %s already exists", taskPath)
+	}
+	for _, dir := range []string{"inputs", "solutions"} {
+		err := util.CreateDirIfNotExist(path.Join(taskPath, dir))
+		if err != nil {
+			return "", errors.Wrapf(err, "Cannot create task directory %s", taskPath)
+		}
+	}
+	return taskPath, nil
+}
+
+// writeTests copies tests into the task directory as 1.in, 1.sol, 2.in, 2.sol, etc.
+func writeTests(taskPath string, tests []testCase) error {
+	for i, test := range tests {
+		err := copyFile(test.inputPath, path.Join(taskPath, "inputs", strconv.Itoa(i+1)+".in"))
+		if err != nil {
+			return err
+		}
+		err = copyFile(test.solutionPath, path.Join(taskPath, "solutions", strconv.Itoa(i+1)+".sol"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultCheckerExists reports whether a checker with the given name is shipped in defaultCheckers
+func defaultCheckerExists(name string, config conf.Config) bool {
+	if name == "" || name == "custom" {
+		return false
+	}
+	for _, candidate := range []string{name, name + ".cpp"} {
+		if _, err := os.Stat(path.Join(config.BasePath, "config", "defaultCheckers", candidate)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// compileCpp compiles a C++ helper program (checker or validator) shipped with a package
+func compileCpp(srcPaths []string, binPath string, includeDirs []string) error {
+	args := []string{"--std=c++17", "-O2"}
+	for _, dir := range includeDirs {
+		args = append(args, "-I", dir)
+	}
+	args = append(args, srcPaths...)
+	args = append(args, "-o", binPath)
+	out, err := exec.Command("/usr/bin/c++", args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "Cannot compile %s: %s", strings.Join(srcPaths, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// installWrappedChecker compiles the sources of a foreign checker into the task directory as binName
+// and puts wrapper in front of it as the task's custom checker. The sources are kept for reference
+func installWrappedChecker(taskPath string, srcPaths []string, includeDirs []string, binName string, wrapper string) error {
+	keptSrcPaths := make([]string, len(srcPaths))
+	for i, srcPath := range srcPaths {
+		keptSrcPaths[i] = path.Join(taskPath, binName+"_"+path.Base(srcPath))
+		err := copyFile(srcPath, keptSrcPaths[i])
+		if err != nil {
+			return err
+		}
+	}
+	err := compileCpp(keptSrcPaths, path.Join(taskPath, binName), includeDirs)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(taskPath, "checker"), []byte(wrapper), 0755)
+	if err != nil {
+		return errors.Wrap(err, "Cannot write checker wrapper")
+	}
+	return nil
+}
+
+// validateTests compiles a testlib validator and runs it on every input. A validator that does not
+// compile is reported as a warning, but an input that fails validation aborts the import
+func validateTests(report *Report, srcPath string, includeDirs []string, tests []testCase) error {
+	tmpDir, err := ioutil.TempDir("", "grader_import")
+	if err != nil {
+		return errors.Wrap(err, "Cannot create tmp directory for validator")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	validatorPath := path.Join(tmpDir, "validator")
+	err = compileCpp([]string{srcPath}, validatorPath, includeDirs)
+	if err != nil {
+		report.warnf("Validator was not run: %v", err)
+		return nil
+	}
+	for i, test := range tests {
+		input, err := os.Open(test.inputPath)
+		if err != nil {
+			return errors.Wrapf(err, "Cannot open input %s", test.inputPath)
+		}
+		cmd := exec.Command(validatorPath)
+		cmd.Stdin = input
+		out, err := cmd.CombinedOutput()
+		input.Close()
+		if err != nil {
+			return errors.Errorf("Test %d (%s) failed validation: %s", i+1, test.inputPath, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// finishImport writes the tests and manifest of an imported task
+func finishImport(report *Report, taskPath string, manifest grader.Manifest, tests []testCase) error {
+	err := writeTests(taskPath, tests)
+	if err != nil {
+		return err
+	}
+	err = grader.WriteManifest(path.Join(taskPath, "manifest.json"), manifest)
+	if err != nil {
+		return err
+	}
+	report.TaskID = manifest.ID
+	report.NumTests = len(tests)
+	return nil
+}
+
+// testGroup is a group of tests as described by the source package, before being laid out
+// into the contiguous index ranges that the grader uses
+type testGroup struct {
+	name         string
+	fullScore    float64
+	perTest      bool // score is the average over tests instead of all-or-nothing
+	dependencies []string
+	tests        []testCase
+}
+
+// layoutGroups orders groups so that every group comes after its dependencies, renumbers tests
+// so that each group covers a contiguous range and picks a default grouper for the task
+func layoutGroups(report *Report, groups []testGroup) ([]grader.TestGroup, []testCase, string, error) {
+	// Empty groups cannot be represented as an index range
+	nonEmpty := make([]testGroup, 0, len(groups))
+	dropped := make(map[string]bool)
+	for _, group := range groups {
+		if len(group.tests) == 0 {
+			report.warnf("Group %s has no tests and was dropped", group.name)
+			dropped[group.name] = true
+			continue
+		}
+		nonEmpty = append(nonEmpty, group)
+	}
+
+	exists := make(map[string]bool)
+	for _, group := range nonEmpty {
+		exists[group.name] = true
+	}
+
+	// Stable topological sort: always place the earliest group whose dependencies are placed
+	newIndex := make(map[string]int)
+	placed := make([]bool, len(nonEmpty))
+	ordered := make([]testGroup, 0, len(nonEmpty))
+	for len(ordered) < len(nonEmpty) {
+		progress := false
+		for i, group := range nonEmpty {
+			if placed[i] {
+				continue
+			}
+			ready := true
+			for _, dependency := range group.dependencies {
+				if dropped[dependency] {
+					continue
+				}
+				if !exists[dependency] {
+					return nil, nil, "", errors.Errorf("Group %s depends on unknown group %s", group.name, dependency)
+				}
+				if _, ok := newIndex[dependency]; !ok {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				placed[i] = true
+				ordered = append(ordered, group)
+				newIndex[group.name] = len(ordered)
+				progress = true
+				break
+			}
+		}
+		if !progress {
+			return nil, nil, "", errors.New("Group dependencies contain a cycle")
+		}
+	}
+
+	manifestGroups := make([]grader.TestGroup, 0, len(ordered))
+	tests := make([]testCase, 0)
+	numPerTest := 0
+	for _, group := range ordered {
+		dependencies := make([]int, 0)
+		for _, dependency := range group.dependencies {
+			if !dropped[dependency] {
+				dependencies = append(dependencies, newIndex[dependency])
+			}
+		}
+		manifestGroups = append(manifestGroups, grader.TestGroup{
+			FullScore:    group.fullScore,
+			Dependencies: dependencies,
+			TestIndices:  grader.IndexRange{Start: len(tests) + 1, End: len(tests) + len(group.tests)},
+		})
+		tests = append(tests, group.tests...)
+		if group.perTest {
+			numPerTest++
+		}
+	}
+
+	grouper := "min"
+	if numPerTest == len(ordered) && numPerTest > 0 {
+		grouper = "avg"
+	} else if numPerTest > 0 {
+		report.warnf("%d of %d groups are scored per test, but a task has a single grouper: using min for all groups", numPerTest, len(ordered))
+	}
+	return manifestGroups, tests, grouper, nil
+}
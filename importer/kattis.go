@@ -0,0 +1,325 @@
+package importer
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/grader"
+)
+
+// readKattisTests lists the tests directly inside dir (pairs of .in and .ans files) in name order
+func readKattisTests(dir string) ([]testCase, error) {
+	inputPaths, err := filepath.Glob(path.Join(dir, "*.in"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cannot list tests in %s", dir)
+	}
+	sort.Strings(inputPaths)
+	tests := make([]testCase, 0, len(inputPaths))
+	for _, inputPath := range inputPaths {
+		solutionPath := strings.TrimSuffix(inputPath, ".in") + ".ans"
+		if _, err := os.Stat(solutionPath); err != nil {
+			return nil, errors.Wrapf(err, "Test %s has no answer file", inputPath)
+		}
+		tests = append(tests, testCase{inputPath, solutionPath})
+	}
+	return tests, nil
+}
+
+// readKattisTestsRecursive lists the tests in dir and all of its subdirectories in name order
+func readKattisTestsRecursive(dir string) ([]testCase, error) {
+	tests, err := readKattisTests(dir)
+	if err != nil {
+		return nil, err
+	}
+	subdirs, err := kattisSubdirectories(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, subdir := range subdirs {
+		subdirTests, err := readKattisTestsRecursive(subdir)
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, subdirTests...)
+	}
+	return tests, nil
+}
+
+func kattisSubdirectories(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "Cannot list %s", dir)
+	}
+	subdirs := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			subdirs = append(subdirs, path.Join(dir, entry.Name()))
+		}
+	}
+	return subdirs, nil
+}
+
+// kattisScoringGroup makes a group of tests from one directory of data/secret. Its score comes from
+// the range or accept_score in the directory's testdata.yaml
+func kattisScoringGroup(report *Report, dir string, name string, tests []testCase) (testGroup, error) {
+	group := testGroup{name: name, perTest: true, tests: tests}
+
+	testdataYAML := map[string]interface{}{}
+	testdataPath := path.Join(dir, "testdata.yaml")
+	if _, err := os.Stat(testdataPath); err == nil {
+		testdataYAML, err = readYAMLFile(testdataPath)
+		if err != nil {
+			return testGroup{}, err
+		}
+	}
+
+	acceptScore, ok := yamlFloat(testdataYAML, "accept_score")
+	if !ok {
+		acceptScore = 1
+	}
+	group.fullScore = acceptScore * float64(len(tests))
+	if scoreRange, ok := yamlString(testdataYAML, "range"); ok {
+		bounds := strings.Fields(scoreRange)
+		if len(bounds) == 2 {
+			if maxScore, err := strconv.ParseFloat(bounds[1], 64); err == nil {
+				group.fullScore = maxScore
+			}
+		}
+	}
+	if grading, ok := yamlString(testdataYAML, "grading"); ok && grading != "default" {
+		report.warnf("Group %s uses %s grading, which is not supported: scored as the sum of its tests", name, grading)
+	}
+	if aggregation, _ := yamlString(testdataYAML, "aggregation"); aggregation == "min" {
+		group.perTest = false
+	}
+	return group, nil
+}
+
+// kattisDefaultChecker picks the default checker closest to the default output validator with the given flags
+func kattisDefaultChecker(report *Report, validatorFlags string) string {
+	flags := strings.Fields(validatorFlags)
+	checker := "wcmp"
+	caseSensitive := false
+	for i := 0; i < len(flags); i++ {
+		switch flags[i] {
+		case "float_tolerance", "float_absolute_tolerance", "float_relative_tolerance":
+			if i+1 >= len(flags) {
+				continue
+			}
+			tolerance, err := strconv.ParseFloat(flags[i+1], 64)
+			i++
+			if err != nil {
+				continue
+			}
+			if tolerance <= 1e-9 {
+				checker = "rcmp9"
+			} else if tolerance <= 1e-6 {
+				checker = "rcmp6"
+			} else {
+				checker = "rcmp4"
+			}
+			report.warnf("Validator flag %s %v was mapped to checker %s", flags[i-1], tolerance, checker)
+		case "case_sensitive":
+			caseSensitive = true
+		case "space_change_sensitive":
+			if checker == "wcmp" {
+				checker = "fcmp"
+			}
+		default:
+			report.warnf("Validator flag %s is not supported", flags[i])
+		}
+	}
+	if !caseSensitive && checker != "rcmp4" && checker != "rcmp6" && checker != "rcmp9" {
+		report.warnf("Output is compared case-sensitively, while the Kattis default validator ignores case")
+	}
+	return checker
+}
+
+// installKattisOutputValidator compiles the C++ output validator in output_validators/ as a custom checker
+func installKattisOutputValidator(packagePath string, taskPath string) error {
+	validatorDirs, err := kattisSubdirectories(path.Join(packagePath, "output_validators"))
+	if err != nil {
+		return err
+	}
+	if len(validatorDirs) != 1 {
+		return errors.Errorf("Expected exactly one output validator, found %d", len(validatorDirs))
+	}
+	srcPaths := make([]string, 0)
+	for _, pattern := range []string{"*.cpp", "*.cc"} {
+		matches, _ := filepath.Glob(path.Join(validatorDirs[0], pattern))
+		srcPaths = append(srcPaths, matches...)
+	}
+	if len(srcPaths) == 0 {
+		return errors.Errorf("Output validator %s has no C++ sources: other languages cannot be represented", validatorDirs[0])
+	}
+	return installWrappedChecker(taskPath, srcPaths, []string{validatorDirs[0]}, "output_validator", kattisCheckerWrapper)
+}
+
+// kattisPointsFile is written next to the output validator of a scoring problem. It has the points each
+// test is worth, one per line in test order, which kattisCheckerWrapper scales score.txt against
+const kattisPointsFile = "output_validator_points"
+
+// writeKattisPoints writes kattisPointsFile for groups whose points are shared equally by their tests
+func writeKattisPoints(taskPath string, groups []grader.TestGroup) error {
+	lines := make([]string, 0)
+	for _, group := range groups {
+		numTests := group.TestIndices.End - group.TestIndices.Start + 1
+		for i := 0; i < numTests; i++ {
+			lines = append(lines, strconv.FormatFloat(group.FullScore/float64(numTests), 'g', -1, 64))
+		}
+	}
+	err := ioutil.WriteFile(path.Join(taskPath, kattisPointsFile), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot write %s", kattisPointsFile)
+	}
+	return nil
+}
+
+// ImportKattis converts the Kattis (ICPC) problem package at packagePath into a new task with ID taskID.
+// If taskID is empty, the name of the package directory is used
+func ImportKattis(packagePath string, taskID string, config conf.Config) (Report, error) {
+	report := Report{}
+
+	problemYAML, err := readYAMLFile(path.Join(packagePath, "problem.yaml"))
+	if err != nil {
+		return report, err
+	}
+	if taskID == "" {
+		taskID = path.Base(path.Clean(packagePath))
+	}
+
+	validation, ok := yamlString(problemYAML, "validation")
+	if !ok {
+		validation = "default"
+	}
+	if strings.Contains(validation, "interactive") {
+		return report, errors.New("Interactive problems cannot be represented")
+	}
+	problemType, _ := yamlString(problemYAML, "type")
+	scoring := problemType == "scoring" || strings.Contains(validation, "score")
+
+	limits := yamlMapping(problemYAML, "limits")
+	timeLimit, ok := yamlFloat(limits, "time_limit")
+	if !ok {
+		report.warnf("problem.yaml has no time limit (Kattis derives it from the solutions): using 1 second")
+		timeLimit = 1
+	}
+	memoryLimit, ok := yamlFloat(limits, "memory")
+	if !ok {
+		memoryLimit = 2048
+	}
+	unsupportedLimits := make([]string, 0)
+	for key := range limits {
+		if key != "time_limit" && key != "memory" {
+			unsupportedLimits = append(unsupportedLimits, key)
+		}
+	}
+	sort.Strings(unsupportedLimits)
+	for _, key := range unsupportedLimits {
+		report.warnf("Limit %s is not supported", key)
+	}
+
+	samples, err := readKattisTests(path.Join(packagePath, "data", "sample"))
+	if err != nil {
+		return report, err
+	}
+	secretPath := path.Join(packagePath, "data", "secret")
+	var groups []testGroup
+	if scoring {
+		// Samples are judged but worth nothing, and each directory in data/secret is a group
+		groups = append(groups, testGroup{name: "sample", perTest: true, tests: samples})
+		topLevel, err := readKattisTests(secretPath)
+		if err != nil {
+			return report, err
+		}
+		if len(topLevel) > 0 {
+			group, err := kattisScoringGroup(&report, secretPath, "secret", topLevel)
+			if err != nil {
+				return report, err
+			}
+			groups = append(groups, group)
+		}
+		subdirs, err := kattisSubdirectories(secretPath)
+		if err != nil {
+			return report, err
+		}
+		for _, subdir := range subdirs {
+			subdirTests, err := readKattisTestsRecursive(subdir)
+			if err != nil {
+				return report, err
+			}
+			group, err := kattisScoringGroup(&report, subdir, path.Base(subdir), subdirTests)
+			if err != nil {
+				return report, err
+			}
+			groups = append(groups, group)
+		}
+	} else {
+		// Pass-fail problems are accepted only if every test passes
+		secret, err := readKattisTestsRecursive(secretPath)
+		if err != nil {
+			return report, err
+		}
+		groups = []testGroup{{name: "all", fullScore: 100, tests: append(samples, secret...)}}
+	}
+	manifestGroups, tests, grouper, err := layoutGroups(&report, groups)
+	if err != nil {
+		return report, err
+	}
+	if len(tests) == 0 {
+		return report, errors.New("Package has no tests")
+	}
+
+	taskPath, err := createTaskDir(taskID, config)
+	if err != nil {
+		return report, err
+	}
+	err = func() error {
+		checker := "custom"
+		if strings.HasPrefix(validation, "custom") {
+			err := installKattisOutputValidator(packagePath, taskPath)
+			if err != nil {
+				return err
+			}
+			if scoring {
+				err = writeKattisPoints(taskPath, manifestGroups)
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			validatorFlags, _ := yamlString(problemYAML, "validator_flags")
+			checker = kattisDefaultChecker(&report, validatorFlags)
+		}
+
+		manifest := grader.Manifest{
+			ID: taskID,
+			DefaultLimits: &grader.LangRunLimit{
+				TimeLimit:   timeLimit,
+				MemoryLimit: int(math.Ceil(memoryLimit)),
+			},
+			Limits:       map[string]grader.LangRunLimit{},
+			Groups:       manifestGroups,
+			CompileFiles: map[string][]string{},
+			Checker:      checker,
+			Grouper:      grouper,
+		}
+		return finishImport(&report, taskPath, manifest, tests)
+	}()
+	if err != nil {
+		os.RemoveAll(taskPath)
+		return report, err
+	}
+	return report, nil
+}
@@ -0,0 +1,173 @@
+package importer
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/grader"
+)
+
+func TestImportKattis(t *testing.T) {
+	baseDir, packagePath := writePackage(t, map[string]string{
+		"problem.yaml": `# Problem configuration
+name: Scoring Problem
+type: scoring
+validator_flags: float_tolerance 1e-6
+limits:
+  time_limit: 2
+  memory: 512
+`,
+		"data/sample/1.in":                 "1",
+		"data/sample/1.ans":                "1",
+		"data/secret/group1/a.in":          "a",
+		"data/secret/group1/a.ans":         "a",
+		"data/secret/group1/testdata.yaml": "range: 0 25\n",
+		"data/secret/group2/b.in":          "b",
+		"data/secret/group2/b.ans":         "b",
+		"data/secret/group2/c.in":          "c",
+		"data/secret/group2/c.ans":         "c",
+		"data/secret/group2/testdata.yaml": "accept_score: 37.5\n",
+	})
+	defer os.RemoveAll(baseDir)
+
+	report, err := Import("", packagePath, "scoring", conf.Config{BasePath: baseDir})
+	if err != nil {
+		t.Fatal("Import failed: ", err)
+	}
+	if report.NumTests != 4 {
+		t.Errorf("Unexpected report %#v", report)
+	}
+
+	manifest := readImportedManifest(t, baseDir, "scoring")
+	if manifest.Checker != "rcmp6" || manifest.Grouper != "avg" {
+		t.Errorf("Unexpected checker %s and grouper %s", manifest.Checker, manifest.Grouper)
+	}
+	if manifest.DefaultLimits.TimeLimit != 2 || manifest.DefaultLimits.MemoryLimit != 512 {
+		t.Errorf("Unexpected limits %#v", manifest.DefaultLimits)
+	}
+	if len(manifest.Groups) != 3 ||
+		manifest.Groups[0].FullScore != 0 || manifest.Groups[0].TestIndices != (grader.IndexRange{Start: 1, End: 1}) ||
+		manifest.Groups[1].FullScore != 25 || manifest.Groups[1].TestIndices != (grader.IndexRange{Start: 2, End: 2}) ||
+		manifest.Groups[2].FullScore != 75 || manifest.Groups[2].TestIndices != (grader.IndexRange{Start: 3, End: 4}) {
+		t.Errorf("Unexpected groups %#v", manifest.Groups)
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	mapping, err := parseYAML([]byte(`
+name: "A # not a comment"
+keywords:
+- graphs
+- 'trees'
+score_type_parameters: [[30, 5], [70, "regex"]]
+description: |
+  first line
+  second line
+limits:
+    memory: 1024 # MB
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := yamlString(mapping, "name"); name != "A # not a comment" {
+		t.Errorf("Unexpected name %q", name)
+	}
+	if keywords, _ := mapping["keywords"].([]interface{}); len(keywords) != 2 || keywords[1] != "trees" {
+		t.Errorf("Unexpected keywords %#v", mapping["keywords"])
+	}
+	if parameters, _ := mapping["score_type_parameters"].([]interface{}); len(parameters) != 2 {
+		t.Errorf("Unexpected score type parameters %#v", mapping["score_type_parameters"])
+	}
+	if description, _ := yamlString(mapping, "description"); description != "first line\nsecond line" {
+		t.Errorf("Unexpected description %q", description)
+	}
+	if memory, _ := yamlFloat(yamlMapping(mapping, "limits"), "memory"); memory != 1024 {
+		t.Errorf("Unexpected memory limit %v", memory)
+	}
+
+	// Sequences of mappings are rejected instead of being read as strings
+	for _, document := range []string{"testcases:\n- name: x\n  score: 1\n", "testcases:\n-\n  name: x\n", "testcases:\n- 'a': 1\n"} {
+		if _, err := parseYAML([]byte(document)); err == nil || !strings.Contains(err.Error(), "unsupported YAML") {
+			t.Errorf("Got error %v for %q, expected unsupported YAML", err, document)
+		}
+	}
+	// Colons that do not separate a key are kept in scalars
+	mapping, err = parseYAML([]byte("urls:\n- http://example.com\n- 'a: b'\n- [x, 'y: z']\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urls, _ := mapping["urls"].([]interface{}); len(urls) != 3 || urls[0] != "http://example.com" || urls[1] != "a: b" {
+		t.Errorf("Unexpected URLs %#v", mapping["urls"])
+	}
+}
+
+// runCheckerWrapper installs wrapper in dir next to a stand-in for the checker it wraps, and returns its
+// verdict and score on the given test
+func runCheckerWrapper(t *testing.T, dir string, wrapper string, checkerName string, checker string, test int) (string, string) {
+	err := ioutil.WriteFile(path.Join(dir, "checker"), []byte(wrapper), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(dir, checkerName), []byte(checker), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputPath := path.Join(dir, strconv.Itoa(test)+".in")
+	err = ioutil.WriteFile(inputPath, []byte("1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command(path.Join(dir, "checker"), inputPath, inputPath, inputPath).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(output), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("Unexpected checker output %q", output)
+	}
+	return lines[0], lines[1]
+}
+
+func TestCheckerWrapperScores(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is needed to run the checker wrappers")
+	}
+	dir, err := ioutil.TempDir("", "wrapper_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// score.txt is in points, scaled against the test's share of its group
+	validator := "#!/bin/sh\necho 7.5 > \"$3/score.txt\"\nexit 42\n"
+	err = writeKattisPoints(dir, []grader.TestGroup{
+		{FullScore: 0, TestIndices: grader.IndexRange{Start: 1, End: 1}},
+		{FullScore: 30, TestIndices: grader.IndexRange{Start: 2, End: 3}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verdict, score := runCheckerWrapper(t, dir, kattisCheckerWrapper, "output_validator", validator, 2); verdict != "Partially Correct" || score != "50.0" {
+		t.Errorf("Got %s %s for 7.5 of 15 points", verdict, score)
+	}
+	if verdict, _ := runCheckerWrapper(t, dir, kattisCheckerWrapper, "output_validator", validator, 1); verdict != "Correct" {
+		t.Errorf("Got %s on a test worth no points", verdict)
+	}
+	if verdict, _ := runCheckerWrapper(t, dir, kattisCheckerWrapper, "output_validator", validator, 4); verdict != "Judge Error" {
+		t.Errorf("Got %s on a test without points", verdict)
+	}
+
+	// quitp gives a fraction of the test's score, and anything else is a judge error
+	for points, expected := range map[string]string{"0.25": "Partially Correct", "40": "Judge Error"} {
+		checker := "#!/bin/sh\necho \"points " + points + " ok\" >&2\nexit 7\n"
+		if verdict, _ := runCheckerWrapper(t, dir, testlibCheckerWrapper, "testlib_checker", checker, 1); verdict != expected {
+			t.Errorf("Got %s for quitp(%s), expected %s", verdict, points, expected)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package importer
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/grader"
+)
+
+/* POLYGON PACKAGE TYPES */
+
+type polygonFile struct {
+	Path string `xml:"path,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type polygonTest struct {
+	Method string  `xml:"method,attr"`
+	Group  string  `xml:"group,attr"`
+	Points float64 `xml:"points,attr"`
+	Sample bool    `xml:"sample,attr"`
+}
+
+type polygonDependency struct {
+	Group string `xml:"group,attr"`
+}
+
+type polygonGroup struct {
+	Name         string              `xml:"name,attr"`
+	Points       *float64            `xml:"points,attr"`
+	PointsPolicy string              `xml:"points-policy,attr"`
+	Dependencies []polygonDependency `xml:"dependencies>dependency"`
+}
+
+type polygonTestset struct {
+	Name              string         `xml:"name,attr"`
+	TimeLimit         int            `xml:"time-limit"`   // milliseconds
+	MemoryLimit       int64          `xml:"memory-limit"` // bytes
+	TestCount         int            `xml:"test-count"`
+	InputPathPattern  string         `xml:"input-path-pattern"`
+	AnswerPathPattern string         `xml:"answer-path-pattern"`
+	Tests             []polygonTest  `xml:"tests>test"`
+	Groups            []polygonGroup `xml:"groups>group"`
+}
+
+type polygonChecker struct {
+	Name   string      `xml:"name,attr"`
+	Type   string      `xml:"type,attr"`
+	Source polygonFile `xml:"source"`
+}
+
+type polygonValidator struct {
+	Source polygonFile `xml:"source"`
+}
+
+// polygonProblem is a type binding for problem.xml at the root of a Polygon package
+type polygonProblem struct {
+	ShortName  string             `xml:"short-name,attr"`
+	Testsets   []polygonTestset   `xml:"judging>testset"`
+	Checker    polygonChecker     `xml:"assets>checker"`
+	Validators []polygonValidator `xml:"assets>validators>validator"`
+}
+
+func readPolygonProblem(problemXMLPath string) (polygonProblem, error) {
+	problemFileBytes, err := ioutil.ReadFile(problemXMLPath)
+	if err != nil {
+		return polygonProblem{}, errors.Wrapf(err, "Failed to read problem.xml at %s", problemXMLPath)
+	}
+	var problem polygonProblem
+	err = xml.Unmarshal(problemFileBytes, &problem)
+	if err != nil {
+		return polygonProblem{}, errors.Wrapf(err, "Failed to unmarshal problem.xml at %s", problemXMLPath)
+	}
+	return problem, nil
+}
+
+// polygonTestsetToGroups splits the tests of a testset into groups in the order they are declared
+func polygonTestsetToGroups(report *Report, packagePath string, testset polygonTestset) ([]testGroup, error) {
+	groups := make([]testGroup, 0)
+	groupIndex := make(map[string]int)
+	for _, group := range testset.Groups {
+		currGroup := testGroup{
+			name:    group.Name,
+			perTest: group.PointsPolicy == "each-test",
+		}
+		if group.Points != nil {
+			currGroup.fullScore = *group.Points
+		}
+		for _, dependency := range group.Dependencies {
+			currGroup.dependencies = append(currGroup.dependencies, dependency.Group)
+		}
+		groupIndex[group.Name] = len(groups)
+		groups = append(groups, currGroup)
+	}
+
+	testPoints := make([]float64, len(groups))
+	for i, test := range testset.Tests {
+		inputPath := path.Join(packagePath, fmt.Sprintf(testset.InputPathPattern, i+1))
+		solutionPath := path.Join(packagePath, fmt.Sprintf(testset.AnswerPathPattern, i+1))
+		if _, err := os.Stat(inputPath); err != nil {
+			return nil, errors.Wrapf(err, "Input of test %d not found. Was the package built with tests?", i+1)
+		}
+		if _, err := os.Stat(solutionPath); err != nil {
+			return nil, errors.Wrapf(err, "Answer of test %d not found. Run doall.sh in the package first", i+1)
+		}
+
+		// Tests without a declared group go into an implicit group named after their group attribute
+		if _, exists := groupIndex[test.Group]; !exists {
+			if len(testset.Groups) > 0 {
+				report.warnf("Test %d belongs to undeclared group \"%s\"", i+1, test.Group)
+			}
+			groupIndex[test.Group] = len(groups)
+			groups = append(groups, testGroup{name: test.Group, perTest: true})
+			testPoints = append(testPoints, 0)
+		}
+		j := groupIndex[test.Group]
+		groups[j].tests = append(groups[j].tests, testCase{inputPath, solutionPath})
+		testPoints[j] += test.Points
+	}
+
+	for i := range groups {
+		if i < len(testset.Groups) && testset.Groups[i].Points != nil {
+			if groups[i].perTest && testPoints[i] != 0 && testPoints[i] != groups[i].fullScore {
+				report.warnf("Group %s has %v points but its tests sum to %v", groups[i].name, groups[i].fullScore, testPoints[i])
+			}
+			continue
+		}
+		groups[i].fullScore = testPoints[i]
+	}
+
+	// Without groups or points, the whole testset is a single all-or-nothing group worth 100
+	if len(groups) == 1 && groups[0].fullScore == 0 {
+		groups[0].fullScore = 100
+		groups[0].perTest = false
+		report.warnf("Problem has no points: judging all tests as one group worth 100")
+	}
+	return groups, nil
+}
+
+// ImportPolygon converts the Polygon package at packagePath into a new task with ID taskID.
+// If taskID is empty, the short name of the problem is used
+func ImportPolygon(packagePath string, taskID string, config conf.Config) (Report, error) {
+	report := Report{}
+
+	problem, err := readPolygonProblem(path.Join(packagePath, "problem.xml"))
+	if err != nil {
+		return report, err
+	}
+	if taskID == "" {
+		taskID = problem.ShortName
+	}
+	if taskID == "" {
+		return report, errors.New("Task ID not provided and problem.xml has no short name")
+	}
+
+	// Judge with the "tests" testset, which is the one Polygon uses for final judging
+	if len(problem.Testsets) == 0 {
+		return report, errors.New("problem.xml has no testsets")
+	}
+	testset := problem.Testsets[0]
+	for _, candidate := range problem.Testsets {
+		if candidate.Name == "tests" {
+			testset = candidate
+			break
+		}
+	}
+	if len(problem.Testsets) > 1 {
+		report.warnf("Only testset \"%s\" was imported", testset.Name)
+	}
+	if len(testset.Tests) != testset.TestCount {
+		return report, errors.Errorf("Testset declares %d tests but lists %d", testset.TestCount, len(testset.Tests))
+	}
+
+	groups, err := polygonTestsetToGroups(&report, packagePath, testset)
+	if err != nil {
+		return report, err
+	}
+	manifestGroups, tests, grouper, err := layoutGroups(&report, groups)
+	if err != nil {
+		return report, err
+	}
+
+	taskPath, err := createTaskDir(taskID, config)
+	if err != nil {
+		return report, err
+	}
+	err = func() error {
+		// testlib.h is usually shipped in files/ next to the checker and validator sources
+		includeDirs := []string{path.Join(packagePath, "files")}
+
+		for _, validator := range problem.Validators {
+			err := validateTests(&report, path.Join(packagePath, validator.Source.Path), includeDirs, tests)
+			if err != nil {
+				return err
+			}
+		}
+
+		checker := strings.TrimSuffix(strings.TrimPrefix(problem.Checker.Name, "std::"), ".cpp")
+		if !strings.HasPrefix(problem.Checker.Name, "std::") || !defaultCheckerExists(checker, config) {
+			if problem.Checker.Source.Path == "" {
+				return errors.New("problem.xml has no checker source")
+			}
+			err := installWrappedChecker(taskPath,
+				[]string{path.Join(packagePath, problem.Checker.Source.Path)},
+				append(includeDirs, path.Join(config.BasePath, "config", "defaultCheckers")),
+				"testlib_checker",
+				testlibCheckerWrapper)
+			if err != nil {
+				return err
+			}
+			checker = "custom"
+		}
+
+		manifest := grader.Manifest{
+			ID: taskID,
+			DefaultLimits: &grader.LangRunLimit{
+				TimeLimit:   float64(testset.TimeLimit) / 1000,
+				MemoryLimit: int(math.Ceil(float64(testset.MemoryLimit) / 1024 / 1024)),
+			},
+			Limits:       map[string]grader.LangRunLimit{},
+			Groups:       manifestGroups,
+			CompileFiles: map[string][]string{},
+			Checker:      checker,
+			Grouper:      grouper,
+		}
+		return finishImport(&report, taskPath, manifest, tests)
+	}()
+	if err != nil {
+		os.RemoveAll(taskPath)
+		return report, err
+	}
+	return report, nil
+}
@@ -0,0 +1,107 @@
+package importer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/programming-in-th/grader/conf"
+	"github.com/programming-in-th/grader/grader"
+)
+
+const testProblemXML = `<?xml version="1.0" encoding="utf-8" standalone="no"?>
+<problem revision="3" short-name="a-plus-b">
+  <judging>
+    <testset name="tests">
+      <time-limit>1500</time-limit>
+      <memory-limit>268435456</memory-limit>
+      <test-count>4</test-count>
+      <input-path-pattern>tests/%02d</input-path-pattern>
+      <answer-path-pattern>tests/%02d.a</answer-path-pattern>
+      <tests>
+        <test method="manual" group="2"/>
+        <test method="manual" group="1" sample="true"/>
+        <test method="generated" group="2"/>
+        <test method="generated" group="1"/>
+      </tests>
+      <groups>
+        <group name="2" points="70" points-policy="complete-group">
+          <dependencies>
+            <dependency group="1"/>
+          </dependencies>
+        </group>
+        <group name="1" points="30" points-policy="complete-group"/>
+      </groups>
+    </testset>
+  </judging>
+  <assets>
+    <checker name="std::lcmp.cpp" type="testlib">
+      <source path="files/check.cpp" type="cpp.g++17"/>
+    </checker>
+  </assets>
+</problem>
+`
+
+func TestImportPolygon(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "grader_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+
+	packagePath := path.Join(baseDir, "package")
+	os.MkdirAll(path.Join(packagePath, "tests"), 0755)
+	os.MkdirAll(path.Join(baseDir, "config", "defaultCheckers"), 0755)
+	ioutil.WriteFile(path.Join(baseDir, "config", "defaultCheckers", "lcmp"), nil, 0755)
+	ioutil.WriteFile(path.Join(packagePath, "problem.xml"), []byte(testProblemXML), 0644)
+	for i, name := range []string{"01", "02", "03", "04"} {
+		ioutil.WriteFile(path.Join(packagePath, "tests", name), []byte{byte('a' + i)}, 0644)
+		ioutil.WriteFile(path.Join(packagePath, "tests", name+".a"), []byte{byte('A' + i)}, 0644)
+	}
+
+	config := conf.Config{BasePath: baseDir}
+	report, err := ImportPolygon(packagePath, "", config)
+	if err != nil {
+		t.Fatal("Import failed: ", err)
+	}
+	if report.TaskID != "a-plus-b" || report.NumTests != 4 {
+		t.Errorf("Unexpected report %#v", report)
+	}
+
+	taskPath := path.Join(baseDir, "tasks", "a-plus-b")
+	manifestBytes, err := ioutil.ReadFile(path.Join(taskPath, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(string(manifestBytes))
+
+	// Group 1 must be moved before group 2, which depends on it
+	expectedInputs := []string{"b", "d", "a", "c"}
+	for i, expected := range expectedInputs {
+		data, _ := ioutil.ReadFile(path.Join(taskPath, "inputs", strconv.Itoa(i+1)+".in"))
+		if string(data) != expected {
+			t.Errorf("Input %d is %q, expected %q", i+1, data, expected)
+		}
+	}
+
+	manifest := grader.Manifest{}
+	err = json.Unmarshal(manifestBytes, &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Checker != "lcmp" || manifest.Grouper != "min" {
+		t.Errorf("Unexpected checker %s and grouper %s", manifest.Checker, manifest.Grouper)
+	}
+	if manifest.DefaultLimits.TimeLimit != 1.5 || manifest.DefaultLimits.MemoryLimit != 256 {
+		t.Errorf("Unexpected limits %#v", manifest.DefaultLimits)
+	}
+	if len(manifest.Groups) != 2 ||
+		manifest.Groups[0].FullScore != 30 || manifest.Groups[0].TestIndices != (grader.IndexRange{Start: 1, End: 2}) ||
+		manifest.Groups[1].FullScore != 70 || manifest.Groups[1].TestIndices != (grader.IndexRange{Start: 3, End: 4}) ||
+		len(manifest.Groups[1].Dependencies) != 1 || manifest.Groups[1].Dependencies[0] != 1 {
+		t.Errorf("Unexpected groups %#v", manifest.Groups)
+	}
+}
@@ -0,0 +1,259 @@
+package importer
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The package formats below describe problems in YAML. Only the subset of YAML that these files
+// use in practice is supported: nested mappings, block sequences of scalars, flow sequences,
+// block scalars (| and >) and plain, single- or double-quoted scalars. Numbers are parsed as
+// float64 and booleans as bool, everything else is a string. Sequences of mappings are rejected
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+func stripYAMLComment(line string) string {
+	inSingle, inDouble := false, false
+	for i, c := range line {
+		switch {
+		case c == '\'' && !inDouble:
+			inSingle = !inSingle
+		case c == '"' && !inSingle:
+			inDouble = !inDouble
+		case c == '#' && !inSingle && !inDouble && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func splitYAMLLines(data []byte) []yamlLine {
+	lines := make([]yamlLine, 0)
+	for i, raw := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		text := strings.TrimRight(stripYAMLComment(raw), " \t")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" || trimmed == "..." {
+			continue
+		}
+		lines = append(lines, yamlLine{i + 1, len(text) - len(trimmed), trimmed})
+	}
+	return lines
+}
+
+// splitYAMLFlow splits the inside of a flow sequence on top-level commas
+func splitYAMLFlow(inner string) []string {
+	parts := make([]string, 0)
+	depth := 0
+	inSingle, inDouble := false, false
+	start := 0
+	for i, c := range inner {
+		switch {
+		case c == '\'' && !inDouble:
+			inSingle = !inSingle
+		case c == '"' && !inSingle:
+			inDouble = !inDouble
+		case inSingle || inDouble:
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, strings.TrimSpace(inner[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(inner[start:]); last != "" {
+		parts = append(parts, last)
+	}
+	return parts
+}
+
+// isYAMLMappingEntry reports whether text is a "key: value" or "key:" entry rather than a scalar
+func isYAMLMappingEntry(text string) bool {
+	inSingle, inDouble := false, false
+	depth := 0
+	for i, c := range text {
+		switch {
+		case c == '\'' && !inDouble:
+			inSingle = !inSingle
+		case c == '"' && !inSingle:
+			inDouble = !inDouble
+		case inSingle || inDouble:
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ':' && depth == 0 && (i+1 == len(text) || text[i+1] == ' '):
+			return true
+		}
+	}
+	return false
+}
+
+func parseYAMLScalar(text string) (interface{}, error) {
+	text = strings.TrimSpace(text)
+	switch {
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, errors.Errorf("Unterminated flow sequence %s", text)
+		}
+		items := make([]interface{}, 0)
+		for _, part := range splitYAMLFlow(text[1 : len(text)-1]) {
+			item, err := parseYAMLScalar(part)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case strings.HasPrefix(text, "{"):
+		return nil, errors.New("Flow mappings are not supported")
+	case len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"':
+		unquoted, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid double-quoted string %s", text)
+		}
+		return unquoted, nil
+	case len(text) >= 2 && text[0] == '\'' && text[len(text)-1] == '\'':
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+	switch strings.ToLower(text) {
+	case "true", "yes":
+		return true, nil
+	case "false", "no":
+		return false, nil
+	case "null", "~":
+		return nil, nil
+	}
+	if number, err := strconv.ParseFloat(text, 64); err == nil {
+		return number, nil
+	}
+	return text, nil
+}
+
+// parseYAMLBlockScalar reads the lines of a | or > scalar, which are all indented more than indent
+func parseYAMLBlockScalar(lines []yamlLine, i int, indent int, folded bool) (string, int) {
+	parts := make([]string, 0)
+	for ; i < len(lines) && lines[i].indent > indent; i++ {
+		parts = append(parts, lines[i].text)
+	}
+	if folded {
+		return strings.Join(parts, " "), i
+	}
+	return strings.Join(parts, "\n"), i
+}
+
+// parseYAMLBlock parses the mapping or sequence whose lines start at lines[i] with the given indent
+func parseYAMLBlock(lines []yamlLine, i int, indent int) (interface{}, int, error) {
+	if strings.HasPrefix(lines[i].text, "- ") || lines[i].text == "-" {
+		items := make([]interface{}, 0)
+		for ; i < len(lines) && lines[i].indent == indent && strings.HasPrefix(lines[i].text, "-"); i++ {
+			text := strings.TrimSpace(strings.TrimPrefix(lines[i].text, "-"))
+			if isYAMLMappingEntry(text) || (i+1 < len(lines) && lines[i+1].indent > indent) {
+				return nil, i, errors.Errorf("Line %d: unsupported YAML: sequences of mappings are not supported", lines[i].number)
+			}
+			item, err := parseYAMLScalar(text)
+			if err != nil {
+				return nil, i, errors.Wrapf(err, "Line %d", lines[i].number)
+			}
+			items = append(items, item)
+		}
+		return items, i, nil
+	}
+
+	mapping := make(map[string]interface{})
+	for i < len(lines) && lines[i].indent == indent {
+		line := lines[i]
+		separator := strings.Index(line.text, ":")
+		if separator == -1 || (separator+1 < len(line.text) && line.text[separator+1] != ' ') {
+			return nil, i, errors.Errorf("Line %d: expected \"key: value\"", line.number)
+		}
+		key := strings.Trim(strings.TrimSpace(line.text[:separator]), "\"'")
+		rawValue := strings.TrimSpace(line.text[separator+1:])
+		i++
+
+		var value interface{}
+		var err error
+		switch {
+		case rawValue == "|" || rawValue == ">" || rawValue == "|-" || rawValue == ">-":
+			value, i = parseYAMLBlockScalar(lines, i, indent, rawValue[0] == '>')
+		case rawValue != "":
+			value, err = parseYAMLScalar(rawValue)
+			if err != nil {
+				return nil, i, errors.Wrapf(err, "Line %d", line.number)
+			}
+		case i < len(lines) && lines[i].indent > indent:
+			value, i, err = parseYAMLBlock(lines, i, lines[i].indent)
+			if err != nil {
+				return nil, i, err
+			}
+		case i < len(lines) && lines[i].indent == indent && strings.HasPrefix(lines[i].text, "-"):
+			// Sequences are allowed at the same indentation as their key
+			value, i, err = parseYAMLBlock(lines, i, indent)
+			if err != nil {
+				return nil, i, err
+			}
+		}
+		mapping[key] = value
+	}
+	if i < len(lines) && lines[i].indent > indent {
+		return nil, i, errors.Errorf("Line %d: unexpected indentation", lines[i].number)
+	}
+	return mapping, i, nil
+}
+
+func parseYAML(data []byte) (map[string]interface{}, error) {
+	lines := splitYAMLLines(data)
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	value, i, err := parseYAMLBlock(lines, 0, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if i < len(lines) {
+		return nil, errors.Errorf("Line %d: unexpected content", lines[i].number)
+	}
+	mapping, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Top level of YAML document is not a mapping")
+	}
+	return mapping, nil
+}
+
+func readYAMLFile(yamlPath string) (map[string]interface{}, error) {
+	yamlFileBytes, err := ioutil.ReadFile(yamlPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read %s", yamlPath)
+	}
+	mapping, err := parseYAML(yamlFileBytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse %s", yamlPath)
+	}
+	return mapping, nil
+}
+
+func yamlString(mapping map[string]interface{}, key string) (string, bool) {
+	value, ok := mapping[key].(string)
+	return value, ok
+}
+
+func yamlFloat(mapping map[string]interface{}, key string) (float64, bool) {
+	value, ok := mapping[key].(float64)
+	return value, ok
+}
+
+func yamlMapping(mapping map[string]interface{}, key string) map[string]interface{} {
+	value, ok := mapping[key].(map[string]interface{})
+	if !ok {
+		return map[string]interface{}{}
+	}
+	return value
+}
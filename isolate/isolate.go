@@ -1,7 +1,6 @@
 package isolate
 
 import (
-	"io/ioutil"
 	"log"
 	"math"
 	"os"
@@ -13,26 +12,53 @@ import (
 	"syscall"
 
 	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/util"
 )
 
 /*----------------------TYPE DECLARATIONS----------------------*/
 
 // Instance defines an instance of an isolate lifecycle from initialization to cleanup.
 type Instance struct {
-	isolateExecPath        string
-	boxID                  int
-	userProgramPath        string
-	ioMode                 int    // 0 = user's program already handles file IO, 1 = script needs to redirect IO
-	logFile                string // Can be both absolute and relative path
-	timeLimit              float64
-	extraTime              float64 // Extra time allowed before kill
-	memoryLimit            int
-	isolateDirectory       string // Box directory of isolate. Must only be set through IsolateInit()
-	isolateInputName       string // Relative to box directory and must be within box directory as per isolate specs
-	isolateOutputName      string // Relative to box directory and must be within box directory as per isolate specs
-	resultOutputTargetPath string // Target path of output file after copying out of box directory
-	inputPath              string // Path to input file from test case
-	runnerScriptPath       string // Path to runner script
+	isolateExecPath  string
+	boxID            int
+	logFile          string // Can be both absolute and relative path
+	quota            Quota
+	isolateDirectory string // Box directory of isolate. Must only be set through Init()
+}
+
+// Quota limits the disk space and number of files the program may create in a box. A zero Quota is unlimited
+type Quota struct {
+	Blocks int // Disk space in KiB
+	Inodes int // Number of files and directories
+}
+
+// RunOptions are the limits, standard streams and environment of a single run inside a box
+type RunOptions struct {
+	TimeLimit   float64 // CPU time limit in seconds
+	ExtraTime   float64 // Extra time allowed before kill
+	MemoryLimit int     // In KiB
+	Stdin       string  // Name of the file in the box to use as stdin. Left unredirected if empty
+	Stdout      string  // Name of the file in the box to write stdout to. Left unredirected if empty
+	Stderr      string  // Name of the file in the box to write stderr to. Left unredirected if empty
+	OutputLimit int     // Largest file the program may write, in KiB. Unlimited if 0
+
+	StderrToStdout bool     // Write stderr to the same file as stdout instead of Stderr
+	Env            []string // Extra environment variables, as KEY=VALUE
+	Directories    []string // Extra host directories the program can read, at the same paths
+	MaxProcesses   int      // Processes and threads the program may run at once. Defaults to DefaultMaxProcesses
+	StackLimit     int      // In KiB. Only limited by the memory limit if 0
+	WallTime       float64  // Wall clock limit in seconds. Defaults to TimeLimit + 5
+}
+
+// DefaultMaxProcesses only allows the program itself. Languages that need more, such as Java, set MaxProcesses
+const DefaultMaxProcesses = 1
+
+// WallClockLimit returns the wall clock time in seconds the program may run before it is killed
+func (options RunOptions) WallClockLimit() float64 {
+	if options.WallTime > 0 {
+		return options.WallTime
+	}
+	return options.TimeLimit + 5 // Five extra seconds for wall clock
 }
 
 // RunVerdict denotes possible states after isolate run
@@ -47,56 +73,44 @@ const (
 	IsolateRunMLE RunVerdict = "MLE"
 	// IsolateRunRE = Runtime error (any runtime error that is not MLE, including asserting false, invalid memory access, etc)
 	IsolateRunRE RunVerdict = "RE"
+	// IsolateRunILE = Wall clock time limit exceeded without exceeding the CPU time limit (sleeping or waiting for input)
+	IsolateRunILE RunVerdict = "ILE"
+	// IsolateRunOLE = Output limit exceeded (the program was killed for exceeding the file size limit)
+	IsolateRunOLE RunVerdict = "OLE"
+	// IsolateRunSV = Security violation (the program was killed for a forbidden operation)
+	IsolateRunSV RunVerdict = "SV"
 	// IsolateRunXX = Internal error of isolate
 	IsolateRunXX RunVerdict = "XX"
 	// IsolateRunOther = Placeholder in case something went wrong in this script
 	IsolateRunOther RunVerdict = "??"
 )
 
-// RunMetrics contains info on time and memory usage after running isolate
+// RunMetrics contains info on time and memory usage and on how the program ended after running isolate
 type RunMetrics struct {
 	TimeElapsed int
 	MemoryUsage int
+	ExitCode    int  // Exit code of the program if it exited by itself
+	ExitSignal  int  // Signal that terminated the program, or 0 if it exited by itself
+	Killed      bool // Whether the sandbox killed the program for exceeding a limit
 }
 
-/*----------------------END TYPE DECLARATIONS----------------------*/
-
-// NewInstance creates a new Instance
-func NewInstance(
-	isolateExecPath string,
-	boxID int,
-	execFile string,
-	ioMode int,
-	logFile string,
-	timeLimit float64,
-	extraTime float64,
-	memoryLimit int,
-	resultOutputFile string,
-	inputFile string,
-	runnerScriptPath string) *Instance {
+// quotaBlockSize is the block size of the filesystem of the boxes in KiB, assumed to be the usual 4 KiB
+const quotaBlockSize = 4
 
-	timeLimit = math.Round(timeLimit*1000) / 1000
-	extraTime = math.Round(extraTime*1000) / 1000
+/*----------------------END TYPE DECLARATIONS----------------------*/
 
+// NewInstance creates a new Instance. The quota needs disk quotas to be enabled on the filesystem of the boxes
+func NewInstance(isolateExecPath string, boxID int, logFile string, quota Quota) *Instance {
 	return &Instance{
-		isolateExecPath:        isolateExecPath,
-		boxID:                  boxID,
-		userProgramPath:        strings.TrimSpace(execFile),
-		ioMode:                 ioMode,
-		logFile:                strings.TrimSpace(logFile),
-		timeLimit:              timeLimit,
-		extraTime:              extraTime,
-		memoryLimit:            memoryLimit,
-		isolateInputName:       "input",
-		isolateOutputName:      "output",
-		resultOutputTargetPath: strings.TrimSpace(resultOutputFile),
-		inputPath:              strings.TrimSpace(inputFile),
-		runnerScriptPath:       strings.TrimSpace(runnerScriptPath),
+		isolateExecPath: isolateExecPath,
+		boxID:           boxID,
+		logFile:         strings.TrimSpace(logFile),
+		quota:           quota,
 	}
 }
 
 // Init initializes the new box directory for the Instance
-func (instance *Instance) Init() error { // returns true if finished OK, otherwise returns false
+func (instance *Instance) Init() error {
 	// Isolate needs to be run as root
 	isRoot, err := checkRootPermissions()
 	if err != nil {
@@ -107,26 +121,46 @@ func (instance *Instance) Init() error { // returns true if finished OK, otherwi
 	}
 
 	// Run init command
-	bytes, err := exec.Command(instance.isolateExecPath, "--cg", "-b", strconv.Itoa(instance.boxID), "--init").Output()
+	args := []string{"--cg", "-b", strconv.Itoa(instance.boxID)}
+	if instance.quota != (Quota{}) {
+		args = append(args, "--quota="+strconv.Itoa(instance.quota.Blocks)+","+strconv.Itoa(instance.quota.Inodes))
+	}
+	bytes, err := exec.Command(instance.isolateExecPath, append(args, "--init")...).Output()
 	outputString := strings.TrimSpace(string(bytes))
 	instance.isolateDirectory = path.Join(outputString, "box")
 	if err != nil {
 		return errors.Wrapf(err, "Unable to run isolate --init command. Does a box already exist? If so, you must clean up first.")
 	}
+	return nil
+}
 
-	// Copy input, output and executable files to isolate directory
-	// TODO: validate nonexistent input file
-	err = exec.Command("cp", instance.inputPath, path.Join(instance.isolateDirectory, instance.isolateInputName)).Run()
+// CopyIn copies the file at srcPath into the box directory as name
+func (instance *Instance) CopyIn(srcPath string, name string) error {
+	err := os.MkdirAll(path.Dir(path.Join(instance.isolateDirectory, name)), 0755)
+	if err == nil {
+		err = exec.Command("cp", strings.TrimSpace(srcPath), path.Join(instance.isolateDirectory, name)).Run()
+	}
 	if err != nil {
-		return errors.Wrap(err, "Unable to copy input file into box directory")
+		return errors.Wrapf(err, "Unable to copy %s into box directory", srcPath)
 	}
-	err = exec.Command("cp", instance.userProgramPath, path.Join(instance.isolateDirectory)).Run()
+	return nil
+}
+
+// CopyOut copies the file name out of the box directory to dstPath
+func (instance *Instance) CopyOut(name string, dstPath string) error {
+	err := exec.Command("cp", path.Join(instance.isolateDirectory, name), strings.TrimSpace(dstPath)).Run()
 	if err != nil {
-		return errors.Wrap(err, "Unable to copy user exec file into box directory")
+		return errors.Wrapf(err, "Unable to copy %s out of box directory", name)
 	}
-	err = exec.Command("cp", instance.runnerScriptPath, path.Join(instance.isolateDirectory)).Run()
+	return nil
+}
+
+// Reset empties the box directory so the box can be used for another run
+func (instance *Instance) Reset() error {
+	os.Remove(instance.logFile)
+	err := util.RemoveDirContents(instance.isolateDirectory)
 	if err != nil {
-		return errors.Wrap(err, "Unable to copy runner script into box directory")
+		return errors.Wrap(err, "Unable to empty box directory")
 	}
 	return nil
 }
@@ -138,149 +172,98 @@ func (instance *Instance) Cleanup() error { // returns true if finished OK, othe
 	return err
 }
 
-func (instance *Instance) buildIsolateArguments() []string {
+func (instance *Instance) buildIsolateArguments(options RunOptions) []string {
+	timeLimit := math.Round(options.TimeLimit*1000) / 1000
+	extraTime := math.Round(options.ExtraTime*1000) / 1000
+
 	args := make([]string, 0)
 	args = append(args, "--cg")
 	args = append(args, "--cg-timing")
-	args = append(args, "--processes=128") // set to high number (like 128) for Java (issue #57 in ioi/isolate)
+	maxProcesses := options.MaxProcesses
+	if maxProcesses <= 0 {
+		maxProcesses = DefaultMaxProcesses
+	}
+	args = append(args, "--processes="+strconv.Itoa(maxProcesses))
 	args = append(args, []string{"-b", strconv.Itoa(instance.boxID)}...)
 	args = append(args, []string{"-M", instance.logFile}...)
-	args = append(args, []string{"-t", strconv.FormatFloat(instance.timeLimit, 'f', -1, 64)}...)
-	args = append(args, "--cg-mem="+strconv.Itoa(instance.memoryLimit))
-	args = append(args, []string{"-w", strconv.FormatFloat(instance.timeLimit+5, 'f', -1, 64)}...) // five extra seconds for wall clock
-	args = append(args, []string{"-x", strconv.FormatFloat(instance.extraTime, 'f', -1, 64)}...)
-	_, err := os.Stat("/etc/alternatives")
-	if !os.IsNotExist(err) {
-		args = append(args, "--dir=etc/alternatives") // for Java, PHP, etc.
+	args = append(args, []string{"-t", strconv.FormatFloat(timeLimit, 'f', -1, 64)}...)
+	args = append(args, "--cg-mem="+strconv.Itoa(options.MemoryLimit))
+	args = append(args, []string{"-w", strconv.FormatFloat(math.Round(options.WallClockLimit()*1000)/1000, 'f', -1, 64)}...)
+	args = append(args, []string{"-x", strconv.FormatFloat(extraTime, 'f', -1, 64)}...)
+	if options.StackLimit > 0 {
+		args = append(args, "--stack="+strconv.Itoa(options.StackLimit))
 	}
-	if instance.ioMode == 1 {
-		args = append(args, []string{"-i", instance.isolateInputName}...)
-		args = append(args, []string{"-o", instance.isolateOutputName}...)
+	for _, dir := range options.Directories {
+		args = append(args, "--dir="+strings.TrimPrefix(dir, "/")+":maybe") // Hosts without the directory still run the language
 	}
-	return args
-}
-
-func (instance *Instance) checkXX(props map[string]string) bool {
-	status, statusExists := props["status"]
-	return statusExists && strings.TrimSpace(status) == "XX"
-}
-
-func (instance *Instance) checkTLE(props map[string]string) (bool, bool) {
-	timeElapsedString, timeExists := props["time"]
-	status := strings.TrimSpace(props["status"])
-	_, err := strconv.ParseFloat(timeElapsedString, 64)
-	if !timeExists || err != nil {
-		return false, true // second parameter denotes whether or not log file is corrupted
+	for _, variable := range options.Env {
+		args = append(args, []string{"-E", variable}...)
 	}
-	return status == "TO", false
-}
-
-func (instance *Instance) checkRE(props map[string]string) (int, string) {
-	memoryUsageString, cgMemExists := props["cg-mem"]
-	exitSig, exitSigExists := props["exitsig"]
-	status := props["status"]
-	memoryUsage, err := strconv.Atoi(memoryUsageString)
-	if !cgMemExists || err != nil ||
-		((memoryUsage > instance.memoryLimit || exitSigExists || strings.TrimSpace(status) == "SG") &&
-			!(exitSigExists && status == "SG")) {
-		return -1, "" // -1 status means log file was corrupted
+	if options.Stdin != "" {
+		args = append(args, []string{"-i", options.Stdin}...)
+	}
+	if options.Stdout != "" {
+		args = append(args, []string{"-o", options.Stdout}...)
 	}
-	if strings.TrimSpace(status) != "RE" && strings.TrimSpace(status) != "SG" {
-		return 0, ""
-	} else if memoryUsage > instance.memoryLimit {
-		return 1, strings.TrimSpace(exitSig) // MLE
-	} else {
-		return 2, strings.TrimSpace(exitSig) // RE (assert or segmentation fault)
+	if options.StderrToStdout {
+		args = append(args, "--stderr-to-stdout")
+	} else if options.Stderr != "" {
+		args = append(args, []string{"-r", options.Stderr}...)
 	}
+	if options.OutputLimit > 0 {
+		args = append(args, "--fsize="+strconv.Itoa(options.OutputLimit))
+	}
+	return args
 }
 
-// Run runs isolate on an Instance
-func (instance *Instance) Run() (RunVerdict, RunMetrics) {
+// Run runs command inside the box of an Instance
+func (instance *Instance) Run(options RunOptions, command []string) (RunVerdict, RunMetrics) {
 	// Run isolate --run
-	_, runnerScriptName := filepath.Split(instance.runnerScriptPath)
-	args := append(instance.buildIsolateArguments()[:], []string{"--run", "--", runnerScriptName}...)
-	var exitCode int
+	args := append(instance.buildIsolateArguments(options), "--run", "--")
+	args = append(args, command...)
 	output, err := exec.Command(instance.isolateExecPath, args...).CombinedOutput()
 	log.Println(string(output))
-	if err != nil {
-		exitCode = err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
-	} else {
-		exitCode = 0
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		log.Println("Cannot run isolate:", err)
+		return IsolateRunXX, RunMetrics{}
 	}
 
-	// Read and parse log file into a map
-	logFileBytes, err := ioutil.ReadFile(instance.logFile)
+	meta, err := ReadMeta(instance.logFile)
 	if err != nil {
-		log.Println("Cannot read log file")
+		log.Println(err)
 		return IsolateRunOther, RunMetrics{}
 	}
-	contents := string(logFileBytes)
-	props := make(map[string]string)
-	for _, line := range strings.Split(contents, "\n") { // PITFALL: What if the file doesn't follow the correct format?
-		if len(line) == 0 {
-			continue
-		}
-		pair := strings.Split(line, ":")
-		if len(pair) != 2 {
-			log.Println("Log file has incorrect format")
-			return IsolateRunOther, RunMetrics{}
-		}
-		props[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+	verdict := meta.Verdict(options)
+	if verdict == IsolateRunXX || verdict == IsolateRunOther {
+		log.Printf("Isolate failed with status %q: %s", meta.Status, meta.Message)
+		return verdict, RunMetrics{}
 	}
-
-	// If the error is XX, then the fields required for run metrics won't be there
-	if instance.checkXX(props) {
-		return IsolateRunXX, RunMetrics{}
+	// Writes past the quota fail instead of killing the program, which may crash or carry on with partial output
+	if (verdict == IsolateRunOK || verdict == IsolateRunRE) && instance.quotaExhausted() {
+		verdict = IsolateRunOLE
 	}
+	return verdict, meta.Metrics()
+}
 
-	// Validate fields and extract run metrics from the map
-	memoryUsageString, memoryUsageExists := props["cg-mem"]
-	timeElapsedString, timeElapsedExists := props["time"]
-	_, wallTimeElapsedExists := props["time-wall"]
-	if !memoryUsageExists || !timeElapsedExists || !wallTimeElapsedExists {
-		log.Println("Log file has incorrect format")
-		return IsolateRunOther, RunMetrics{}
+// quotaExhausted reports whether the files the program created in the box use up its quota.
+// Files copied in by the grader belong to root and are not counted, as with the quota itself
+func (instance *Instance) quotaExhausted() bool {
+	if instance.quota == (Quota{}) {
+		return false
 	}
-	memoryUsage, err := strconv.Atoi(memoryUsageString)
-	if err != nil {
-		log.Println("Log file has incorrect format")
-		return IsolateRunOther, RunMetrics{}
-	}
-	timeElapsedUnrounded, err := strconv.ParseFloat(timeElapsedString, 64)
-	timeElapsed := int(math.Round(timeElapsedUnrounded * 1000))
-	if err != nil {
-		log.Println("Log file has incorrect format")
-		return IsolateRunOther, RunMetrics{}
-	}
-	metricObject := RunMetrics{TimeElapsed: timeElapsed, MemoryUsage: memoryUsage}
-
-	// Check status and return
-	if exitCode == 0 {
-		// IMPORTANT: copy output out of isolate directory
-		err = exec.Command("cp", path.Join(instance.isolateDirectory, instance.isolateOutputName), instance.resultOutputTargetPath).Run()
+	blocks, inodes := 0, 0
+	filepath.Walk(instance.isolateDirectory, func(filePath string, info os.FileInfo, err error) error {
 		if err != nil {
-			log.Println("Cannot copy output out of isolate directory")
-			return IsolateRunOther, RunMetrics{}
+			return nil
 		}
-		return IsolateRunOK, metricObject
-	}
-	code, _ := instance.checkRE(props)
-	if code == 1 {
-		return IsolateRunMLE, metricObject
-	} else if code == 2 {
-		return IsolateRunRE, metricObject
-	} else if code == -1 {
-		log.Println("Log file has incorrect format")
-		return IsolateRunOther, RunMetrics{}
-	}
-	if tle, logFileCorrupted := instance.checkTLE(props); tle {
-		return IsolateRunTLE, metricObject
-	} else if logFileCorrupted {
-		log.Println("Log file corrupted")
-		return IsolateRunOther, RunMetrics{}
-	}
-	log.Println("Verdict unknown")
-	return IsolateRunOther, RunMetrics{}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 {
+			blocks += int(stat.Blocks / 2) // Stat_t.Blocks is in 512-byte units
+			inodes++
+		}
+		return nil
+	})
+	// Writes fail as soon as the next block no longer fits
+	return blocks+quotaBlockSize > instance.quota.Blocks || inodes >= instance.quota.Inodes
 }
 
 func checkRootPermissions() (bool, error) {
@@ -1,25 +1,36 @@
 package isolate
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
 
 func TestIsolate(t *testing.T) {
-	instance := NewInstance("/usr/local/bin/isolate",
-		0,
-		"/home/proggrader/a.out",
-		1,
-		"/home/proggrader/logFile",
-		1.0,
-		5.0,
-		512000,
-		"/home/proggrader/output",
-		"/home/proggrader/testcases/tasks/o61_may08_estate/inputs/19.in",
-		"/home/proggrader/testcases/config/runnerScripts/cpp14",
-	)
+	instance := NewInstance("/usr/local/bin/isolate", 0, "/home/proggrader/logFile", Quota{})
 	err := instance.Init()
 	if err != nil {
 		t.Log(err)
 	}
-	verdict, metrics := instance.Run()
+	for _, file := range [][2]string{
+		{"/home/proggrader/testcases/tasks/o61_may08_estate/inputs/19.in", "input"},
+		{"/home/proggrader/a.out", "a.out"},
+		{"/home/proggrader/testcases/config/runnerScripts/cpp14", "cpp14"},
+	} {
+		err = instance.CopyIn(file[0], file[1])
+		if err != nil {
+			t.Log(err)
+		}
+	}
+	verdict, metrics := instance.Run(RunOptions{
+		TimeLimit:   1.0,
+		ExtraTime:   5.0,
+		MemoryLimit: 512000,
+		Stdin:       "input",
+		Stdout:      "output",
+	}, []string{"cpp14"})
 	t.Log(verdict)
 	t.Log(metrics)
 	err = instance.Cleanup()
@@ -27,3 +38,61 @@ func TestIsolate(t *testing.T) {
 		t.Log(err)
 	}
 }
+
+func TestBuildIsolateArguments(t *testing.T) {
+	instance := NewInstance("/usr/bin/isolate", 3, "/tmp/log", Quota{})
+	args := strings.Join(instance.buildIsolateArguments(RunOptions{TimeLimit: 1, ExtraTime: 2, MemoryLimit: 65536}), " ")
+	for _, arg := range []string{"--processes=1", "-w 6", "-b 3"} {
+		if !strings.Contains(args, arg) {
+			t.Errorf("Default arguments %q lack %q", args, arg)
+		}
+	}
+	if strings.Contains(args, "--dir") || strings.Contains(args, "--stack") {
+		t.Errorf("Default arguments %q add directories or a stack limit", args)
+	}
+
+	args = strings.Join(instance.buildIsolateArguments(RunOptions{
+		TimeLimit:    1,
+		MemoryLimit:  65536,
+		MaxProcesses: 64,
+		StackLimit:   65536,
+		WallTime:     12.5,
+		Directories:  []string{"/usr/lib/jvm"},
+		Env:          []string{"JAVA_OPTS=-Xmx64m"},
+	}), " ")
+	for _, arg := range []string{"--processes=64", "--stack=65536", "-w 12.5", "--dir=usr/lib/jvm:maybe", "-E JAVA_OPTS=-Xmx64m"} {
+		if !strings.Contains(args, arg) {
+			t.Errorf("Arguments %q lack %q", args, arg)
+		}
+	}
+}
+
+func TestQuotaExhausted(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Creating files owned by the box user needs root")
+	}
+	dir, err := ioutil.TempDir("", "isolate_test_quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	instance := NewInstance("isolate", 0, "", Quota{Blocks: 64, Inodes: 3})
+	instance.isolateDirectory = dir
+
+	// Files copied in by the grader do not count
+	ioutil.WriteFile(path.Join(dir, "input"), make([]byte, 1024*1024), 0644)
+	if instance.quotaExhausted() {
+		t.Error("Quota exhausted by the input")
+	}
+	ioutil.WriteFile(path.Join(dir, "output"), make([]byte, 64*1024), 0644)
+	os.Chown(path.Join(dir, "output"), 60000, 60000)
+	if !instance.quotaExhausted() {
+		t.Error("Quota not exhausted by 64 KiB of output")
+	}
+
+	instance = NewInstance("isolate", 0, "", Quota{})
+	instance.isolateDirectory = dir
+	if instance.quotaExhausted() {
+		t.Error("Quota exhausted without a quota")
+	}
+}
@@ -0,0 +1,183 @@
+package isolate
+
+import (
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Meta is the contents of the meta file isolate writes after a run (see the META-FILES section of isolate(1)).
+// Fields isolate did not write are left at their zero values
+type Meta struct {
+	Time         float64 // CPU time in seconds
+	TimeWall     float64 // Wall clock time in seconds
+	MaxRSS       int     // Maximum resident set size of the process in KiB
+	CgMem        int     // Total memory used by the control group in KiB
+	CgOOMKilled  bool    // The program was killed by the out-of-memory killer of the control group
+	CswVoluntary int     // Number of context switches caused by the process giving up the CPU
+	CswForced    int     // Number of context switches forced by the kernel
+	ExitCode     int     // Exit code of the program, if it exited normally
+	ExitSig      int     // Signal that killed the program, if any
+	Killed       bool    // The program was killed by isolate, e.g. for exceeding the time limit
+	Status       string  // Empty if the program succeeded, otherwise RE, SG, TO or XX
+	Message      string  // Human-readable description of the status
+}
+
+// ParseMeta parses the contents of a meta file. Fields it does not know are ignored
+func ParseMeta(contents string) (Meta, error) {
+	meta := Meta{}
+	for _, line := range strings.Split(contents, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		// Only the first colon separates the key, as messages may contain colons
+		pair := strings.SplitN(line, ":", 2)
+		if len(pair) != 2 {
+			return meta, errors.Errorf("Meta file line %q is not a key:value pair", line)
+		}
+		key := strings.TrimSpace(pair[0])
+		value := strings.TrimSpace(pair[1])
+
+		var err error
+		switch key {
+		case "time":
+			meta.Time, err = strconv.ParseFloat(value, 64)
+		case "time-wall":
+			meta.TimeWall, err = strconv.ParseFloat(value, 64)
+		case "max-rss":
+			meta.MaxRSS, err = strconv.Atoi(value)
+		case "cg-mem":
+			meta.CgMem, err = strconv.Atoi(value)
+		case "cg-oom-killed":
+			meta.CgOOMKilled, err = parseMetaFlag(value)
+		case "csw-voluntary":
+			meta.CswVoluntary, err = strconv.Atoi(value)
+		case "csw-forced":
+			meta.CswForced, err = strconv.Atoi(value)
+		case "exitcode":
+			meta.ExitCode, err = strconv.Atoi(value)
+		case "exitsig":
+			meta.ExitSig, err = strconv.Atoi(value)
+		case "killed":
+			meta.Killed, err = parseMetaFlag(value)
+		case "status":
+			meta.Status = value
+		case "message":
+			meta.Message = value
+		}
+		if err != nil {
+			return meta, errors.Wrapf(err, "Meta file has invalid %s", key)
+		}
+	}
+	return meta, nil
+}
+
+// parseMetaFlag parses flags such as killed, which isolate writes as 1 when set
+func parseMetaFlag(value string) (bool, error) {
+	flag, err := strconv.Atoi(value)
+	return flag != 0, err
+}
+
+// ReadMeta reads and parses the meta file at path
+func ReadMeta(path string) (Meta, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Meta{}, errors.Wrapf(err, "Cannot read meta file %s", path)
+	}
+	return ParseMeta(string(contents))
+}
+
+// Metrics returns the time and memory usage of the run and how it ended. Memory usage is taken from the
+// control group if isolate ran with one, and from the process otherwise
+func (meta Meta) Metrics() RunMetrics {
+	memoryUsage := meta.CgMem
+	if memoryUsage == 0 {
+		memoryUsage = meta.MaxRSS
+	}
+	return RunMetrics{
+		TimeElapsed: int(math.Round(meta.Time * 1000)),
+		MemoryUsage: memoryUsage,
+		ExitCode:    meta.ExitCode,
+		ExitSignal:  meta.ExitSig,
+		Killed:      meta.Killed,
+	}
+}
+
+// SignalVerdict returns the verdict of a program killed by signal. Signals that do not stand for a limit
+// or a forbidden operation are runtime errors
+func SignalVerdict(signal syscall.Signal) RunVerdict {
+	switch signal {
+	case syscall.SIGXFSZ:
+		return IsolateRunOLE
+	case syscall.SIGSYS:
+		return IsolateRunSV
+	default:
+		return IsolateRunRE
+	}
+}
+
+// signalNames are the names of the signals a program is commonly terminated by
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGUSR2: "SIGUSR2",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+	syscall.SIGSYS:  "SIGSYS",
+}
+
+// SignalName returns the name of signal, such as SIGSEGV, or an empty string for signal 0
+func SignalName(signal syscall.Signal) string {
+	if signal == 0 {
+		return ""
+	}
+	if name, exists := signalNames[signal]; exists {
+		return name
+	}
+	return "signal " + strconv.Itoa(int(signal))
+}
+
+// Verdict decides the verdict of the run from its status. A timed out program that did not use up its CPU time
+// was idle. A program that crashed is judged to have exceeded the memory limit if the out-of-memory killer hit it
+// or it used more memory than allowed
+func (meta Meta) Verdict(options RunOptions) RunVerdict {
+	switch meta.Status {
+	case "":
+		return IsolateRunOK
+	case "TO":
+		if meta.Time <= options.TimeLimit {
+			return IsolateRunILE
+		}
+		return IsolateRunTLE
+	case "RE", "SG":
+		if meta.CgOOMKilled || meta.Metrics().MemoryUsage > options.MemoryLimit {
+			return IsolateRunMLE
+		}
+		if meta.ExitSig != 0 {
+			return SignalVerdict(syscall.Signal(meta.ExitSig))
+		}
+		return IsolateRunRE
+	case "FO": // Forbidden operation, reported by older sandboxes derived from the same box
+		return IsolateRunSV
+	case "XX":
+		return IsolateRunXX
+	default:
+		return IsolateRunOther
+	}
+}
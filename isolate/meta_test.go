@@ -0,0 +1,98 @@
+package isolate
+
+import (
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestReadMeta(t *testing.T) {
+	meta, err := ReadMeta(path.Join("testdata", "mle.meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Meta{
+		Time:         0.21,
+		TimeWall:     0.231,
+		MaxRSS:       65536,
+		CgMem:        65536,
+		CgOOMKilled:  true,
+		CswVoluntary: 1,
+		CswForced:    3,
+		ExitSig:      9,
+		Killed:       true,
+		Status:       "SG",
+		Message:      "Caught fatal signal 9",
+	}
+	if meta != expected {
+		t.Errorf("Got %+v, expected %+v", meta, expected)
+	}
+
+	// Messages may contain colons, and unknown fields are ignored
+	meta, err = ReadMeta(path.Join("testdata", "colon.meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Message != `Exited with error status 1: see stderr: "a:b"` || meta.ExitCode != 1 {
+		t.Errorf("Got %+v", meta)
+	}
+
+	_, err = ReadMeta(path.Join("testdata", "corrupt.meta"))
+	if err == nil {
+		t.Error("Expected an error for a corrupt meta file")
+	}
+	_, err = ReadMeta(path.Join("testdata", "missing.meta"))
+	if err == nil {
+		t.Error("Expected an error for a missing meta file")
+	}
+}
+
+func TestMetaVerdict(t *testing.T) {
+	tests := []struct {
+		file    string
+		verdict RunVerdict
+		metrics RunMetrics
+	}{
+		{"ok.meta", IsolateRunOK, RunMetrics{TimeElapsed: 12, MemoryUsage: 1528}},
+		{"tle.meta", IsolateRunTLE, RunMetrics{TimeElapsed: 1004, MemoryUsage: 1480, Killed: true}},
+		{"wall.meta", IsolateRunILE, RunMetrics{TimeElapsed: 3, MemoryUsage: 1212, Killed: true}},
+		{"re.meta", IsolateRunRE, RunMetrics{TimeElapsed: 2, MemoryUsage: 1360, ExitCode: 3}},
+		{"sg.meta", IsolateRunRE, RunMetrics{TimeElapsed: 1, MemoryUsage: 1300, ExitSignal: 11}},
+		{"mle.meta", IsolateRunMLE, RunMetrics{TimeElapsed: 210, MemoryUsage: 65536, ExitSignal: 9, Killed: true}},
+		{"colon.meta", IsolateRunRE, RunMetrics{TimeElapsed: 2, MemoryUsage: 900, ExitCode: 1}},
+		{"ole.meta", IsolateRunOLE, RunMetrics{TimeElapsed: 15, MemoryUsage: 1400, ExitSignal: 25}},
+		{"sys.meta", IsolateRunSV, RunMetrics{TimeElapsed: 1, MemoryUsage: 1100, ExitSignal: 31}},
+		{"xx.meta", IsolateRunXX, RunMetrics{}},
+	}
+	for _, test := range tests {
+		meta, err := ReadMeta(path.Join("testdata", test.file))
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+			continue
+		}
+		if verdict := meta.Verdict(RunOptions{TimeLimit: 1, MemoryLimit: 65536}); verdict != test.verdict {
+			t.Errorf("%s: got verdict %s, expected %s", test.file, verdict, test.verdict)
+		}
+		if metrics := meta.Metrics(); metrics != test.metrics {
+			t.Errorf("%s: got metrics %v, expected %v", test.file, metrics, test.metrics)
+		}
+	}
+}
+
+func TestSignalName(t *testing.T) {
+	tests := []struct {
+		signal syscall.Signal
+		name   string
+	}{
+		{0, ""},
+		{syscall.SIGSEGV, "SIGSEGV"},
+		{syscall.SIGABRT, "SIGABRT"},
+		{syscall.SIGFPE, "SIGFPE"},
+		{syscall.Signal(40), "signal 40"},
+	}
+	for _, test := range tests {
+		if name := SignalName(test.signal); name != test.name {
+			t.Errorf("Got %q for signal %d, expected %q", name, test.signal, test.name)
+		}
+	}
+}
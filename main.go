@@ -1,19 +1,53 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/programming-in-th/grader/api"
 	"github.com/programming-in-th/grader/conf"
 	"github.com/programming-in-th/grader/grader"
+	"github.com/programming-in-th/grader/importer"
 	"github.com/programming-in-th/grader/util"
 )
 
 func initGrader(config conf.Config) {
+	err := grader.CheckSandbox(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Working files left by a grader that stopped are removed before its queued submissions are judged again.
+	// Only the files of those submissions are removed, since other graders and commands may share the tmp
+	// folder. Boxes it left are destroyed one by one when the box pool is created
+	queuedSubmissionIDs, err := api.QueuedSubmissionIDs(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, submissionID := range queuedSubmissionIDs {
+		for _, dir := range []string{grader.BASE_TMP_PATH, grader.BASE_SRC_PATH} {
+			stalePath := path.Join(dir, submissionID)
+			if !strings.HasPrefix(stalePath, dir+"/") || stalePath == grader.BASE_SRC_PATH {
+				continue // The ID does not name a directory of its own
+			}
+			err = os.RemoveAll(stalePath)
+			if err != nil {
+				log.Fatalf("Error removing stale working files of submission %s", submissionID)
+			}
+		}
+	}
+
 	// Create base tmp path for user binaries and outputs
-	err := util.CreateDirIfNotExist(grader.BASE_TMP_PATH)
+	err = util.CreateDirIfNotExist(grader.BASE_TMP_PATH)
 	if err != nil {
 		log.Fatal("Error creating working tmp folder")
 	}
@@ -25,38 +59,157 @@ func initGrader(config conf.Config) {
 	}
 
 	gradingJobDoneChannel := make(chan bool)
-	gradingJobChannel := grader.NewGradingJobQueue(2, gradingJobDoneChannel, config)
+	gradingJobChannel, backgroundJobChannel, gradingJobsStopped, abortGradingJobs := grader.NewPrioritizedGradingJobQueue(numGradingWorkers, gradingJobDoneChannel, config)
 
 	// Init handlers
 	requestDoneChannel := make(chan bool)
-	requestChannel := newSubmissionJobQueue(4, requestDoneChannel, gradingJobChannel, config)
-	api.InitAPI(requestChannel, config)
+	requestChannel, requestsStopped := newSubmissionJobQueue(4, requestDoneChannel, gradingJobChannel, config)
+	rejudgeChannel := newRejudgeQueue(backgroundJobChannel, config)
+	syncUpdateChannel := api.NewSyncUpdateChannel(config)
+	go pruneStore(config)
 
-	requestDoneChannel <- true
-	gradingJobDoneChannel <- true
-	close(gradingJobDoneChannel)
+	// The API and the grader share one shutdown timeout, which starts when the signal is received
+	apiDoneChannel := make(chan bool)
+	shutdown, expireShutdown := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		log.Printf("Received %s, shutting down", <-signals)
+		time.AfterFunc(time.Duration(config.Glob.ShutdownTimeout*float64(time.Second)), expireShutdown)
+		close(apiDoneChannel)
+	}()
+	err = api.InitAPI(requestChannel, rejudgeChannel, syncUpdateChannel, func(query api.SubmissionQuery) (interface{}, error) {
+		return grader.QueryStoredSubmissions(query, config)
+	}, apiDoneChannel, shutdown, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	shutdownGrader(requestDoneChannel, requestsStopped, syncUpdateChannel, gradingJobDoneChannel, gradingJobsStopped, abortGradingJobs, shutdown)
 }
 
-func newSubmissionJobQueue(maxWorkers int, done chan bool, gradingJobChannel chan grader.GradingJob, config conf.Config) chan api.GradingRequest {
+// shutdownGrader lets the submissions being judged finish, sends their remaining sync updates and cleans
+// up the boxes. Once shutdown expires, it cleans up every box at once, killing the tests still running,
+// and gives up on the rest. Submissions that did not finish stay in the on-disk queue, and running rejudges
+// are abandoned
+func shutdownGrader(requestDoneChannel chan bool,
+	requestsStopped chan bool,
+	syncUpdateChannel chan api.SyncUpdate,
+	gradingJobDoneChannel chan bool,
+	gradingJobsStopped chan bool,
+	abortGradingJobs func(),
+	shutdown context.Context) {
+
+	steps := []struct {
+		name string
+		stop func()
+	}{
+		{"judging submissions", func() {
+			close(requestDoneChannel)
+			<-requestsStopped
+		}},
+		{"sending sync updates", func() {
+			api.FlushSyncUpdates(syncUpdateChannel)
+		}},
+		{"cleaning up boxes", func() {
+			close(gradingJobDoneChannel)
+			<-gradingJobsStopped
+		}},
+	}
+	for _, step := range steps {
+		finished := make(chan bool)
+		go func(stop func()) {
+			stop()
+			close(finished)
+		}(step.stop)
+		select {
+		case <-finished:
+		case <-shutdown.Done():
+			log.Printf("Shutdown timed out while %s", step.name)
+			abortGradingJobs()
+			return
+		}
+	}
+	log.Println("Grader stopped")
+}
+
+// numGradingWorkers is the number of tests the server runs at once
+const numGradingWorkers = 2
+
+// storePruneInterval is how often submissions past their retention are removed from the store
+const storePruneInterval = time.Hour
+
+// pruneStore removes the submissions past their retention from the store when the grader starts, and
+// every storePruneInterval after that
+func pruneStore(config conf.Config) {
+	for {
+		removed, err := grader.PruneStore(config)
+		if err != nil {
+			log.Println(err)
+		} else if removed > 0 {
+			log.Printf("Removed %d submissions past their retention from the store", removed)
+		}
+		time.Sleep(storePruneInterval)
+	}
+}
+
+// newRejudgeQueue starts every rejudge sent on the returned channel as soon as it arrives. Rejudges run on
+// the background queue of the grading workers, so that live submissions are judged first
+func newRejudgeQueue(backgroundJobChannel chan grader.GradingJob, config conf.Config) chan api.RejudgeRequest {
+	ch := make(chan api.RejudgeRequest)
+	go func() {
+		for request := range ch {
+			go func(request api.RejudgeRequest) {
+				report, err := grader.Rejudge(request, backgroundJobChannel, numGradingWorkers, config)
+				if err != nil {
+					log.Println(err)
+				}
+				log.Printf("Rejudge %s finished: %d submissions rejudged, %d changed", report.ID, report.Rejudged, len(report.Changes))
+			}(request)
+		}
+	}()
+	return ch
+}
+
+// newSubmissionJobQueue starts workers that each judge one submission at a time. Closing done stops every
+// worker once its current submission is judged, and the returned stopped channel is closed when all have stopped
+func newSubmissionJobQueue(maxWorkers int, done chan bool, gradingJobChannel chan grader.GradingJob, config conf.Config) (chan api.GradingRequest, chan bool) {
 	ch := make(chan api.GradingRequest)
+	stopped := make(chan bool)
 	var wg sync.WaitGroup
 
+	wg.Add(maxWorkers)
 	go func() {
 		wg.Wait()
-		close(ch)
+		close(stopped)
 	}()
 
-	wg.Add(maxWorkers)
 	for i := 0; i < maxWorkers; i++ {
 		go func() {
 			for {
 				select {
 				case request := <-ch:
-					err := grader.GradeSubmission(request.SubmissionID, request.TaskID, request.TargLang, request.Code, gradingJobChannel, request.SyncUpdateChannel, config)
+					// Submissions stay in the on-disk queue until they are judged, so they are judged at least once
+					err := api.StartQueuedRequest(request.SubmissionID, config)
+					if err != nil {
+						log.Println(err)
+					}
+					grade := grader.GradeSubmission
+					if request.RejudgedAfterCrash {
+						grade = grader.GradeRecoveredSubmission
+					}
+					err = grade(request.SubmissionID, request.TaskID, request.TargLang, request.Source, request.Accepted, gradingJobChannel, request.SyncUpdateChannel, config)
+					if err == grader.ErrAborted {
+						continue // Cut off by the shutdown timeout, so it stays queued and is judged again
+					}
 					if err != nil {
 						// TODO: do something with the error
 						log.Println(err)
 					}
+					err = api.FinishQueuedRequest(request.SubmissionID, config)
+					if err != nil {
+						log.Println(err)
+					}
 				case <-done:
 					wg.Done()
 					return
@@ -64,13 +217,220 @@ func newSubmissionJobQueue(maxWorkers int, done chan bool, gradingJobChannel cha
 			}
 		}()
 	}
-	return ch
+	return ch, stopped
 }
 
-func main() {
-	err := os.RemoveAll("/var/local/lib/isolate")
+// runImport converts a problem package into a task under the base path.
+// Usage: grader import [-format polygon|cms|kattis] [-id taskID] <base path> <package path>
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "format of the package: polygon, cms or kattis (detected if omitted)")
+	taskID := flags.String("id", "", "ID of the new task (defaults to the name given in the package)")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		log.Fatal("Usage: grader import [-format polygon|cms|kattis] [-id taskID] <base path> <package path>")
+	}
+
+	config := conf.InitConfig(flags.Arg(0))
+	report, err := importer.Import(*format, flags.Arg(1), *taskID, config)
 	if err != nil {
-		log.Fatal("Failed to rm /var/local/lib/isolate")
+		log.Fatal(err)
+	}
+	for _, warning := range report.Warnings {
+		log.Println("Warning:", warning)
+	}
+	log.Printf("Imported task %s with %d tests", report.TaskID, report.NumTests)
+}
+
+// runBuild generates the tests of a task from its build.txt.
+// Usage: grader build <base path> <task ID>
+func runBuild(args []string) {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		log.Fatal("Usage: grader build <base path> <task ID>")
+	}
+
+	config := conf.InitConfig(flags.Arg(0))
+	report, err := grader.BuildTask(flags.Arg(1), config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Built %d tests: %d inputs and %d solutions regenerated", report.NumTests, report.InputsGenerated, report.SolutionsGenerated)
+}
+
+// runVerify judges the author solutions of a task and exits with an error if any of them gets an unexpected result.
+// Usage: grader verify <base path> <task ID>
+func runVerify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		log.Fatal("Usage: grader verify <base path> <task ID>")
+	}
+
+	config := conf.InitConfig(flags.Arg(0))
+	results, err := grader.VerifyTask(flags.Arg(1), config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	numFailed := 0
+	for _, result := range results {
+		if len(result.Mismatches) == 0 {
+			log.Printf("OK: %s (%s)", result.Solution.Path, result.Solution.Lang)
+			continue
+		}
+		numFailed++
+		log.Printf("MISMATCH: %s (%s)", result.Solution.Path, result.Solution.Lang)
+		for _, mismatch := range result.Mismatches {
+			log.Println("  " + mismatch)
+		}
+	}
+	if numFailed > 0 {
+		log.Fatalf("%d of %d author solutions got unexpected results", numFailed, len(results))
+	}
+}
+
+// runTimeLimit measures the accepted author solutions of a task and proposes time limits.
+// Usage: grader timelimit [options] <base path> <task ID>
+func runTimeLimit(args []string) {
+	options := grader.DefaultTimeLimitOptions
+	flags := flag.NewFlagSet("timelimit", flag.ExitOnError)
+	flags.IntVar(&options.Runs, "runs", options.Runs, "number of times each solution is run on each test")
+	flags.Float64Var(&options.ProbeTimeLimit, "probe", options.ProbeTimeLimit, "time limit in seconds while measuring")
+	flags.Float64Var(&options.Multiplier, "multiplier", options.Multiplier, "proposed limit = slowest time * multiplier")
+	flags.Float64Var(&options.NoisySpread, "noisy", options.NoisySpread, "report tests whose spread exceeds this fraction of their max time")
+	flags.StringVar(&options.BaseLang, "base", "", "language whose limit becomes DefaultLimits")
+	languageMultipliers := flags.String("lang-multipliers", "", "per-language multipliers, e.g. python3=3,java8=2.5")
+	write := flags.Bool("write", false, "write the proposed limits into manifest.json")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		log.Fatal("Usage: grader timelimit [options] <base path> <task ID>")
+	}
+	options.LanguageMultipliers = make(map[string]float64)
+	if *languageMultipliers != "" {
+		for _, pair := range strings.Split(*languageMultipliers, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				log.Fatalf("Invalid language multiplier %s", pair)
+			}
+			multiplier, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil {
+				log.Fatalf("Invalid language multiplier %s", pair)
+			}
+			options.LanguageMultipliers[parts[0]] = multiplier
+		}
+	}
+
+	config := conf.InitConfig(flags.Arg(0))
+	taskID := flags.Arg(1)
+	proposal, err := grader.ProposeTimeLimits(taskID, options, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, timing := range proposal.Solutions {
+		log.Printf("%s (%s): slowest test %d ms", timing.Solution.Path, timing.Solution.Lang, timing.Max)
+	}
+	for _, noisy := range proposal.NoisyTests {
+		log.Println("Noisy:", noisy)
+	}
+	log.Printf("Proposed DefaultLimits: %v s, %d MB", proposal.DefaultLimits.TimeLimit, proposal.DefaultLimits.MemoryLimit)
+	for lang, limit := range proposal.Limits {
+		log.Printf("Proposed Limits for %s: %v s, %d MB", lang, limit.TimeLimit, limit.MemoryLimit)
+	}
+	if *write {
+		err = grader.ApplyTimeLimits(taskID, proposal, config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Limits written to manifest.json")
+	}
+}
+
+// runRejudge judges stored submissions again and reports every verdict and score that changed.
+// Usage: grader rejudge [options] <base path>
+func runRejudge(args []string) {
+	var request api.RejudgeRequest
+	flags := flag.NewFlagSet("rejudge", flag.ExitOnError)
+	submissionIDs := flags.String("submissions", "", "comma-separated IDs of the submissions to rejudge")
+	taskIDs := flags.String("tasks", "", "comma-separated IDs of the tasks whose submissions are rejudged")
+	langs := flags.String("langs", "", "comma-separated languages of the submissions to rejudge")
+	flags.StringVar(&request.Verdict, "verdict", "", "only rejudge submissions whose latest verdict is this, e.g. Correct")
+	since := flags.String("since", "", "only rejudge submissions submitted at or after this RFC 3339 time")
+	until := flags.String("until", "", "only rejudge submissions submitted before this RFC 3339 time")
+	workers := flags.Int("workers", 2, "number of tests run at once")
+	firstBoxID := flags.Int("first-box", -1, "first box ID to use, in place of FirstBoxID of the global configuration")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: grader rejudge [options] <base path>")
+	}
+	splitList := func(list string) []string {
+		if list == "" {
+			return nil
+		}
+		return strings.Split(list, ",")
+	}
+	request.SubmissionIDs = splitList(*submissionIDs)
+	request.TaskIDs = splitList(*taskIDs)
+	request.Langs = splitList(*langs)
+	for _, bound := range []struct {
+		value *string
+		time  *time.Time
+	}{{since, &request.Since}, {until, &request.Until}} {
+		if *bound.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, *bound.value)
+		if err != nil {
+			log.Fatalf("Invalid time %s", *bound.value)
+		}
+		*bound.time = parsed
+	}
+
+	config := conf.InitConfig(flags.Arg(0))
+	if *firstBoxID >= 0 {
+		config.Glob.FirstBoxID = *firstBoxID
+	}
+	err := grader.CheckSandbox(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	done := make(chan bool)
+	gradingJobChannel := grader.NewGradingJobQueue(*workers, done, config)
+	report, err := grader.Rejudge(request, gradingJobChannel, *workers, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, change := range report.Changes {
+		log.Printf("%s (%s): %s %v -> %s %v", change.SubmissionID, change.TaskID, change.OldVerdict, change.OldScore, change.NewVerdict, change.NewScore)
+		for _, test := range change.Tests {
+			log.Printf("  group %d test %d: %s %s -> %s %s", test.Group, test.Test, test.OldVerdict, test.OldScore, test.NewVerdict, test.NewScore)
+		}
+	}
+	for _, rejudgeError := range report.Errors {
+		log.Println("Error:", rejudgeError)
+	}
+	log.Printf("Rejudged %d submissions, %d changed. Report %s written to the store", report.Rejudged, len(report.Changes), report.ID)
+}
+
+func main() {
+	if len(os.Args) >= 2 {
+		switch os.Args[1] {
+		case "import":
+			runImport(os.Args[2:])
+			return
+		case "build":
+			runBuild(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "timelimit":
+			runTimeLimit(os.Args[2:])
+			return
+		case "rejudge":
+			runRejudge(os.Args[2:])
+			return
+		}
 	}
 
 	if len(os.Args) < 2 {
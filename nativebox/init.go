@@ -0,0 +1,290 @@
+package nativebox
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// initArg is argv[0] of the grader when it is re-executed as the init process of a box
+const initArg = "nativebox-init"
+
+// rlimInfinity is RLIM_INFINITY as an unsigned value
+const rlimInfinity = ^uint64(0)
+
+// File descriptors passed to the init process
+const (
+	syncFD  = 3
+	errorFD = 4
+)
+
+// readOnlyDirs are the host directories visible (read-only) inside every box
+var readOnlyDirs = []string{"/bin", "/lib", "/lib32", "/lib64", "/libx32", "/usr"}
+
+// devices are the host devices visible inside every box
+var devices = []string{"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"}
+
+// initConfig tells the init process how to set up the box
+type initConfig struct {
+	RootPath      string // Mount point of the root of the box
+	BoxPath       string // Box directory, mounted at /box
+	CPULimit      uint64 // In seconds
+	FileSizeLimit uint64 // In bytes
+	StackLimit    uint64 // In bytes
+	Command       []string
+	Env           []string // Added to the environment of the program, overriding the defaults
+	Directories   []string // Visible (read-only) in the box besides readOnlyDirs
+	BoxUID        int
+	Hostname      string
+}
+
+// When the grader is re-executed as the init process of a box, it sets up the box and becomes the
+// program to run instead of starting normally
+func init() {
+	if len(os.Args) != 2 || os.Args[0] != initArg {
+		return
+	}
+	runtime.LockOSThread()
+	err := runInit(os.Args[1])
+	errorPipe := os.NewFile(errorFD, "error")
+	errorPipe.Write([]byte(err.Error()))
+	os.Exit(1)
+}
+
+// runInit only returns if the box could not be set up
+func runInit(configJSON string) error {
+	var config initConfig
+	err := json.Unmarshal([]byte(configJSON), &config)
+	if err != nil {
+		return errors.Wrap(err, "Invalid box configuration")
+	}
+	syscall.CloseOnExec(errorFD)
+
+	// Wait until we have been moved into the cgroup of the run
+	syncPipe := os.NewFile(syncFD, "sync")
+	_, err = syncPipe.Read(make([]byte, 1))
+	if err != nil {
+		return errors.Wrap(err, "Sync with grader failed")
+	}
+	syncPipe.Close()
+
+	err = setUpRoot(config)
+	if err != nil {
+		return err
+	}
+	err = syscall.Sethostname([]byte(config.Hostname))
+	if err != nil {
+		return errors.Wrap(err, "Unable to set hostname")
+	}
+
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_CPU, config.CPULimit},
+		{syscall.RLIMIT_FSIZE, config.FileSizeLimit},
+		{syscall.RLIMIT_STACK, config.StackLimit},
+		{syscall.RLIMIT_CORE, 0},
+		{syscall.RLIMIT_NOFILE, 256},
+	}
+	for _, limit := range limits {
+		err := syscall.Setrlimit(limit.resource, &syscall.Rlimit{Cur: limit.value, Max: limit.value})
+		if err != nil {
+			return errors.Wrapf(err, "Unable to set rlimit %d", limit.resource)
+		}
+	}
+
+	err = os.Chdir("/box")
+	if err != nil {
+		return errors.Wrap(err, "Unable to enter box directory")
+	}
+	err = syscall.Setgid(config.BoxUID)
+	if err != nil {
+		return errors.Wrap(err, "Unable to drop group privileges")
+	}
+	err = syscall.Setuid(config.BoxUID)
+	if err != nil {
+		return errors.Wrap(err, "Unable to drop user privileges")
+	}
+
+	program := config.Command[0]
+	if !strings.Contains(program, "/") {
+		program = "./" + program // Relative to the box directory, as in isolate
+	}
+	env := []string{"PATH=/usr/local/bin:/usr/bin:/bin", "HOME=/box", "LIBC_FATAL_STDERR_=1"}
+	for _, variable := range config.Env {
+		env = setEnv(env, variable)
+	}
+	err = syscall.Exec(program, config.Command, env)
+	return errors.Wrapf(err, "Unable to execute %s", program)
+}
+
+// isInside reports whether filePath is one of dirs or inside one of them
+func isInside(filePath string, dirs []string) bool {
+	for _, dir := range dirs {
+		if filePath == dir || strings.HasPrefix(filePath, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// setEnv sets the KEY=VALUE variable in env, replacing any earlier value of KEY
+func setEnv(env []string, variable string) []string {
+	key := strings.SplitN(variable, "=", 2)[0] + "="
+	for i := range env {
+		if strings.HasPrefix(env[i], key) {
+			env[i] = variable
+			return env
+		}
+	}
+	return append(env, variable)
+}
+
+// setUpRoot builds the root of the box on a tmpfs and switches to it
+func setUpRoot(config initConfig) error {
+	// Keep our mounts from propagating back to the host
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return errors.Wrap(err, "Unable to make mounts private")
+	}
+	root := config.RootPath
+	err = syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "size=16m,mode=755")
+	if err != nil {
+		return errors.Wrap(err, "Unable to mount root")
+	}
+
+	mounted := make([]string, 0)
+	for _, dir := range append(append([]string{}, readOnlyDirs...), config.Directories...) {
+		info, err := os.Lstat(dir)
+		if err != nil || isInside(dir, mounted) {
+			continue
+		}
+		mounted = append(mounted, dir)
+		target := path.Join(root, dir)
+		if info.Mode()&os.ModeSymlink != 0 {
+			// Merged /usr layouts link /bin and /lib into /usr
+			link, err := os.Readlink(dir)
+			if err == nil {
+				err = os.MkdirAll(path.Dir(target), 0755)
+			}
+			if err == nil {
+				err = os.Symlink(link, target)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "Unable to link %s", dir)
+			}
+			continue
+		}
+		err = os.MkdirAll(target, 0755)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to create %s", target)
+		}
+		err = bindMount(dir, target, true, syscall.MS_REC)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, device := range devices {
+		target := path.Join(root, device)
+		err := os.MkdirAll(path.Dir(target), 0755)
+		if err == nil {
+			err = createEmptyFile(target)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Unable to create %s", target)
+		}
+		err = bindMount(device, target, false, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range []string{"box", "proc", "tmp"} {
+		err := os.Mkdir(path.Join(root, dir), 0755)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to create /%s", dir)
+		}
+	}
+	err = bindMount(config.BoxPath, path.Join(root, "box"), false, 0)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("proc", path.Join(root, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err != nil {
+		return errors.Wrap(err, "Unable to mount /proc")
+	}
+	err = syscall.Mount("tmpfs", path.Join(root, "tmp"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "size=64m,mode=1777")
+	if err != nil {
+		return errors.Wrap(err, "Unable to mount /tmp")
+	}
+
+	// Switch to the new root and drop the old one
+	oldRoot := path.Join(root, ".oldroot")
+	err = os.Mkdir(oldRoot, 0700)
+	if err != nil {
+		return errors.Wrap(err, "Unable to create mount point for old root")
+	}
+	err = syscall.PivotRoot(root, oldRoot)
+	if err != nil {
+		return errors.Wrap(err, "Unable to pivot root")
+	}
+	err = os.Chdir("/")
+	if err != nil {
+		return errors.Wrap(err, "Unable to enter new root")
+	}
+	err = syscall.Unmount("/.oldroot", syscall.MNT_DETACH)
+	if err != nil {
+		return errors.Wrap(err, "Unable to unmount old root")
+	}
+	err = os.Remove("/.oldroot")
+	if err != nil {
+		return errors.Wrap(err, "Unable to remove mount point of old root")
+	}
+	err = syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, "")
+	if err != nil {
+		return errors.Wrap(err, "Unable to make root read-only")
+	}
+	return nil
+}
+
+// bindMount mounts source at target, ignoring setuid bits
+func bindMount(source string, target string, readOnly bool, flags uintptr) error {
+	err := syscall.Mount(source, target, "", syscall.MS_BIND|flags, "")
+	if err != nil {
+		return errors.Wrapf(err, "Unable to mount %s", source)
+	}
+	remountFlags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_NOSUID)
+	if readOnly {
+		remountFlags |= syscall.MS_RDONLY
+	}
+	// Flags of the original mount may be locked, so they must be kept
+	var stat syscall.Statfs_t
+	if syscall.Statfs(source, &stat) == nil {
+		for _, flag := range []uintptr{syscall.MS_NODEV, syscall.MS_NOEXEC, syscall.MS_NOATIME, syscall.MS_NODIRATIME, syscall.MS_RDONLY} {
+			if uintptr(stat.Flags)&flag != 0 { // ST_* flags share values with these MS_* flags
+				remountFlags |= flag
+			}
+		}
+	}
+	err = syscall.Mount("", target, "", remountFlags, "")
+	if err != nil {
+		return errors.Wrapf(err, "Unable to restrict mount of %s", source)
+	}
+	return nil
+}
+
+// createEmptyFile creates an empty file to bind-mount a device over
+func createEmptyFile(filePath string) error {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
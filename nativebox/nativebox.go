@@ -0,0 +1,508 @@
+package nativebox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/programming-in-th/grader/isolate"
+	"github.com/programming-in-th/grader/util"
+)
+
+// DefaultCgroupPath is the cgroup v2 directory boxes are created in if none is configured.
+// The memory and pids controllers must be available in it
+const DefaultCgroupPath = "/sys/fs/cgroup/grader"
+
+// BoxBasePath is the directory the box directories are created in
+const BoxBasePath = "/var/local/lib/nativebox"
+
+// firstUID is the first host user and group ID used by boxes. Box i uses firstUID + 2i while setting up
+// and firstUID + 2i + 1 while running the program, so boxes never share IDs
+const firstUID = 60000
+
+// boxUID is the user and group ID programs run as inside the box
+const boxUID = 1000
+
+// Box is a sandbox built directly on Linux namespaces and a cgroup v2 subtree, without the isolate binary.
+// Programs run as an unprivileged user in their own mount, PID, network, IPC and UTS namespaces, on a
+// read-only root that contains only the host's system directories and the box directory /box
+type Box struct {
+	boxID      int
+	cgroupPath string // Parent of the cgroups of runs in this box
+	boxPath    string // Contains the box directory and the mount point of the root of the box
+	quota      isolate.Quota
+}
+
+// New creates a Box that creates the cgroups of its runs in cgroupPath.
+// If cgroupPath is empty, DefaultCgroupPath is used. If a quota is given, the box directory is a tmpfs
+// that is resized before every run, so files the program writes there also count towards its memory usage
+func New(boxID int, cgroupPath string, quota isolate.Quota) *Box {
+	if cgroupPath == "" {
+		cgroupPath = DefaultCgroupPath
+	}
+	return &Box{
+		boxID:      boxID,
+		cgroupPath: cgroupPath,
+		boxPath:    path.Join(BoxBasePath, strconv.Itoa(boxID)),
+		quota:      quota,
+	}
+}
+
+func (box *Box) boxDirectory() string {
+	return path.Join(box.boxPath, "box")
+}
+
+func (box *Box) hostUID() int {
+	return firstUID + 2*box.boxID + 1
+}
+
+// Init creates the box directory and makes sure the cgroup controllers boxes need are enabled
+func (box *Box) Init() error {
+	if os.Geteuid() != 0 {
+		return errors.New("Init failed: the native sandbox must be run as root")
+	}
+	if _, err := os.Stat(box.boxPath); err == nil {
+		return errors.Errorf("Box %d already exists. It must be cleaned up first", box.boxID)
+	}
+
+	for _, dir := range []string{box.boxDirectory(), path.Join(box.boxPath, "root")} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to create %s", dir)
+		}
+	}
+	if box.quota != (isolate.Quota{}) {
+		err := syscall.Mount("tmpfs", box.boxDirectory(), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=755")
+		if err != nil {
+			return errors.Wrap(err, "Unable to mount box directory")
+		}
+	}
+	err := os.Chown(box.boxDirectory(), box.hostUID(), box.hostUID())
+	if err != nil {
+		return errors.Wrap(err, "Unable to hand the box directory to the box user")
+	}
+
+	err = os.MkdirAll(box.cgroupPath, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to create cgroup %s. Is cgroup v2 mounted?", box.cgroupPath)
+	}
+	err = ioutil.WriteFile(path.Join(box.cgroupPath, "cgroup.subtree_control"), []byte("+memory +pids +cpu"), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to enable the memory, pids and cpu controllers in %s", box.cgroupPath)
+	}
+	return nil
+}
+
+// CopyIn copies the file at srcPath into the box directory as name, keeping its permissions
+func (box *Box) CopyIn(srcPath string, name string) error {
+	dstPath := path.Join(box.boxDirectory(), name)
+	err := box.mkdirAll(path.Dir(dstPath))
+	if err == nil {
+		err = copyFile(srcPath, dstPath)
+	}
+	if err == nil {
+		err = os.Chown(dstPath, box.hostUID(), box.hostUID())
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Unable to copy %s into box directory", srcPath)
+	}
+	return nil
+}
+
+// mkdirAll creates dir and its parents inside the box directory, owned by the user of the box
+func (box *Box) mkdirAll(dir string) error {
+	if dir == box.boxDirectory() || !strings.HasPrefix(dir, box.boxDirectory()+"/") {
+		return nil
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	err := box.mkdirAll(path.Dir(dir))
+	if err == nil {
+		err = os.Mkdir(dir, 0755)
+	}
+	if err == nil {
+		err = os.Chown(dir, box.hostUID(), box.hostUID())
+	}
+	return err
+}
+
+// CopyOut copies the file name out of the box directory to dstPath
+func (box *Box) CopyOut(name string, dstPath string) error {
+	srcPath := path.Join(box.boxDirectory(), name)
+	// The program may have replaced the file with a link to somewhere outside the box
+	info, err := os.Lstat(srcPath)
+	if err == nil && !info.Mode().IsRegular() {
+		err = errors.New("not a regular file")
+	}
+	if err == nil {
+		err = copyFile(srcPath, dstPath)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Unable to copy %s out of box directory", name)
+	}
+	return nil
+}
+
+// Reset empties the box directory
+func (box *Box) Reset() error {
+	err := util.RemoveDirContents(box.boxDirectory())
+	if err != nil {
+		return errors.Wrap(err, "Unable to empty box directory")
+	}
+	return nil
+}
+
+// Cleanup removes the box directory
+func (box *Box) Cleanup() error {
+	syscall.Unmount(box.boxDirectory(), syscall.MNT_DETACH) // Only mounted if the box has a quota
+	return os.RemoveAll(box.boxPath)
+}
+
+// applyQuota resizes the box directory so the program can add exactly the quota to the files already in it
+func (box *Box) applyQuota() error {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(box.boxDirectory(), &stat)
+	if err != nil {
+		return errors.Wrap(err, "Unable to get usage of box directory")
+	}
+	size := int64(stat.Blocks-stat.Bfree)*stat.Bsize + int64(box.quota.Blocks)*1024
+	inodes := stat.Files - stat.Ffree + uint64(box.quota.Inodes)
+	options := "size=" + strconv.FormatInt(size, 10) + ",nr_inodes=" + strconv.FormatUint(inodes, 10)
+	err = syscall.Mount("", box.boxDirectory(), "", syscall.MS_REMOUNT|syscall.MS_NOSUID|syscall.MS_NODEV, options)
+	if err != nil {
+		return errors.Wrap(err, "Unable to resize box directory")
+	}
+	return nil
+}
+
+// quotaExhausted reports whether the program used up the quota of the box directory
+func (box *Box) quotaExhausted() bool {
+	var stat syscall.Statfs_t
+	if box.quota == (isolate.Quota{}) || syscall.Statfs(box.boxDirectory(), &stat) != nil {
+		return false
+	}
+	return stat.Bfree == 0 || stat.Ffree == 0
+}
+
+func copyFile(srcPath string, dstPath string) error {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	contents, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dstPath, contents, info.Mode().Perm())
+}
+
+// runCgroup creates a new cgroup for one run with the given limits. Every run gets a fresh cgroup
+// so that peak memory usage and OOM kills are counted from zero
+func (box *Box) runCgroup(options isolate.RunOptions) (string, error) {
+	cgroupPath := path.Join(box.cgroupPath, "box-"+strconv.Itoa(box.boxID))
+	removeCgroup(cgroupPath) // Left behind if the grader crashed during a run
+	err := os.Mkdir(cgroupPath, 0755)
+	if err != nil {
+		return "", errors.Wrapf(err, "Unable to create cgroup %s", cgroupPath)
+	}
+
+	maxProcesses := options.MaxProcesses
+	if maxProcesses <= 0 {
+		maxProcesses = isolate.DefaultMaxProcesses
+	}
+	limits := [][2]string{
+		{"memory.max", strconv.Itoa(options.MemoryLimit * 1024)},
+		{"memory.swap.max", "0"},
+		{"pids.max", strconv.Itoa(maxProcesses)},
+	}
+	for _, limit := range limits {
+		err := ioutil.WriteFile(path.Join(cgroupPath, limit[0]), []byte(limit[1]), 0644)
+		if err != nil && !(os.IsNotExist(err) && limit[0] == "memory.swap.max") { // Swap accounting may be disabled
+			removeCgroup(cgroupPath)
+			return "", errors.Wrapf(err, "Unable to set %s", limit[0])
+		}
+	}
+	return cgroupPath, nil
+}
+
+// removeCgroup kills every process left in a cgroup and removes it
+func removeCgroup(cgroupPath string) error {
+	if _, err := os.Stat(cgroupPath); os.IsNotExist(err) {
+		return nil
+	}
+	ioutil.WriteFile(path.Join(cgroupPath, "cgroup.kill"), []byte("1"), 0644)
+	var err error
+	for i := 0; i < 50; i++ { // Killed processes take a moment to leave the cgroup
+		err = syscall.Rmdir(cgroupPath)
+		if err != syscall.EBUSY {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
+// Run runs command in the box with the given limits
+func (box *Box) Run(options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics) {
+	verdict, metrics, err := box.run(options, command)
+	if err != nil {
+		log.Println(errors.Wrapf(err, "Native sandbox failed in box %d", box.boxID))
+		return isolate.IsolateRunXX, isolate.RunMetrics{}
+	}
+	// Writes past the quota fail instead of killing the program, which may crash or carry on with partial output
+	if (verdict == isolate.IsolateRunOK || verdict == isolate.IsolateRunRE) && box.quotaExhausted() {
+		verdict = isolate.IsolateRunOLE
+	}
+	return verdict, metrics
+}
+
+func (box *Box) run(options isolate.RunOptions, command []string) (isolate.RunVerdict, isolate.RunMetrics, error) {
+	if len(command) == 0 {
+		return "", isolate.RunMetrics{}, errors.New("No command to run")
+	}
+	if box.quota != (isolate.Quota{}) {
+		err := box.applyQuota()
+		if err != nil {
+			return "", isolate.RunMetrics{}, err
+		}
+	}
+	cgroupPath, err := box.runCgroup(options)
+	if err != nil {
+		return "", isolate.RunMetrics{}, err
+	}
+	defer removeCgroup(cgroupPath)
+
+	cpuLimit := uint64(math.Ceil(options.TimeLimit + options.ExtraTime))
+	if cpuLimit < 1 {
+		cpuLimit = 1 // A limit of 0 would kill the program immediately
+	}
+	fileSizeLimit := rlimInfinity
+	if options.OutputLimit > 0 {
+		fileSizeLimit = uint64(options.OutputLimit) * 1024
+	}
+	stackLimit := rlimInfinity // Memory is limited by the cgroup instead
+	if options.StackLimit > 0 {
+		stackLimit = uint64(options.StackLimit) * 1024
+	}
+	configJSON, err := json.Marshal(initConfig{
+		RootPath:      path.Join(box.boxPath, "root"),
+		BoxPath:       box.boxDirectory(),
+		CPULimit:      cpuLimit,
+		FileSizeLimit: fileSizeLimit,
+		StackLimit:    stackLimit,
+		Command:       command,
+		Env:           options.Env,
+		Directories:   options.Directories,
+		BoxUID:        boxUID,
+		Hostname:      "box-" + strconv.Itoa(box.boxID),
+	})
+	if err != nil {
+		return "", isolate.RunMetrics{}, err
+	}
+
+	// The sync pipe holds the init process back until it is in its cgroup. The error pipe is
+	// closed on exec, so anything read from it is an error from setting up the box
+	syncReader, syncWriter, err := os.Pipe()
+	if err != nil {
+		return "", isolate.RunMetrics{}, err
+	}
+	defer syncWriter.Close()
+	errorReader, errorWriter, err := os.Pipe()
+	if err != nil {
+		syncReader.Close()
+		return "", isolate.RunMetrics{}, err
+	}
+	defer errorReader.Close()
+
+	setupID := firstUID + 2*box.boxID
+	cmd := &exec.Cmd{
+		Path:       "/proc/self/exe",
+		Args:       []string{initArg, string(configJSON)},
+		Env:        []string{},
+		ExtraFiles: []*os.File{syncReader, errorWriter},
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET |
+				syscall.CLONE_NEWUSER | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+			UidMappings: []syscall.SysProcIDMap{
+				{ContainerID: 0, HostID: setupID, Size: 1},
+				{ContainerID: boxUID, HostID: setupID + 1, Size: 1},
+			},
+			GidMappings: []syscall.SysProcIDMap{
+				{ContainerID: 0, HostID: setupID, Size: 1},
+				{ContainerID: boxUID, HostID: setupID + 1, Size: 1},
+			},
+			Credential: &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true},
+			Pdeathsig:  syscall.SIGKILL,
+		},
+	}
+	if options.Stdin != "" {
+		stdin, err := os.Open(path.Join(box.boxDirectory(), options.Stdin))
+		if err != nil {
+			return "", isolate.RunMetrics{}, errors.Wrap(err, "Unable to open stdin")
+		}
+		defer stdin.Close()
+		cmd.Stdin = stdin
+	}
+	if options.Stdout != "" {
+		stdoutPath := path.Join(box.boxDirectory(), options.Stdout)
+		stdout, err := os.OpenFile(stdoutPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0644)
+		if err != nil {
+			return "", isolate.RunMetrics{}, errors.Wrap(err, "Unable to create stdout")
+		}
+		defer stdout.Close()
+		os.Chown(stdoutPath, box.hostUID(), box.hostUID())
+		cmd.Stdout = stdout
+	}
+	if options.StderrToStdout {
+		cmd.Stderr = cmd.Stdout
+	} else if options.Stderr != "" {
+		stderrPath := path.Join(box.boxDirectory(), options.Stderr)
+		stderr, err := os.OpenFile(stderrPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0644)
+		if err != nil {
+			return "", isolate.RunMetrics{}, errors.Wrap(err, "Unable to create stderr")
+		}
+		defer stderr.Close()
+		os.Chown(stderrPath, box.hostUID(), box.hostUID())
+		cmd.Stderr = stderr
+	}
+
+	err = cmd.Start()
+	syncReader.Close()
+	errorWriter.Close()
+	if err != nil {
+		return "", isolate.RunMetrics{}, errors.Wrap(err, "Unable to start box")
+	}
+	err = ioutil.WriteFile(path.Join(cgroupPath, "cgroup.procs"), []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return "", isolate.RunMetrics{}, errors.Wrap(err, "Unable to move box into its cgroup")
+	}
+	syncWriter.Write([]byte{0})
+	syncWriter.Close()
+
+	// Killing the init process of the PID namespace kills everything in the box
+	timer := time.AfterFunc(time.Duration(options.WallClockLimit()*float64(time.Second)), func() {
+		cmd.Process.Kill()
+	})
+	err = cmd.Wait()
+	wallClockExceeded := !timer.Stop() // The timer has already fired
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return "", isolate.RunMetrics{}, errors.Wrap(err, "Unable to wait for box")
+	}
+	setupError, _ := ioutil.ReadAll(errorReader)
+	if len(setupError) > 0 {
+		return "", isolate.RunMetrics{}, errors.Errorf("Unable to set up box: %s", setupError)
+	}
+
+	stats, err := readCgroupStats(cgroupPath)
+	if err != nil {
+		return "", isolate.RunMetrics{}, err
+	}
+	status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if stats.memoryUsage == 0 {
+		// memory.peak is only available from Linux 5.19
+		stats.memoryUsage = int(cmd.ProcessState.SysUsage().(*syscall.Rusage).Maxrss)
+	}
+	metrics := isolate.RunMetrics{
+		TimeElapsed: stats.timeElapsed,
+		MemoryUsage: stats.memoryUsage,
+	}
+	if status.Exited() {
+		metrics.ExitCode = status.ExitStatus()
+	}
+	if status.Signaled() {
+		metrics.ExitSignal = int(status.Signal())
+	}
+	// The CPU time limit is enforced with SIGXCPU, or with SIGKILL once the hard limit is reached
+	cpuTimeKilled := status.Signaled() && (status.Signal() == syscall.SIGXCPU ||
+		(status.Signal() == syscall.SIGKILL && float64(metrics.TimeElapsed) > options.TimeLimit*1000))
+	metrics.Killed = wallClockExceeded || stats.oomKilled || cpuTimeKilled
+	return classifyRun(options, status, wallClockExceeded, stats), metrics, nil
+}
+
+// cgroupStats is the resource usage of a run as accounted by its cgroup
+type cgroupStats struct {
+	timeElapsed int // CPU time in milliseconds
+	memoryUsage int // Peak memory usage in KiB
+	oomKilled   bool
+}
+
+// readKeyedFile parses a cgroup file made of "key value" lines, like cpu.stat and memory.events
+func readKeyedFile(filePath string) (map[string]int64, error) {
+	contents, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]int64)
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to parse %s", filePath)
+		}
+		values[fields[0]] = value
+	}
+	return values, nil
+}
+
+func readCgroupStats(cgroupPath string) (cgroupStats, error) {
+	stats := cgroupStats{}
+	cpuStat, err := readKeyedFile(path.Join(cgroupPath, "cpu.stat"))
+	if err != nil {
+		return stats, errors.Wrap(err, "Unable to read CPU usage")
+	}
+	stats.timeElapsed = int(math.Round(float64(cpuStat["usage_usec"]) / 1000))
+
+	memoryEvents, err := readKeyedFile(path.Join(cgroupPath, "memory.events"))
+	if err != nil {
+		return stats, errors.Wrap(err, "Unable to read memory events")
+	}
+	stats.oomKilled = memoryEvents["oom_kill"] > 0
+
+	peak, err := ioutil.ReadFile(path.Join(cgroupPath, "memory.peak"))
+	if err == nil {
+		peakBytes, err := strconv.ParseInt(strings.TrimSpace(string(peak)), 10, 64)
+		if err != nil {
+			return stats, errors.Wrap(err, "Unable to parse peak memory usage")
+		}
+		stats.memoryUsage = int(peakBytes / 1024)
+	}
+	return stats, nil
+}
+
+// classifyRun decides the verdict of a finished run the way isolate does: exceeding the time limit
+// takes precedence over everything else, and memory is only blamed for runs that did not exit normally.
+// A run killed by the wall clock limit without using up its CPU time was idle
+func classifyRun(options isolate.RunOptions, status syscall.WaitStatus, wallClockExceeded bool, stats cgroupStats) isolate.RunVerdict {
+	withinTimeLimit := float64(stats.timeElapsed) <= options.TimeLimit*1000
+	if wallClockExceeded && withinTimeLimit {
+		return isolate.IsolateRunILE
+	}
+	if wallClockExceeded || !withinTimeLimit || (status.Signaled() && status.Signal() == syscall.SIGXCPU) {
+		return isolate.IsolateRunTLE
+	}
+	if status.Exited() && status.ExitStatus() == 0 {
+		return isolate.IsolateRunOK
+	}
+	if stats.oomKilled || stats.memoryUsage > options.MemoryLimit {
+		return isolate.IsolateRunMLE
+	}
+	if status.Signaled() {
+		return isolate.SignalVerdict(status.Signal())
+	}
+	return isolate.IsolateRunRE
+}
@@ -0,0 +1,180 @@
+package nativebox
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/programming-in-th/grader/isolate"
+)
+
+func TestReadCgroupStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nativebox_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"cpu.stat":      "usage_usec 1234567\nuser_usec 1200000\nsystem_usec 34567\n",
+		"memory.events": "low 0\nhigh 0\nmax 12\noom 1\noom_kill 1\n",
+		"memory.peak":   "67108864\n",
+	}
+	for name, contents := range files {
+		err := ioutil.WriteFile(path.Join(dir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := readCgroupStats(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := cgroupStats{timeElapsed: 1235, memoryUsage: 65536, oomKilled: true}
+	if stats != expected {
+		t.Errorf("Got %+v, expected %+v", stats, expected)
+	}
+
+	// memory.peak is missing before Linux 5.19
+	os.Remove(path.Join(dir, "memory.peak"))
+	stats, err = readCgroupStats(dir)
+	if err != nil || stats.memoryUsage != 0 {
+		t.Errorf("Got %+v, %v without memory.peak", stats, err)
+	}
+}
+
+func TestClassifyRun(t *testing.T) {
+	options := isolate.RunOptions{TimeLimit: 1, ExtraTime: 1, MemoryLimit: 65536}
+	exited := func(code int) syscall.WaitStatus {
+		return syscall.WaitStatus(code << 8)
+	}
+	signaled := func(signal syscall.Signal) syscall.WaitStatus {
+		return syscall.WaitStatus(signal)
+	}
+	tests := []struct {
+		name     string
+		status   syscall.WaitStatus
+		wall     bool
+		stats    cgroupStats
+		expected isolate.RunVerdict
+	}{
+		{"OK", exited(0), false, cgroupStats{timeElapsed: 500, memoryUsage: 1000}, isolate.IsolateRunOK},
+		{"CPU time", exited(0), false, cgroupStats{timeElapsed: 1001}, isolate.IsolateRunTLE},
+		{"SIGXCPU", signaled(syscall.SIGXCPU), false, cgroupStats{timeElapsed: 900}, isolate.IsolateRunTLE},
+		{"Wall clock", signaled(syscall.SIGKILL), true, cgroupStats{timeElapsed: 1500}, isolate.IsolateRunTLE},
+		{"Idle", signaled(syscall.SIGKILL), true, cgroupStats{timeElapsed: 10}, isolate.IsolateRunILE},
+		{"File size", signaled(syscall.SIGXFSZ), false, cgroupStats{timeElapsed: 10}, isolate.IsolateRunOLE},
+		{"Forbidden system call", signaled(syscall.SIGSYS), false, cgroupStats{timeElapsed: 10}, isolate.IsolateRunSV},
+		{"OOM kill", signaled(syscall.SIGKILL), false, cgroupStats{timeElapsed: 10, oomKilled: true}, isolate.IsolateRunMLE},
+		{"Exit code", exited(1), false, cgroupStats{timeElapsed: 10}, isolate.IsolateRunRE},
+		{"Segfault", signaled(syscall.SIGSEGV), false, cgroupStats{timeElapsed: 10}, isolate.IsolateRunRE},
+	}
+	for _, test := range tests {
+		verdict := classifyRun(options, test.status, test.wall, test.stats)
+		if verdict != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.name, verdict, test.expected)
+		}
+	}
+}
+
+// TestRun needs root and a cgroup v2 hierarchy with the memory controller at /sys/fs/cgroup
+func TestRun(t *testing.T) {
+	controllers, err := ioutil.ReadFile("/sys/fs/cgroup/cgroup.controllers")
+	if os.Geteuid() != 0 || err != nil || !strings.Contains(string(controllers), "memory") {
+		t.Skip("Needs root and cgroup v2")
+	}
+	dir, err := ioutil.TempDir("", "nativebox_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := path.Join(dir, "run")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\nread a b\necho $((a * b))\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := path.Join(dir, "input")
+	err = ioutil.WriteFile(input, []byte("5 2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	box := New(999, "", isolate.Quota{})
+	err = box.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer box.Cleanup()
+	for _, file := range [][2]string{{script, "run"}, {input, "input"}} {
+		err = box.CopyIn(file[0], file[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	verdict, metrics := box.Run(isolate.RunOptions{TimeLimit: 1, ExtraTime: 1, MemoryLimit: 65536, Stdin: "input", Stdout: "output"}, []string{"run"})
+	if verdict != isolate.IsolateRunOK {
+		t.Fatalf("Got verdict %s, expected %s", verdict, isolate.IsolateRunOK)
+	}
+	t.Log(metrics)
+	output := path.Join(dir, "output")
+	err = box.CopyOut("output", output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadFile(output)
+	if string(contents) != "10\n" {
+		t.Errorf("Got output %q, expected \"10\\n\"", contents)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nativebox_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	box := &Box{boxID: 999, boxPath: dir, quota: isolate.Quota{Blocks: 64, Inodes: 4}}
+	err = os.Mkdir(box.boxDirectory(), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Mount("tmpfs", box.boxDirectory(), "tmpfs", 0, "mode=755")
+	if err != nil {
+		t.Skip("Mounting a tmpfs needs root: ", err)
+	}
+	defer box.Cleanup()
+
+	// The quota is on top of the files already in the box
+	err = ioutil.WriteFile(path.Join(box.boxDirectory(), "input"), make([]byte, 1024*1024), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = box.applyQuota()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(box.boxDirectory(), "small"), make([]byte, 16*1024), 0644)
+	if err != nil || box.quotaExhausted() {
+		t.Errorf("Writing 16 KiB failed or exhausted the quota: %v", err)
+	}
+	err = ioutil.WriteFile(path.Join(box.boxDirectory(), "large"), make([]byte, 64*1024), 0644)
+	if err == nil || !box.quotaExhausted() {
+		t.Errorf("Writing 64 KiB more did not exhaust the quota: %v", err)
+	}
+}
+
+func TestSetEnv(t *testing.T) {
+	env := []string{"PATH=/bin", "HOME=/box"}
+	env = setEnv(env, "PATH=/opt/bin:/bin")
+	env = setEnv(env, "LANG=C.UTF-8")
+	expected := []string{"PATH=/opt/bin:/bin", "HOME=/box", "LANG=C.UTF-8"}
+	if strings.Join(env, " ") != strings.Join(expected, " ") {
+		t.Errorf("Got %v, expected %v", env, expected)
+	}
+	if !isInside("/usr/lib/jvm", []string{"/bin", "/usr"}) || isInside("/usrlocal", []string{"/usr"}) {
+		t.Error("isInside is wrong")
+	}
+}
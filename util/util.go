@@ -1,6 +1,10 @@
 package util
 
-import "os"
+import (
+	"io/ioutil"
+	"os"
+	"path"
+)
 
 func CreateDirIfNotExist(path string) error {
 	_, err := os.Stat(path)
@@ -12,3 +16,18 @@ func CreateDirIfNotExist(path string) error {
 	}
 	return nil
 }
+
+// RemoveDirContents removes everything inside dir, but not dir itself
+func RemoveDirContents(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err := os.RemoveAll(path.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}